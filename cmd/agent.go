@@ -0,0 +1,126 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	ddns "github.com/tnyeanderson/ddns/pkg"
+)
+
+var agentCmd = &cobra.Command{
+	Use:   "agent [domain]",
+	Args:  cobra.MaximumNArgs(1),
+	Short: "Keep the records for one or more domains up to date",
+	Long: `Keep the record for a domain pointing at the public IP of the current
+machine. The IP is checked periodically using the DDNS API, and the record is
+only updated when the IP changes, or when the refresh interval has passed.
+Errors are retried with exponential backoff. Stops on SIGINT or SIGTERM.
+
+If no domain is given, the jobs in the "agent.jobs" section of the config file
+are run instead. Each job can update several domains with its own record type,
+IP source, server, API key and interval.
+
+With --once, the IP is checked a single time, for running the agent from cron.
+Set a state file, so that the update is only sent when the IP changes.
+
+When run by systemd with Type=notify, the agent reports when it is ready and
+the result of each check, and sends keep-alive messages if WatchdogSec is set,
+as long as no check is stuck.
+
+See "ddns help" for a list of supported environment variables.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		c := mustInitConfig(cmd)
+		if once, _ := cmd.Flags().GetBool("once"); once {
+			c.Agent.Once = true
+		}
+		mustValidate(c.Agent.Validate())
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		go ddns.NotifyWatchdog(ctx)
+		if c.Agent.StatusListener != "" && !c.Agent.Once {
+			go func() {
+				slog.Info("starting status server", "listener", c.Agent.StatusListener)
+				if err := c.Agent.ServeStatus(ctx); err != nil {
+					slog.Error(err.Error())
+					os.Exit(1)
+				}
+			}()
+		}
+
+		var err error
+		if len(args) == 0 {
+			err = c.Agent.RunJobs(ctx)
+		} else {
+			slog.Info("starting agent", "domain", args[0], "server", c.Agent.ServerAddress)
+			err = c.Agent.Run(ctx, args[0])
+		}
+		if err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+	},
+}
+
+var agentStatusCmd = &cobra.Command{
+	Use:   "status",
+	Args:  cobra.NoArgs,
+	Short: "Show the status of the agent",
+	Long: `Show the last detected and pushed IP, and the result of the last check,
+for each domain kept up to date by the agent. The status is read from the state
+file, or from the status endpoint of a running agent if there is no state file.
+
+Exits with an error if the last check failed for any domain.
+
+See "ddns help" for a list of supported environment variables.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		c := mustInitConfig(cmd)
+
+		status, err := c.Agent.Status(cmd.Context())
+		if err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "DOMAIN\tSERVER\tSOURCE\tDETECTED\tPUSHED\tLAST SUCCESS\tLAST FAILURE\tERROR")
+		for _, r := range status.Records {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.Domain, r.Server, r.Source, orDash(r.DetectedIP), orDash(r.PushedIP), timeOrDash(r.LastSuccess), timeOrDash(r.LastFailure), orDash(r.Error))
+		}
+		w.Flush()
+
+		if len(status.Failing()) > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func timeOrDash(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+func init() {
+	agentCmd.Flags().Bool("once", false, "check the IP once and exit")
+	addSettingFlags(agentCmd.Flags(), scopeClient|scopeUpdate|scopeAgent)
+	addSettingFlags(agentStatusCmd.Flags(), scopeStatus)
+	agentCmd.AddCommand(agentStatusCmd)
+	rootCmd.AddCommand(agentCmd)
+}
@@ -2,27 +2,83 @@ package cmd
 
 import (
 	"fmt"
-	"log/slog"
+	"net/netip"
 	"os"
-	"regexp"
 	"strings"
 
+	"github.com/spf13/pflag"
 	ddns "github.com/tnyeanderson/ddns/pkg"
-	"gopkg.in/yaml.v3"
 )
 
 const (
 	// EnvConfigFile is the path to a YAML config file for the server.
 	EnvConfigFile = "DDNS_CONFIG_FILE"
 
-	EnvAPIServer = "DDNS_API_SERVER" // sets [Agent.ServerAddress]
+	EnvAPIServer = "DDNS_API_SERVER" // sets [Agent.ServerAddress], and [Agent.ServerAddresses] if there are several
 	EnvAPIKey    = "DDNS_API_KEY"    // sets [Agent.APIKey]
 
-	EnvServerAPIKey       = "DDNS_SERVER_API_KEY"       // sets a key in [Server.AllowedAPIKeys]
-	EnvServerAPIKeyRegex  = "DDNS_SERVER_API_KEY_REGEX" // sets the value for the [EnvServerAPIKey] key in [Server.AllowedAPIKeys]
-	EnvServerHostsFile    = "DDNS_SERVER_HOSTS_FILE"    // sets [Server.HostsFile]
-	EnvServerHTTPListener = "DDNS_SERVER_HTTP_LISTENER" // sets [Server.HTTPListener]
-	EnvServerDNSListener  = "DDNS_SERVER_DNS_LISTENER"  // sets [Server.DNSListener]
+	EnvAPITimeout        = "DDNS_API_TIMEOUT"          // sets [Agent.Timeout]
+	EnvAPICAFile         = "DDNS_API_CA_FILE"          // sets [Agent.CAFile]
+	EnvAPIClientCertFile = "DDNS_API_CLIENT_CERT_FILE" // sets [Agent.ClientCertFile]
+	EnvAPIClientKeyFile  = "DDNS_API_CLIENT_KEY_FILE"  // sets [Agent.ClientKeyFile]
+	EnvAPIProxy          = "DDNS_API_PROXY"            // sets [Agent.Proxy]
+
+	EnvAgentInterval        = "DDNS_AGENT_INTERVAL"           // sets [Agent.Interval]
+	EnvAgentRefreshInterval = "DDNS_AGENT_REFRESH_INTERVAL"   // sets [Agent.RefreshInterval]
+	EnvAgentMaxBackoff      = "DDNS_AGENT_MAX_BACKOFF"        // sets [Agent.MaxBackoff]
+	EnvAgentServerMode      = "DDNS_AGENT_SERVER_MODE"        // sets [Agent.ServerMode]
+	EnvAgentVerify          = "DDNS_AGENT_VERIFY"             // sets [Agent.Verify]
+	EnvAgentVerifyNS        = "DDNS_AGENT_VERIFY_NAMESERVERS" // sets [Agent.VerifyNameservers]
+	EnvAgentVerifyTimeout   = "DDNS_AGENT_VERIFY_TIMEOUT"     // sets [Agent.VerifyTimeout]
+
+	EnvAgentHookBefore = "DDNS_AGENT_HOOK_BEFORE" // adds a [HookBefore] command to [Agent.Hooks]
+	EnvAgentHookAfter  = "DDNS_AGENT_HOOK_AFTER"  // adds a [HookAfter] command to [Agent.Hooks]
+	EnvAgentHookURL    = "DDNS_AGENT_HOOK_URL"    // adds a [HookAfter] callback to [Agent.Hooks]
+
+	EnvAgentStateFile      = "DDNS_AGENT_STATE_FILE"      // sets [Agent.StateFile]
+	EnvAgentStatusListener = "DDNS_AGENT_STATUS_LISTENER" // sets [Agent.StatusListener]
+
+	EnvAgentSource    = "DDNS_AGENT_SOURCE"    // sets [IPSourceConfig.Type] for [Agent.Source]
+	EnvAgentInterface = "DDNS_AGENT_INTERFACE" // sets [IPSourceConfig.Interface] for [Agent.Source]
+	EnvAgentFamily    = "DDNS_AGENT_FAMILY"    // sets [IPSourceConfig.Family] for [Agent.Source]
+	EnvAgentWatch     = "DDNS_AGENT_WATCH"     // sets [IPSourceConfig.Watch] for [Agent.Source]
+	EnvAgentCommand   = "DDNS_AGENT_COMMAND"   // sets [IPSourceConfig.Command] for [Agent.Source]
+
+	EnvAgentSourceServer = "DDNS_AGENT_SOURCE_SERVER" // sets [IPSourceConfig.Server] for [Agent.Source]
+	EnvAgentSourceURL    = "DDNS_AGENT_SOURCE_URL"    // sets [IPSourceConfig.URL] for [Agent.Source]
+	EnvAgentSourceName   = "DDNS_AGENT_SOURCE_NAME"   // sets [IPSourceConfig.Name] for [Agent.Source]
+
+	EnvServerAPIKey      = "DDNS_SERVER_API_KEY"       // sets a key in [Server.AllowedAPIKeys]
+	EnvServerAPIKeyRegex = "DDNS_SERVER_API_KEY_REGEX" // sets the value for the [EnvServerAPIKey] key in [Server.AllowedAPIKeys]
+	EnvServerHostsFile   = "DDNS_SERVER_HOSTS_FILE"    // sets [Server.HostsFile]
+	EnvServerKeysFile    = "DDNS_SERVER_KEYS_FILE"     // sets [Server.KeysFile]
+
+	EnvServerHostsFileBackups = "DDNS_SERVER_HOSTS_FILE_BACKUPS" // sets [Server.HostsFileBackups]
+	EnvServerStoreType        = "DDNS_SERVER_STORE_TYPE"         // sets [Server.StoreType]
+	EnvServerStorePath        = "DDNS_SERVER_STORE_PATH"         // sets [Server.StorePath]
+	EnvServerHTTPListener     = "DDNS_SERVER_HTTP_LISTENER"      // sets [Server.HTTPListener]
+	EnvServerDNSListener      = "DDNS_SERVER_DNS_LISTENER"       // sets [Server.DNSListener]
+	EnvServerTLSCertFile      = "DDNS_SERVER_TLS_CERT_FILE"      // sets [Server.TLSCertFile]
+	EnvServerTLSKeyFile       = "DDNS_SERVER_TLS_KEY_FILE"       // sets [Server.TLSKeyFile]
+
+	EnvServerAuditLogFile   = "DDNS_SERVER_AUDIT_LOG_FILE"  // sets [Server.AuditLogFile]
+	EnvServerAuditRetention = "DDNS_SERVER_AUDIT_RETENTION" // sets [Server.AuditRetention]
+
+	EnvServerWebhookURL            = "DDNS_SERVER_WEBHOOK_URL"              // adds a [Webhook] to [Server.Webhooks]
+	EnvServerWebhookSecret         = "DDNS_SERVER_WEBHOOK_SECRET"           // sets [Webhook.Secret] for the [EnvServerWebhookURL] webhook
+	EnvServerWebhookDeadLetterFile = "DDNS_SERVER_WEBHOOK_DEAD_LETTER_FILE" // sets [Server.WebhookDeadLetterFile]
+
+	EnvServerTrustedProxies = "DDNS_SERVER_TRUSTED_PROXIES" // sets [Server.TrustedProxies] (comma separated)
+	EnvServerProxyProtocol  = "DDNS_SERVER_PROXY_PROTOCOL"  // sets [Server.ProxyProtocol]
+
+	EnvServerACMEDomains   = "DDNS_SERVER_ACME_DOMAINS"   // sets [ACMEConfig.Domains] (comma separated)
+	EnvServerACMEEmail     = "DDNS_SERVER_ACME_EMAIL"     // sets [ACMEConfig.Email]
+	EnvServerACMEDirectory = "DDNS_SERVER_ACME_DIRECTORY" // sets [ACMEConfig.DirectoryURL]
+	EnvServerACMECacheDir  = "DDNS_SERVER_ACME_CACHE_DIR" // sets [ACMEConfig.CacheDir]
+
+	EnvServerZoneOrigin      = "DDNS_SERVER_ZONE_ORIGIN"      // sets [ZoneConfig.Origin]
+	EnvServerZoneNameservers = "DDNS_SERVER_ZONE_NAMESERVERS" // sets [ZoneConfig.Nameservers] (comma separated)
+	EnvServerZoneHostmaster  = "DDNS_SERVER_ZONE_HOSTMASTER"  // sets [ZoneConfig.Hostmaster]
 )
 
 // Config contains the configuration used by the ddns CLI. It is also the data
@@ -30,11 +86,22 @@ const (
 type Config struct {
 	Agent  *ddns.Agent
 	Server *ddns.Server
+
+	// path is the config file which was read, if any
+	path string
 }
 
 // Init tries to set the values in [c], first using a YAML config file (if
-// provided), then using environment variables.
+// provided), then using environment variables. Unknown keys in the config
+// file are errors.
 func (c *Config) Init() error {
+	return c.InitFlags(nil)
+}
+
+// InitFlags is like [Config.Init], but the flags which were set in flags
+// override the environment variables. The precedence is: flags, environment
+// variables, the config file, then the defaults.
+func (c *Config) InitFlags(flags *pflag.FlagSet) error {
 	if c.Agent == nil {
 		c.Agent = &ddns.Agent{}
 	}
@@ -44,70 +111,99 @@ func (c *Config) Init() error {
 	}
 
 	// Read YAML config if it exists
-	if v := os.Getenv(EnvConfigFile); v != "" {
+	if v := configFilePath(flags); v != "" {
 		b, err := os.ReadFile(v)
 		if err != nil {
-			slog.Error(err.Error())
-			os.Exit(1)
+			return err
 		}
-		if err := yaml.Unmarshal(b, c); err != nil {
-			slog.Error(err.Error())
-			os.Exit(1)
+		if err := decodeConfig(b, c); err != nil {
+			return fmt.Errorf("%s: %w", v, err)
 		}
+		c.path = v
 	}
 
-	// Overwrite config values with env vars, if set
-	c.fromEnv()
-
-	return nil
+	// Overwrite config values with env vars, then flags, if set
+	if err := c.apply(envLookup); err != nil {
+		return err
+	}
+	if flags == nil {
+		return nil
+	}
+	return c.apply(flagLookup(flags))
 }
 
-func (c *Config) fromEnv() {
-	if v := os.Getenv(EnvServerHTTPListener); v != "" {
-		c.Server.HTTPListener = v
+// configFilePath returns the path to the YAML config file, from the flags or
+// the environment.
+func configFilePath(flags *pflag.FlagSet) string {
+	if flags != nil {
+		if _, v, ok := flagLookup(flags)(findSetting(EnvConfigFile)); ok {
+			return v
+		}
 	}
+	return os.Getenv(EnvConfigFile)
+}
 
-	if v := os.Getenv(EnvServerDNSListener); v != "" {
-		c.Server.DNSListener = v
+// apply sets the value of each setting which lookup finds.
+func (c *Config) apply(lookup settingLookup) error {
+	get := func(env string) string {
+		_, v, _ := lookup(findSetting(env))
+		return v
 	}
-
-	if key := os.Getenv(EnvServerAPIKey); key != "" {
-		var r *regexp.Regexp
-		if pattern := os.Getenv(EnvServerAPIKeyRegex); pattern != "" {
-			r = regexp.MustCompile(pattern)
+	for i := range settings {
+		s := &settings[i]
+		if s.apply == nil {
+			continue
+		}
+		name, v, ok := lookup(s)
+		if !ok {
+			continue
+		}
+		if err := s.apply(c, v, get); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
 		}
-		c.Server.Allow(key, r)
 	}
+	return nil
+}
 
-	if v := os.Getenv(EnvServerHostsFile); v != "" {
-		c.Server.HostsFile = v
+// acme returns the ACME config of the server, initializing it if needed.
+func (c *Config) acme() *ddns.ACMEConfig {
+	if c.Server.ACME == nil {
+		c.Server.ACME = &ddns.ACMEConfig{}
 	}
+	return c.Server.ACME
+}
 
-	if v := os.Getenv(EnvAPIServer); v != "" {
-		c.Agent.ServerAddress = v
+// source returns the IP source config of the agent, initializing it if needed.
+func (c *Config) source() *ddns.IPSourceConfig {
+	if c.Agent.Source == nil {
+		c.Agent.Source = &ddns.IPSourceConfig{}
 	}
+	return c.Agent.Source
+}
 
-	if v := os.Getenv(EnvAPIKey); v != "" {
-		c.Agent.APIKey = v
+// zone returns the zone config of the server, initializing it if needed.
+func (c *Config) zone() *ddns.ZoneConfig {
+	if c.Server.Zone == nil {
+		c.Server.Zone = &ddns.ZoneConfig{}
 	}
+	return c.Server.Zone
 }
 
-func getEnvDocs(prefix string) string {
-	// Not a map to preserve deterministic order
-	docs := [][]string{
-		[]string{EnvConfigFile, `Path to a YAML configuration file for DDNS. See the cmd.Config struct for more info.`},
-		[]string{EnvAPIServer, fmt.Sprintf(`(Agent) The scheme/host/port of the DDNS API server, not including the /api base path (default: "%s").`, ddns.DefaultServerAddress)},
-		[]string{EnvAPIKey, `(Agent) The API key used to authenticate to the DDNS API.`},
-		[]string{EnvServerAPIKey, `This API key will be allowed by the server.`},
-		[]string{EnvServerAPIKeyRegex, fmt.Sprintf(`The regex domain matcher for %s.`, EnvServerAPIKey)},
-		[]string{EnvServerHostsFile, `Path to the hosts file used by the server. See Server.HostsFile for more info.`},
-		[]string{EnvServerHTTPListener, fmt.Sprintf(`The TCP listener address for the HTTP server (default: "%s").`, ddns.DefaultHTTPListener)},
-		[]string{EnvServerDNSListener, fmt.Sprintf(`The TCP listener address for the DNS server (default: "%s").`, ddns.DefaultDNSListener)},
-	}
-	s := &strings.Builder{}
-	for _, v := range docs {
-		fmt.Fprintf(s, "%s%s\n", prefix, v[0])
-		fmt.Fprintf(s, "%s  %s\n\n", prefix, v[1])
+// parsePrefixes parses a comma separated list of CIDRs. Bare IPs are treated as
+// single address prefixes.
+func parsePrefixes(s string) ([]netip.Prefix, error) {
+	out := []netip.Prefix{}
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if ip, err := netip.ParseAddr(v); err == nil {
+			out = append(out, netip.PrefixFrom(ip, ip.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(v)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, p)
 	}
-	return s.String()
+	return out, nil
 }
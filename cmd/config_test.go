@@ -1,12 +1,18 @@
 package cmd
 
 import (
+	"fmt"
 	"net"
+	"net/netip"
 	"os"
+	"path/filepath"
 	"regexp"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-test/deep"
+	"github.com/spf13/pflag"
 	ddns "github.com/tnyeanderson/ddns/pkg"
 )
 
@@ -23,9 +29,11 @@ func TestYAMLConfig(t *testing.T) {
 		Agent: &ddns.Agent{
 			ServerAddress: "https://myserver.com:1234",
 			APIKey:        "mysuperdupersecret",
+			Jobs:          testAgentJobs(),
 		},
 		Server: &ddns.Server{
 			HostsFile: "/path/to/hostsfile",
+			APIKeys:   testAPIKeys(),
 			AllowedAPIKeys: map[string]*regexp.Regexp{
 				"mysupersecretkey": regexp.MustCompile("^onlythishost.com$"),
 			},
@@ -50,13 +58,54 @@ func TestYAMLConfigEnvOverride(t *testing.T) {
 
 	// These env vars should override the values from the config file
 	envVals := map[string]string{
-		EnvAPIServer:          "http://serverfromenv.com",
-		EnvAPIKey:             "apikeyfromenv",
-		EnvServerAPIKey:       "allowedkeyfromenv",
-		EnvServerAPIKeyRegex:  ".*",
-		EnvServerHostsFile:    "/path/to/hostsfile/from/env",
-		EnvServerHTTPListener: ":1111",
-		EnvServerDNSListener:  ":9999",
+		EnvAPIServer:         "http://serverfromenv.com,http://otherserverfromenv.com",
+		EnvAPIKey:            "apikeyfromenv",
+		EnvServerAPIKey:      "allowedkeyfromenv",
+		EnvServerAPIKeyRegex: ".*",
+		EnvServerHostsFile:   "/path/to/hostsfile/from/env",
+		EnvServerKeysFile:    "/path/to/keysfile/from/env",
+		EnvServerStoreType:   "sqlite",
+
+		EnvServerHostsFileBackups: "5",
+		EnvServerStorePath:        "/path/to/db/from/env",
+		EnvServerHTTPListener:     ":1111",
+		EnvServerDNSListener:      ":9999",
+		EnvServerTLSCertFile:      "/path/to/cert.pem",
+		EnvServerTLSKeyFile:       "/path/to/key.pem",
+		EnvServerACMEDomains:      "ddns.example.com,api.example.com",
+		EnvServerACMECacheDir:     "/path/to/acme",
+
+		EnvServerTrustedProxies: "10.0.0.0/8, 192.168.1.1",
+		EnvServerProxyProtocol:  "true",
+
+		EnvServerAuditLogFile:   "/path/to/audit.jsonl",
+		EnvServerAuditRetention: "720h",
+
+		EnvServerWebhookURL:    "https://hooks.example.com/ddns",
+		EnvServerWebhookSecret: "webhooksecret",
+
+		EnvAgentInterval:        "1m",
+		EnvAgentRefreshInterval: "1h",
+		EnvAgentServerMode:      "fanout",
+		EnvAPITimeout:           "5s",
+		EnvAgentVerify:          "true",
+		EnvAgentVerifyNS:        "ns1.example.com,192.0.2.1:5353",
+		EnvAgentVerifyTimeout:   "2m",
+		EnvAgentHookBefore:      "wg-quick down wg0",
+		EnvAgentHookURL:         "https://hooks.example.com/ip",
+		EnvAgentStateFile:       "/path/to/state.json",
+		EnvAgentStatusListener:  "127.0.0.1:8053",
+		EnvAPICAFile:            "/path/to/ca.pem",
+		EnvAPIClientCertFile:    "/path/to/client.pem",
+		EnvAPIClientKeyFile:     "/path/to/client-key.pem",
+		EnvAPIProxy:             "http://proxy.example.com:3128",
+		EnvAgentSource:          "interface",
+		EnvAgentInterface:       "eth0",
+		EnvAgentFamily:          "ipv6",
+		EnvAgentWatch:           "true",
+
+		EnvServerZoneOrigin:      "example.com",
+		EnvServerZoneNameservers: "ns1.example.com,ns2.example.com",
 	}
 
 	for k, v := range envVals {
@@ -69,11 +118,41 @@ func TestYAMLConfigEnvOverride(t *testing.T) {
 	}
 	expected := Config{
 		Agent: &ddns.Agent{
-			ServerAddress: envVals[EnvAPIServer],
-			APIKey:        envVals[EnvAPIKey],
+			ServerAddress:     "http://serverfromenv.com",
+			ServerAddresses:   []string{"http://otherserverfromenv.com"},
+			ServerMode:        "fanout",
+			Timeout:           5 * time.Second,
+			Verify:            true,
+			VerifyNameservers: []string{"ns1.example.com", "192.0.2.1:5353"},
+			VerifyTimeout:     2 * time.Minute,
+			StateFile:         "/path/to/state.json",
+			StatusListener:    "127.0.0.1:8053",
+			Hooks: []*ddns.AgentHook{
+				{When: ddns.HookBefore, Command: "wg-quick down wg0"},
+				{When: ddns.HookAfter, URL: "https://hooks.example.com/ip"},
+			},
+			CAFile:          "/path/to/ca.pem",
+			ClientCertFile:  "/path/to/client.pem",
+			ClientKeyFile:   "/path/to/client-key.pem",
+			Proxy:           "http://proxy.example.com:3128",
+			APIKey:          envVals[EnvAPIKey],
+			Interval:        time.Minute,
+			RefreshInterval: time.Hour,
+			Jobs:            testAgentJobs(),
+			Source: &ddns.IPSourceConfig{
+				Type:      "interface",
+				Interface: "eth0",
+				Family:    "ipv6",
+				Watch:     true,
+			},
 		},
 		Server: &ddns.Server{
-			HostsFile: envVals[EnvServerHostsFile],
+			HostsFile:        envVals[EnvServerHostsFile],
+			KeysFile:         envVals[EnvServerKeysFile],
+			StoreType:        envVals[EnvServerStoreType],
+			HostsFileBackups: 5,
+			StorePath:        envVals[EnvServerStorePath],
+			APIKeys:          testAPIKeys(),
 			AllowedAPIKeys: map[string]*regexp.Regexp{
 				"mysupersecretkey":       regexp.MustCompile("^onlythishost.com$"),
 				envVals[EnvServerAPIKey]: regexp.MustCompile(envVals[EnvServerAPIKeyRegex]),
@@ -83,27 +162,257 @@ func TestYAMLConfigEnvOverride(t *testing.T) {
 			Domains: ddns.Domains{
 				"domain1.haha": net.ParseIP("4.3.2.1"),
 			},
+			TLSCertFile: envVals[EnvServerTLSCertFile],
+			TLSKeyFile:  envVals[EnvServerTLSKeyFile],
+			TrustedProxies: []netip.Prefix{
+				netip.MustParsePrefix("10.0.0.0/8"),
+				netip.MustParsePrefix("192.168.1.1/32"),
+			},
+			ProxyProtocol:  true,
+			AuditLogFile:   envVals[EnvServerAuditLogFile],
+			AuditRetention: 720 * time.Hour,
+			Webhooks: []*ddns.Webhook{
+				{URL: "https://hooks.example.com/ddns", Secret: "webhooksecret"},
+			},
+			ACME: &ddns.ACMEConfig{
+				Domains:  []string{"ddns.example.com", "api.example.com"},
+				CacheDir: envVals[EnvServerACMECacheDir],
+			},
+			Zone: &ddns.ZoneConfig{
+				Origin:      "example.com",
+				Nameservers: []string{"ns1.example.com", "ns2.example.com"},
+			},
 		},
 	}
 
 	if diff := deep.Equal(c, expected); diff != nil {
 		t.Fatalf("unmarshaled YAML config is incorrect: %v", diff)
 	}
+
+	// deep.Equal does not look inside netip types, which have no exported fields
+	if got, want := fmt.Sprint(c.Server.TrustedProxies), fmt.Sprint(expected.Server.TrustedProxies); got != want {
+		t.Fatalf(`incorrect value for Server.TrustedProxies, got: "%s", expected: "%s"`, got, want)
+	}
+}
+
+func TestFlagPrecedence(t *testing.T) {
+	if err := clearEnv(); err != nil {
+		t.Fatal(err.Error())
+	}
+	os.Setenv(EnvAPIServer, "http://serverfromenv.com")
+	os.Setenv(EnvAPIKey, "apikeyfromenv")
+	os.Setenv(EnvServerAPIKey, "allowedkeyfromenv")
+	defer clearEnv()
+
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	addSettingFlags(flags, scopeAll|scopeClient|scopeUpdate|scopeAgent|scopeServer)
+	err := flags.Parse([]string{
+		"--config", "testdata/ddns.yaml",
+		"--server", "http://serverfromflag.com",
+		"--verify",
+		"--http-listen", ":9999",
+		"--server-api-key-regex", "^fromflag.com$",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := Config{}
+	if err := c.InitFlags(flags); err != nil {
+		t.Fatal(err)
+	}
+	checks := []struct{ name, got, want string }{
+		{"flag over env", c.Agent.ServerAddress, "http://serverfromflag.com"},
+		{"env over config", c.Agent.APIKey, "apikeyfromenv"},
+		{"flag over config", c.Server.HTTPListener, ":9999"},
+		{"config", c.Server.DNSListener, ":5333"},
+		{"bool flag", fmt.Sprint(c.Agent.Verify), "true"},
+	}
+	for _, check := range checks {
+		if check.got != check.want {
+			t.Errorf("%s: expected %q, got %q", check.name, check.want, check.got)
+		}
+	}
+
+	// Settings which are used together are only read from the same source
+	if r := c.Server.AllowedAPIKeys["allowedkeyfromenv"]; r != nil {
+		t.Errorf("expected no matcher for the key from the environment, got: %s", r)
+	}
+
+	flags = pflag.NewFlagSet("test", pflag.ContinueOnError)
+	addSettingFlags(flags, scopeServer)
+	if err := flags.Parse([]string{"--trusted-proxies", "nope"}); err != nil {
+		t.Fatal(err)
+	}
+	err = (&Config{}).InitFlags(flags)
+	if err == nil || !strings.HasPrefix(err.Error(), "--trusted-proxies:") {
+		t.Fatalf("expected an error naming the flag, got: %v", err)
+	}
+
+	// Flags are typed
+	if err := flags.Parse([]string{"--hosts-file-backups", "many"}); err == nil {
+		t.Fatalf("expected an error for an invalid int flag")
+	}
+}
+
+func TestSettingFlagScopes(t *testing.T) {
+	update := pflag.NewFlagSet("update", pflag.ContinueOnError)
+	addSettingFlags(update, scopeClient|scopeUpdate)
+	for _, name := range []string{"interval", "state-file", "status-listen", "max-backoff", "hook-before", "watch"} {
+		if update.Lookup(name) != nil {
+			t.Errorf("unexpected agent flag for update: --%s", name)
+		}
+	}
+	if f := update.Lookup("verify"); f == nil || f.NoOptDefVal != "true" || f.Usage == "" {
+		t.Fatalf("expected a documented bool flag, got: %+v", f)
+	}
+
+	status := pflag.NewFlagSet("status", pflag.ContinueOnError)
+	addSettingFlags(status, scopeStatus)
+	if status.Lookup("state-file") == nil || status.Lookup("server") != nil {
+		t.Fatalf("incorrect flags for agent status")
+	}
+}
+
+func TestEnvDocs(t *testing.T) {
+	docs := getEnvDocs("")
+	for _, s := range settings {
+		if s.doc == "" {
+			t.Errorf("no docs for %s", s.env)
+		}
+		if !strings.Contains(docs, s.env) {
+			t.Errorf("%s is missing from the docs", s.env)
+		}
+	}
+}
+
+func TestStrictYAMLConfig(t *testing.T) {
+	if err := clearEnv(); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer clearEnv()
+
+	invalid := map[string]string{
+		"unknown key":     "server:\n  hostsfile: /tmp/hosts\n  httplistner: \":80\"\n",
+		"invalid matcher": "server:\n  apikeys:\n    - id: abc\n      domains: \"[unclosed\"\n",
+		"invalid type":    "agent:\n  interval: soon\n",
+	}
+	lines := map[string]string{
+		"unknown key":     "line 3",
+		"invalid matcher": "line 4",
+		"invalid type":    "line 2",
+	}
+	for name, contents := range invalid {
+		p := filepath.Join(t.TempDir(), "ddns.yaml")
+		if err := os.WriteFile(p, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		os.Setenv(EnvConfigFile, p)
+		err := (&Config{}).Init()
+		if err == nil || !strings.Contains(err.Error(), lines[name]) {
+			t.Errorf("%s: expected an error on %s, got: %v", name, lines[name], err)
+		}
+	}
+}
+
+func TestInvalidEnvMatcher(t *testing.T) {
+	if err := clearEnv(); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer clearEnv()
+	os.Setenv(EnvServerAPIKey, "key")
+	os.Setenv(EnvServerAPIKeyRegex, "(")
+	if err := (&Config{}).Init(); err == nil {
+		t.Fatal("expected an error for an invalid matcher")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	if err := clearEnv(); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer clearEnv()
+
+	dir := t.TempDir()
+	p := filepath.Join(dir, "ddns.yaml")
+	contents := "server:\n  hostsfile: " + filepath.Join(dir, "hosts.yaml") + "\n  allowedapikeys:\n    plaintextkey:\n"
+	if err := os.WriteFile(p, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv(EnvConfigFile, p)
+	c := &Config{}
+	if err := c.Init(); err != nil {
+		t.Fatal(err)
+	}
+	warnings, err := c.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 3 || !strings.Contains(warnings[2], "can be read by any user") {
+		t.Fatalf("expected warnings for the plaintext key and the config file, got: %v", warnings)
+	}
+
+	c.Server.HTTPListener = "localhost"
+	if _, err := c.Validate(); err == nil {
+		t.Fatal("expected an error for an invalid listener")
+	}
+}
+
+func TestReloadConfigValidation(t *testing.T) {
+	if err := clearEnv(); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer clearEnv()
+
+	s := &ddns.Server{AllowedAPIKeys: ddns.APIKeyMatcher{"old": nil}, Store: ddns.NewMemoryStore()}
+	os.Setenv(EnvServerAPIKey, "new")
+	os.Setenv(EnvServerHTTPListener, "localhost")
+	reloadConfig(s, nil)
+	if _, ok := s.AllowedAPIKeys["old"]; !ok {
+		t.Fatalf("expected the current config to be kept, got: %v", s.AllowedAPIKeys)
+	}
+
+	os.Setenv(EnvServerHTTPListener, "localhost:8080")
+	reloadConfig(s, nil)
+	if _, ok := s.AllowedAPIKeys["new"]; !ok {
+		t.Fatalf("expected the new config to be applied, got: %v", s.AllowedAPIKeys)
+	}
+}
+
+// testAPIKeys returns the API keys in testdata/ddns.yaml.
+func testAPIKeys() []*ddns.APIKey {
+	return []*ddns.APIKey{
+		{
+			ID:      "0123456789abcdef",
+			Label:   "home router",
+			Hash:    "$2a$10$P.5t6bB71S5J46fMXmPG8ehYCeicuaEKlq.uO6oEfL21O.Fvoch82",
+			Created: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+			Domains: regexp.MustCompile(`^home\.example\.com$`),
+		},
+	}
+}
+
+// testAgentJobs returns the agent jobs in testdata/ddns.yaml.
+func testAgentJobs() []*ddns.AgentJob {
+	return []*ddns.AgentJob{
+		{
+			Domains:    []string{"home.example.com", "www.example.com"},
+			RecordType: "A",
+		},
+		{
+			Domains:       []string{"home.example.com"},
+			RecordType:    "AAAA",
+			ServerAddress: "https://myotherserver.com",
+			APIKey:        "myothersecret",
+			Interval:      10 * time.Minute,
+			Source:        &ddns.IPSourceConfig{Type: "interface", Interface: "eth0"},
+		},
+	}
 }
 
 func clearEnv() error {
-	all := []string{
-		EnvConfigFile,
-		EnvAPIServer,
-		EnvAPIKey,
-		EnvServerAPIKey,
-		EnvServerAPIKeyRegex,
-		EnvServerHostsFile,
-		EnvServerHTTPListener,
-		EnvServerDNSListener,
-	}
-	for _, e := range all {
-		if err := os.Unsetenv(e); err != nil {
+	for _, s := range settings {
+		if err := os.Unsetenv(s.env); err != nil {
 			return err
 		}
 	}
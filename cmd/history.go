@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	ddns "github.com/tnyeanderson/ddns/pkg"
+)
+
+var historyCmd = &cobra.Command{
+	Use:   "history [domain]",
+	Args:  cobra.MaximumNArgs(1),
+	Short: "Show the history of changes to records",
+	Long: `Show the changes made to records using the API, oldest first, from the
+audit log. If a domain is provided, only changes to that domain are shown.
+
+By default, the audit log configured for the server is read. With --remote, the
+history is read from a running server using the API instead, and only includes
+the domains which the API key may read.
+
+The --since and --until flags accept a duration before now, such as "24h", or
+an RFC 3339 timestamp.
+
+See "ddns help" for a list of supported environment variables.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		c := mustInitConfig(cmd)
+
+		f := ddns.AuditFilter{}
+		if len(args) == 1 {
+			f.Domain = args[0]
+		}
+		f.KeyID, _ = cmd.Flags().GetString("key")
+		f.Limit, _ = cmd.Flags().GetInt("limit")
+		var err error
+		since, _ := cmd.Flags().GetString("since")
+		if f.Since, err = parseTime(since); err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+		until, _ := cmd.Flags().GetString("until")
+		if f.Until, err = parseTime(until); err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+
+		var entries []ddns.AuditEntry
+		if remote, _ := cmd.Flags().GetBool("remote"); remote {
+			entries, err = c.Agent.History(cmd.Context(), f)
+		} else {
+			entries, err = c.Server.History(f)
+		}
+		if err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "TIME\tKEY\tCALLER\tOPERATION\tDOMAIN\tOLD\tNEW\tRESULT")
+		for _, e := range entries {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", e.Time.Format(time.RFC3339), e.KeyID, e.CallerIP, e.Operation, e.Domain, ipOrDash(e.OldIP), ipOrDash(e.NewIP), e.Result)
+		}
+		w.Flush()
+	},
+}
+
+// parseTime parses an RFC 3339 timestamp, or a duration before now. An empty
+// string is the zero time.
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("not a duration or RFC 3339 timestamp: %s", s)
+	}
+	return t, nil
+}
+
+func ipOrDash(ip net.IP) string {
+	if ip == nil {
+		return "-"
+	}
+	return ip.String()
+}
+
+func init() {
+	historyCmd.Flags().String("since", "", "only show changes after this time")
+	historyCmd.Flags().String("until", "", "only show changes before this time")
+	historyCmd.Flags().String("key", "", "only show changes made using the API key with this ID")
+	historyCmd.Flags().Int("limit", 0, "only show this many of the newest changes (default: all)")
+	historyCmd.Flags().Bool("remote", false, "read the history from the server using the API")
+	rootCmd.AddCommand(historyCmd)
+}
@@ -12,13 +12,9 @@ var ipCmd = &cobra.Command{
 	Use:   "ip",
 	Short: "Get the public IP of the current machine using the DDNS API",
 	Run: func(cmd *cobra.Command, args []string) {
-		c := &Config{}
-		if err := c.Init(); err != nil {
-			slog.Error(err.Error())
-			os.Exit(1)
-		}
+		c := mustInitConfig(cmd)
 
-		ip, err := c.Agent.DetermineIP()
+		ip, err := c.Agent.DetermineIP(cmd.Context())
 		if err != nil {
 			slog.Error(err.Error())
 			os.Exit(1)
@@ -29,5 +25,6 @@ var ipCmd = &cobra.Command{
 }
 
 func init() {
+	addSettingFlags(ipCmd.Flags(), scopeClient)
 	rootCmd.AddCommand(ipCmd)
 }
@@ -0,0 +1,224 @@
+package cmd
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	ddns "github.com/tnyeanderson/ddns/pkg"
+	"gopkg.in/yaml.v3"
+)
+
+var keysCmd = &cobra.Command{
+	Use:   "keys",
+	Short: "Manage API keys for the DDNS server",
+}
+
+var keysGenerateCmd = &cobra.Command{
+	Use:   "generate",
+	Short: "Generate a new API key",
+	Long: `Generate a new API key. The secret token is printed once and is not
+stored anywhere, along with a config snippet containing only a hash of the
+secret, which should be added to the server config.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		label, _ := cmd.Flags().GetString("label")
+		pattern, _ := cmd.Flags().GetString("domains")
+		expiresIn, _ := cmd.Flags().GetDuration("expires-in")
+
+		var domains *regexp.Regexp
+		if pattern != "" {
+			r, err := regexp.Compile(pattern)
+			if err != nil {
+				slog.Error(err.Error())
+				os.Exit(1)
+			}
+			domains = r
+		}
+
+		var expires time.Time
+		if expiresIn > 0 {
+			expires = time.Now().Add(expiresIn).UTC().Truncate(time.Second)
+		}
+
+		key, token, err := ddns.GenerateAPIKey(label, domains, expires)
+		if err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+		key.Admin, _ = cmd.Flags().GetBool("admin")
+
+		snippet := &strings.Builder{}
+		enc := yaml.NewEncoder(snippet)
+		enc.SetIndent(2)
+		err = enc.Encode(map[string]any{
+			"server": map[string]any{
+				"apikeys": []*ddns.APIKey{key},
+			},
+		})
+		if err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+
+		fmt.Printf("API key (this is the only time it will be shown):\n\n  %s\n\n", token)
+		fmt.Printf("Add the following to the server config file:\n\n%s", snippet)
+	},
+}
+
+var keysListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the API keys on the server",
+	Long: `List the API keys on the server using the admin API. Requires an admin
+API key.
+
+See "ddns help" for a list of supported environment variables.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		c := mustInitConfig(cmd)
+		keys, err := c.Agent.ListKeys(cmd.Context())
+		if err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tLABEL\tDOMAINS\tEXPIRES\tDISABLED\tADMIN")
+		for _, k := range keys {
+			expires := "never"
+			if !k.Expires.IsZero() {
+				expires = k.Expires.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%t\t%t\n", k.ID, k.Label, k.Domains, expires, k.Disabled, k.Admin)
+		}
+		w.Flush()
+	},
+}
+
+var keysCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "Create an API key on the server",
+	Long: `Create an API key on the server using the admin API. Requires an admin
+API key. The new API key is printed once and is not stored anywhere.
+
+See "ddns help" for a list of supported environment variables.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		c := mustInitConfig(cmd)
+		req := &ddns.APIKeyRequest{}
+		if cmd.Flags().Changed("label") {
+			v, _ := cmd.Flags().GetString("label")
+			req.Label = &v
+		}
+		if cmd.Flags().Changed("domains") {
+			v, _ := cmd.Flags().GetString("domains")
+			req.Domains = &v
+		}
+		if v, _ := cmd.Flags().GetDuration("expires-in"); v > 0 {
+			expires := time.Now().Add(v).UTC().Truncate(time.Second)
+			req.Expires = &expires
+		}
+		if cmd.Flags().Changed("admin") {
+			v, _ := cmd.Flags().GetBool("admin")
+			req.Admin = &v
+		}
+
+		created, err := c.Agent.CreateKey(cmd.Context(), req)
+		if err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+		fmt.Printf("Created API key %s (this is the only time it will be shown):\n\n  %s\n", created.Key.ID, created.Token)
+	},
+}
+
+var keysDisableCmd = &cobra.Command{
+	Use:   "disable id",
+	Args:  cobra.ExactArgs(1),
+	Short: "Disable an API key on the server",
+	Run: func(cmd *cobra.Command, args []string) {
+		disabled := true
+		updateKey(cmd, args[0], &ddns.APIKeyRequest{Disabled: &disabled})
+	},
+}
+
+var keysEnableCmd = &cobra.Command{
+	Use:   "enable id",
+	Args:  cobra.ExactArgs(1),
+	Short: "Enable an API key on the server",
+	Run: func(cmd *cobra.Command, args []string) {
+		disabled := false
+		updateKey(cmd, args[0], &ddns.APIKeyRequest{Disabled: &disabled})
+	},
+}
+
+var keysSetDomainsCmd = &cobra.Command{
+	Use:   "set-domains id [regex]",
+	Args:  cobra.RangeArgs(1, 2),
+	Short: "Change the domains an API key on the server may update",
+	Long: `Change the regex matching the domains an API key on the server may
+update. If the regex is omitted, the key may update any domain.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		domains := ""
+		if len(args) == 2 {
+			domains = args[1]
+		}
+		updateKey(cmd, args[0], &ddns.APIKeyRequest{Domains: &domains})
+	},
+}
+
+var keysDeleteCmd = &cobra.Command{
+	Use:   "delete id",
+	Args:  cobra.ExactArgs(1),
+	Short: "Delete an API key on the server",
+	Run: func(cmd *cobra.Command, args []string) {
+		c := mustInitConfig(cmd)
+		if err := c.Agent.DeleteKey(cmd.Context(), args[0]); err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+		slog.Info("deleted API key", "id", args[0])
+	},
+}
+
+func updateKey(cmd *cobra.Command, id string, req *ddns.APIKeyRequest) {
+	c := mustInitConfig(cmd)
+	if _, err := c.Agent.UpdateKey(cmd.Context(), id, req); err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+	slog.Info("updated API key", "id", id)
+}
+
+// mustInitConfig initializes the config using the flags of cmd, and exits if
+// it is invalid.
+func mustInitConfig(cmd *cobra.Command) *Config {
+	c := &Config{}
+	if err := c.InitFlags(cmd.Flags()); err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+	return c
+}
+
+func init() {
+	keysGenerateCmd.Flags().String("label", "", "human readable description of the key")
+	keysGenerateCmd.Flags().String("domains", "", "regex matching the domains the key may update (default: any domain)")
+	keysGenerateCmd.Flags().Duration("expires-in", 0, "how long until the key expires (default: never)")
+	keysGenerateCmd.Flags().Bool("admin", false, "allow the key to manage other keys using the admin API")
+	keysCreateCmd.Flags().AddFlagSet(keysGenerateCmd.Flags())
+	for _, cmd := range []*cobra.Command{keysListCmd, keysCreateCmd, keysDisableCmd, keysEnableCmd, keysSetDomainsCmd, keysDeleteCmd} {
+		addSettingFlags(cmd.Flags(), scopeClient)
+	}
+
+	keysCmd.AddCommand(keysGenerateCmd)
+	keysCmd.AddCommand(keysListCmd)
+	keysCmd.AddCommand(keysCreateCmd)
+	keysCmd.AddCommand(keysDisableCmd)
+	keysCmd.AddCommand(keysEnableCmd)
+	keysCmd.AddCommand(keysSetDomainsCmd)
+	keysCmd.AddCommand(keysDeleteCmd)
+	rootCmd.AddCommand(keysCmd)
+}
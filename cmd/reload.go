@@ -0,0 +1,110 @@
+package cmd
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/pflag"
+	ddns "github.com/tnyeanderson/ddns/pkg"
+)
+
+// reloadDebounce is how long to wait after a file changes before reloading, so
+// that editors and tools which write a file in several steps only trigger one
+// reload.
+const reloadDebounce = 250 * time.Millisecond
+
+// watchAndReload reloads the server when the hosts file or the config file
+// changes, or when the process receives SIGHUP. It does not return.
+func watchAndReload(s *ddns.Server, flags *pflag.FlagSet) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	configFile := configFilePath(flags)
+	hostsFile := ""
+	if s.HostsFile != "" && (s.StoreType == "" || s.StoreType == ddns.StoreTypeYAML) {
+		hostsFile = s.HostsFile
+	}
+
+	var events <-chan fsnotify.Event
+	var errs <-chan error
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		slog.Error("failed to watch files, only SIGHUP will trigger a reload", "error", err.Error())
+	} else {
+		defer watcher.Close()
+		events, errs = watcher.Events, watcher.Errors
+		// Watch the directories rather than the files, since atomic writes
+		// replace the file and the watch would be lost
+		for _, f := range []string{configFile, hostsFile} {
+			if f == "" {
+				continue
+			}
+			if err := watcher.Add(filepath.Dir(f)); err != nil {
+				slog.Error("failed to watch file", "path", f, "error", err.Error())
+			}
+		}
+	}
+
+	var configTimer, hostsTimer <-chan time.Time
+	for {
+		select {
+		case <-hup:
+			slog.Info("received SIGHUP, reloading")
+			reloadConfig(s, flags)
+			reloadHostsFile(s)
+		case e := <-events:
+			if !e.Has(fsnotify.Write) && !e.Has(fsnotify.Create) && !e.Has(fsnotify.Rename) {
+				continue
+			}
+			switch filepath.Clean(e.Name) {
+			case filepath.Clean(configFile):
+				configTimer = time.After(reloadDebounce)
+			case filepath.Clean(hostsFile):
+				hostsTimer = time.After(reloadDebounce)
+			}
+		case err := <-errs:
+			slog.Error("error watching files", "error", err.Error())
+		case <-configTimer:
+			configTimer = nil
+			reloadConfig(s, flags)
+		case <-hostsTimer:
+			hostsTimer = nil
+			reloadHostsFile(s)
+		}
+	}
+}
+
+// reloadConfig reads the config again, with the same flags, and applies it to
+// s. If the new config is invalid, the current config is kept.
+func reloadConfig(s *ddns.Server, flags *pflag.FlagSet) {
+	next := &Config{}
+	if err := next.InitFlags(flags); err != nil {
+		slog.Error("invalid config, keeping current config", "error", err.Error())
+		return
+	}
+	// The same checks as when the server starts
+	if !logValidation(next.Server.Validate()) {
+		slog.Error("invalid config, keeping current config")
+		return
+	}
+	restartRequired, err := s.Reload(next.Server)
+	if err != nil {
+		slog.Error("failed to reload config", "error", err.Error())
+		return
+	}
+	for _, name := range restartRequired {
+		slog.Warn("config setting changed, restart the server to apply it", "setting", name)
+	}
+	slog.Info("reloaded config")
+}
+
+func reloadHostsFile(s *ddns.Server) {
+	if err := s.ReloadHostsFile(); err != nil {
+		slog.Error("keeping current records", "error", err.Error())
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"os"
 
 	"github.com/spf13/cobra"
+	ddns "github.com/tnyeanderson/ddns/pkg"
 )
 
 // rootCmd represents the base command when called without any subcommands
@@ -15,6 +16,10 @@ var rootCmd = &cobra.Command{
 
 ENVIRONMENT VARIABLES
 
+Each variable can also be set using the flag shown next to it, on the commands
+which use it. Flags take precedence over environment variables, which take
+precedence over the config file, which takes precedence over the defaults.
+
 %s
 
 `, getEnvDocs("  ")),
@@ -29,6 +34,11 @@ func Execute() {
 	}
 }
 
+func init() {
+	addSettingFlags(rootCmd.PersistentFlags(), scopeAll)
+}
+
 func SetVersion(version string) {
 	rootCmd.Version = version
+	ddns.Version = version
 }
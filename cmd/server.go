@@ -1,8 +1,11 @@
 package cmd
 
 import (
+	"context"
 	"log/slog"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/spf13/cobra"
 )
@@ -12,25 +15,36 @@ var serverCmd = &cobra.Command{
 	Short: "Start a DDNS server",
 	Long: `Start an HTTP server and a DNS server.
 
+The hosts file and the config file are reloaded when they change, or when the
+process receives SIGHUP. Changes to the listeners, store and TLS settings
+require a restart.
+
+Stops on SIGINT or SIGTERM, after waiting for requests and webhook deliveries
+in progress. Deliveries which would be retried are written to the dead letter
+log instead.
+
 See "ddns help" for a list of supported environment variables.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		c := &Config{}
-		if err := c.Init(); err != nil {
-			slog.Error(err.Error())
-			os.Exit(1)
-		}
+		c := mustInitConfig(cmd)
+		mustValidate(c.Server.Validate())
 
 		// Load domains from hosts file
 		if err := c.Server.Load(); err != nil {
-			// Log, but don't exit here. Failing to load from the hosts file is not
-			// fatal, and should not stop the DNS server from starting. It's better
-			// to start up and wait for the next update than to crash and have no
-			// chance of fulfilling requests at all.
+			// Log, but don't exit here. Failing to load from the hosts file (and
+			// all of its backups) is not fatal, and should not stop the DNS server
+			// from starting. It's better to start up and wait for the next update
+			// than to crash and have no chance of fulfilling requests at all.
 			slog.Error(err.Error())
 		}
 
+		// Pick up changes to the hosts file and the config file
+		go watchAndReload(c.Server, cmd.Flags())
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
 		// Start the server
-		if err := c.Server.Listen(); err != nil {
+		if err := c.Server.ListenContext(ctx); err != nil {
 			slog.Error(err.Error())
 			os.Exit(1)
 		}
@@ -38,5 +52,6 @@ See "ddns help" for a list of supported environment variables.`,
 }
 
 func init() {
+	addSettingFlags(serverCmd.Flags(), scopeServer)
 	rootCmd.AddCommand(serverCmd)
 }
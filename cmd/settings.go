@@ -0,0 +1,478 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+	ddns "github.com/tnyeanderson/ddns/pkg"
+)
+
+// The commands which have a flag for a [setting]. A setting can be in several
+// scopes.
+const (
+	scopeAll    = 1 << iota // every command
+	scopeClient             // commands which use the DDNS API
+	scopeUpdate             // commands which update records: "agent" and "update"
+	scopeAgent              // the agent
+	scopeStatus             // "agent status"
+	scopeServer             // the server
+)
+
+// The types of the flag for a [setting].
+const (
+	kindString = iota
+	kindBool
+	kindInt
+	kindDuration
+)
+
+// setting is a value which can be set using an environment variable or a
+// command line flag. The settings below are the single source of truth for
+// both, and for the docs.
+type setting struct {
+	env   string
+	flag  string
+	scope int
+	kind  int
+	doc   string
+
+	// apply sets the value in c. get returns the value of another setting
+	// from the same source, for settings which are used together. Settings
+	// which are only read by another setting have no apply.
+	apply func(c *Config, v string, get func(env string) string) error
+}
+
+// settingLookup returns the name and value of a setting from a source, and
+// whether it is set there.
+type settingLookup func(s *setting) (name, value string, ok bool)
+
+// envLookup reads settings from the environment. Empty variables are not set.
+func envLookup(s *setting) (string, string, bool) {
+	v := os.Getenv(s.env)
+	return s.env, v, v != ""
+}
+
+// flagLookup reads settings from the flags which were set in flags.
+func flagLookup(flags *pflag.FlagSet) settingLookup {
+	return func(s *setting) (string, string, bool) {
+		if s.flag == "" {
+			return "", "", false
+		}
+		f := flags.Lookup(s.flag)
+		if f == nil || !f.Changed {
+			return "", "", false
+		}
+		return "--" + s.flag, f.Value.String(), true
+	}
+}
+
+// findSetting returns the setting for the environment variable env.
+func findSetting(env string) *setting {
+	for i := range settings {
+		if settings[i].env == env {
+			return &settings[i]
+		}
+	}
+	panic("unknown setting: " + env)
+}
+
+// addSettingFlags adds a flag to flags for each setting in any of the scopes,
+// which are combined with "|".
+func addSettingFlags(flags *pflag.FlagSet, scopes int) {
+	for _, s := range settings {
+		if s.flag == "" || s.scope&scopes == 0 {
+			continue
+		}
+		usage := strings.TrimPrefix(s.doc, "(Agent) ")
+		switch s.kind {
+		case kindBool:
+			flags.Bool(s.flag, false, usage)
+		case kindInt:
+			flags.Int(s.flag, 0, usage)
+		case kindDuration:
+			flags.Duration(s.flag, 0, usage)
+		default:
+			flags.String(s.flag, "", usage)
+		}
+	}
+}
+
+func getEnvDocs(prefix string) string {
+	s := &strings.Builder{}
+	for _, v := range settings {
+		name := v.env
+		if v.flag != "" {
+			name += ", --" + v.flag
+		}
+		fmt.Fprintf(s, "%s%s\n", prefix, name)
+		fmt.Fprintf(s, "%s  %s\n\n", prefix, v.doc)
+	}
+	return s.String()
+}
+
+// setString returns an apply func which sets the string at field(c).
+func setString(field func(c *Config) *string) func(*Config, string, func(string) string) error {
+	return func(c *Config, v string, _ func(string) string) error {
+		*field(c) = v
+		return nil
+	}
+}
+
+// setList returns an apply func which sets the comma separated list at
+// field(c).
+func setList(field func(c *Config) *[]string) func(*Config, string, func(string) string) error {
+	return func(c *Config, v string, _ func(string) string) error {
+		*field(c) = strings.Split(v, ",")
+		return nil
+	}
+}
+
+// setBool returns an apply func which sets the bool at field(c).
+func setBool(field func(c *Config) *bool) func(*Config, string, func(string) string) error {
+	return func(c *Config, v string, _ func(string) string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		*field(c) = b
+		return nil
+	}
+}
+
+// setInt returns an apply func which sets the int at field(c).
+func setInt(field func(c *Config) *int) func(*Config, string, func(string) string) error {
+	return func(c *Config, v string, _ func(string) string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		*field(c) = n
+		return nil
+	}
+}
+
+// setDuration returns an apply func which sets the duration at field(c).
+func setDuration(field func(c *Config) *time.Duration) func(*Config, string, func(string) string) error {
+	return func(c *Config, v string, _ func(string) string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*field(c) = d
+		return nil
+	}
+}
+
+// addHook returns an apply func which adds a hook to the agent.
+func addHook(when string, isURL bool) func(*Config, string, func(string) string) error {
+	return func(c *Config, v string, _ func(string) string) error {
+		h := &ddns.AgentHook{When: when, Command: v}
+		if isURL {
+			h = &ddns.AgentHook{When: when, URL: v}
+		}
+		c.Agent.Hooks = append(c.Agent.Hooks, h)
+		return nil
+	}
+}
+
+// Not a map to preserve deterministic order
+var settings = []setting{
+	{
+		env: EnvConfigFile, flag: "config", scope: scopeAll,
+		doc: `Path to a YAML configuration file for DDNS. See the cmd.Config struct for more info.`,
+	},
+	{
+		env: EnvAPIServer, flag: "server", scope: scopeClient,
+		doc: fmt.Sprintf(`(Agent) The scheme/host/port of the DDNS API server, not including the /api base path. Separate several servers with commas (default: "%s").`, ddns.DefaultServerAddress),
+		apply: func(c *Config, v string, _ func(string) string) error {
+			servers := strings.Split(v, ",")
+			c.Agent.ServerAddress = servers[0]
+			c.Agent.ServerAddresses = nil
+			if len(servers) > 1 {
+				c.Agent.ServerAddresses = servers[1:]
+			}
+			return nil
+		},
+	},
+	{
+		env: EnvAgentServerMode, flag: "server-mode", scope: scopeUpdate,
+		doc:   fmt.Sprintf(`(Agent) With several servers, "%s" updates the first healthy server, and "%s" updates all of them (default: "%s").`, ddns.ServerModeFailover, ddns.ServerModeFanout, ddns.ServerModeFailover),
+		apply: setString(func(c *Config) *string { return &c.Agent.ServerMode }),
+	},
+	{
+		env: EnvAgentVerify, flag: "verify", scope: scopeUpdate, kind: kindBool,
+		doc:   `(Agent) If "true", "ddns agent" and "ddns update" wait until every nameserver for the domain serves a new IP after updating it, and report the nameservers which are lagging.`,
+		apply: setBool(func(c *Config) *bool { return &c.Agent.Verify }),
+	},
+	{
+		env: EnvAgentVerifyNS, flag: "verify-nameservers", scope: scopeUpdate,
+		doc:   `(Agent) Comma separated nameservers to verify updates on, optionally with a port (default: from an NS lookup of the domain).`,
+		apply: setList(func(c *Config) *[]string { return &c.Agent.VerifyNameservers }),
+	},
+	{
+		env: EnvAgentVerifyTimeout, flag: "verify-timeout", scope: scopeUpdate, kind: kindDuration,
+		doc:   fmt.Sprintf(`(Agent) How long to wait for the nameservers to serve a new IP (default: "%s").`, ddns.DefaultVerifyTimeout),
+		apply: setDuration(func(c *Config) *time.Duration { return &c.Agent.VerifyTimeout }),
+	},
+	{
+		env: EnvAgentHookBefore, flag: "hook-before", scope: scopeAgent,
+		doc:   `(Agent) Shell command to run before the agent sends an update for a new IP. If it fails, the update is not sent. The DDNS_HOOK_DOMAIN, DDNS_HOOK_OLD_IP and DDNS_HOOK_NEW_IP variables are set.`,
+		apply: addHook(ddns.HookBefore, false),
+	},
+	{
+		env: EnvAgentHookAfter, flag: "hook-after", scope: scopeAgent,
+		doc:   `(Agent) Shell command to run after the agent sends an update for a new IP. DDNS_HOOK_RESULT is set to "updated", "unchanged" or "failed", and DDNS_HOOK_ERROR to the error if it failed.`,
+		apply: addHook(ddns.HookAfter, false),
+	},
+	{
+		env: EnvAgentHookURL, flag: "hook-url", scope: scopeAgent,
+		doc:   `(Agent) URL to POST a JSON event to after the agent sends an update for a new IP.`,
+		apply: addHook(ddns.HookAfter, true),
+	},
+	{
+		env: EnvAgentStateFile, flag: "state-file", scope: scopeAgent | scopeStatus,
+		doc:   `(Agent) Path to a JSON file where the agent keeps the last detected and pushed IP, and the result of the last check, for each domain. The agent continues from the last pushed IP after a restart, and "ddns agent status" reads it.`,
+		apply: setString(func(c *Config) *string { return &c.Agent.StateFile }),
+	},
+	{
+		env: EnvAgentStatusListener, flag: "status-listen", scope: scopeAgent | scopeStatus,
+		doc:   `(Agent) Address to serve the status of the agent on as JSON, at /status, such as "127.0.0.1:8053" (default: disabled).`,
+		apply: setString(func(c *Config) *string { return &c.Agent.StatusListener }),
+	},
+	{
+		env: EnvAPIKey, flag: "api-key", scope: scopeClient,
+		doc:   `(Agent) The API key used to authenticate to the DDNS API.`,
+		apply: setString(func(c *Config) *string { return &c.Agent.APIKey }),
+	},
+	{
+		env: EnvAPITimeout, flag: "timeout", scope: scopeClient, kind: kindDuration,
+		doc:   fmt.Sprintf(`(Agent) How long a request to the DDNS API may take. A negative value disables the timeout (default: "%s").`, ddns.DefaultAgentTimeout),
+		apply: setDuration(func(c *Config) *time.Duration { return &c.Agent.Timeout }),
+	},
+	{
+		env: EnvAPICAFile, flag: "ca-file", scope: scopeClient,
+		doc:   `(Agent) A PEM bundle of certificate authorities to trust for the DDNS API, instead of the system ones.`,
+		apply: setString(func(c *Config) *string { return &c.Agent.CAFile }),
+	},
+	{
+		env: EnvAPIClientCertFile, flag: "client-cert-file", scope: scopeClient,
+		doc:   `(Agent) A PEM client certificate to send to the DDNS API, for mutual TLS. Requires ` + EnvAPIClientKeyFile + `.`,
+		apply: setString(func(c *Config) *string { return &c.Agent.ClientCertFile }),
+	},
+	{
+		env: EnvAPIClientKeyFile, flag: "client-key-file", scope: scopeClient,
+		doc:   `(Agent) The PEM private key for ` + EnvAPIClientCertFile + `.`,
+		apply: setString(func(c *Config) *string { return &c.Agent.ClientKeyFile }),
+	},
+	{
+		env: EnvAPIProxy, flag: "proxy", scope: scopeClient,
+		doc:   `(Agent) The URL of a proxy for requests to the DDNS API (default: from HTTP_PROXY, HTTPS_PROXY and NO_PROXY).`,
+		apply: setString(func(c *Config) *string { return &c.Agent.Proxy }),
+	},
+	{
+		env: EnvAgentInterval, flag: "interval", scope: scopeAgent, kind: kindDuration,
+		doc:   fmt.Sprintf(`(Agent) How often "ddns agent" checks for a new IP (default: "%s").`, ddns.DefaultAgentInterval),
+		apply: setDuration(func(c *Config) *time.Duration { return &c.Agent.Interval }),
+	},
+	{
+		env: EnvAgentRefreshInterval, flag: "refresh-interval", scope: scopeAgent, kind: kindDuration,
+		doc:   fmt.Sprintf(`(Agent) How often "ddns agent" sends an update even if the IP has not changed (default: "%s").`, ddns.DefaultAgentRefreshInterval),
+		apply: setDuration(func(c *Config) *time.Duration { return &c.Agent.RefreshInterval }),
+	},
+	{
+		env: EnvAgentMaxBackoff, flag: "max-backoff", scope: scopeAgent, kind: kindDuration,
+		doc:   fmt.Sprintf(`(Agent) The longest "ddns agent" waits between attempts after errors (default: "%s").`, ddns.DefaultAgentMaxBackoff),
+		apply: setDuration(func(c *Config) *time.Duration { return &c.Agent.MaxBackoff }),
+	},
+	{
+		env: EnvAgentSource, flag: "source", scope: scopeAgent,
+		doc:   fmt.Sprintf(`(Agent) Where "ddns agent" gets the IP: "%s", "%s", "%s", "%s", "%s", "%s", "%s" or "%s". Use the config file for "%s" (default: "%s").`, ddns.SourceTypeServer, ddns.SourceTypeInterface, ddns.SourceTypeCommand, ddns.SourceTypeSTUN, ddns.SourceTypeHTTP, ddns.SourceTypeDNS, ddns.SourceTypeUPnP, ddns.SourceTypeNATPMP, ddns.SourceTypeConsensus, ddns.SourceTypeServer),
+		apply: setString(func(c *Config) *string { return &c.source().Type }),
+	},
+	{
+		env: EnvAgentInterface, flag: "interface", scope: scopeAgent,
+		doc:   fmt.Sprintf(`(Agent) The network interface to read the IP from, for the "%s" source.`, ddns.SourceTypeInterface),
+		apply: setString(func(c *Config) *string { return &c.source().Interface }),
+	},
+	{
+		env: EnvAgentFamily, flag: "family", scope: scopeAgent,
+		doc:   fmt.Sprintf(`(Agent) The address family to read from the interface: "%s" or "%s" (default: "%s").`, ddns.FamilyIPv4, ddns.FamilyIPv6, ddns.FamilyIPv4),
+		apply: setString(func(c *Config) *string { return &c.source().Family }),
+	},
+	{
+		env: EnvAgentWatch, flag: "watch", scope: scopeAgent, kind: kindBool,
+		doc:   fmt.Sprintf(`(Agent) If "true", watch for address changes: using netlink for the "%s" source (Linux only), or the announcements of the router for the "%s" source.`, ddns.SourceTypeInterface, ddns.SourceTypeNATPMP),
+		apply: setBool(func(c *Config) *bool { return &c.source().Watch }),
+	},
+	{
+		env: EnvAgentCommand, flag: "command", scope: scopeAgent,
+		doc:   fmt.Sprintf(`(Agent) The shell command which prints the IP, for the "%s" source.`, ddns.SourceTypeCommand),
+		apply: setString(func(c *Config) *string { return &c.source().Command }),
+	},
+	{
+		env: EnvAgentSourceServer, flag: "source-server", scope: scopeAgent,
+		doc:   fmt.Sprintf(`(Agent) The host and port of the server for the "%s" and "%s" sources, or the address of the router for the "%s" source (default: the default gateway).`, ddns.SourceTypeSTUN, ddns.SourceTypeDNS, ddns.SourceTypeNATPMP),
+		apply: setString(func(c *Config) *string { return &c.source().Server }),
+	},
+	{
+		env: EnvAgentSourceURL, flag: "source-url", scope: scopeAgent,
+		doc:   fmt.Sprintf(`(Agent) The URL which responds with the IP of the caller, for the "%s" source, or the device description of the router for the "%s" source (default: discovered using SSDP).`, ddns.SourceTypeHTTP, ddns.SourceTypeUPnP),
+		apply: setString(func(c *Config) *string { return &c.source().URL }),
+	},
+	{
+		env: EnvAgentSourceName, flag: "source-name", scope: scopeAgent,
+		doc:   fmt.Sprintf(`(Agent) The name to query, for the "%s" source.`, ddns.SourceTypeDNS),
+		apply: setString(func(c *Config) *string { return &c.source().Name }),
+	},
+	{
+		env: EnvServerAPIKey, flag: "server-api-key", scope: scopeServer,
+		doc: `This plaintext API key will be allowed by the server. Prefer hashed keys in the config file (see "ddns keys generate").`,
+		apply: func(c *Config, v string, get func(string) string) error {
+			var r *regexp.Regexp
+			if pattern := get(EnvServerAPIKeyRegex); pattern != "" {
+				var err error
+				if r, err = regexp.Compile(pattern); err != nil {
+					return fmt.Errorf("invalid domain matcher: %w", err)
+				}
+			}
+			c.Server.Allow(v, r)
+			return nil
+		},
+	},
+	{
+		env: EnvServerAPIKeyRegex, flag: "server-api-key-regex", scope: scopeServer,
+		doc: fmt.Sprintf(`The regex domain matcher for %s.`, EnvServerAPIKey),
+	},
+	{
+		env: EnvServerHostsFile, flag: "hosts-file", scope: scopeServer,
+		doc:   `Path to the hosts file used by the "yaml" store type. See Server.HostsFile for more info.`,
+		apply: setString(func(c *Config) *string { return &c.Server.HostsFile }),
+	},
+	{
+		env: EnvServerHostsFileBackups, flag: "hosts-file-backups", scope: scopeServer, kind: kindInt,
+		doc:   fmt.Sprintf(`The number of previous versions of the hosts file to keep, which are used if it is corrupt. A negative value disables backups (default: %d).`, ddns.DefaultHostsFileBackups),
+		apply: setInt(func(c *Config) *int { return &c.Server.HostsFileBackups }),
+	},
+	{
+		env: EnvServerStoreType, flag: "store-type", scope: scopeServer,
+		doc:   fmt.Sprintf(`The type of store for records: "%s", "%s", "%s" or "%s" (default: "%s" if a hosts file is set, otherwise "%s").`, ddns.StoreTypeYAML, ddns.StoreTypeSQLite, ddns.StoreTypeBolt, ddns.StoreTypeMemory, ddns.StoreTypeYAML, ddns.StoreTypeMemory),
+		apply: setString(func(c *Config) *string { return &c.Server.StoreType }),
+	},
+	{
+		env: EnvServerStorePath, flag: "store-path", scope: scopeServer,
+		doc:   fmt.Sprintf(`Path to the database file for the "%s" and "%s" store types.`, ddns.StoreTypeSQLite, ddns.StoreTypeBolt),
+		apply: setString(func(c *Config) *string { return &c.Server.StorePath }),
+	},
+	{
+		env: EnvServerKeysFile, flag: "keys-file", scope: scopeServer,
+		doc:   fmt.Sprintf(`Path to the file where API keys managed using the admin API are saved (default: "%s" next to the hosts file).`, ddns.DefaultKeysFileName),
+		apply: setString(func(c *Config) *string { return &c.Server.KeysFile }),
+	},
+	{
+		env: EnvServerAuditLogFile, flag: "audit-log-file", scope: scopeServer,
+		doc:   fmt.Sprintf(`Path to the audit log of changes made using the API (default: "%s" next to the hosts file).`, ddns.DefaultAuditLogFileName),
+		apply: setString(func(c *Config) *string { return &c.Server.AuditLogFile }),
+	},
+	{
+		env: EnvServerAuditRetention, flag: "audit-retention", scope: scopeServer, kind: kindDuration,
+		doc:   fmt.Sprintf(`How long entries are kept in the audit log, such as "720h". A negative value keeps entries forever (default: "%s").`, ddns.DefaultAuditRetention),
+		apply: setDuration(func(c *Config) *time.Duration { return &c.Server.AuditRetention }),
+	},
+	{
+		env: EnvServerWebhookURL, flag: "webhook-url", scope: scopeServer,
+		doc: `This URL will receive a POST request with a JSON payload after each change to a record. More webhooks can be set in the config file.`,
+		apply: func(c *Config, v string, get func(string) string) error {
+			c.Server.Webhooks = append(c.Server.Webhooks, &ddns.Webhook{
+				URL:    v,
+				Secret: get(EnvServerWebhookSecret),
+			})
+			return nil
+		},
+	},
+	{
+		env: EnvServerWebhookSecret, flag: "webhook-secret", scope: scopeServer,
+		doc: fmt.Sprintf(`The secret used to sign requests to %s, in the %s header.`, EnvServerWebhookURL, ddns.WebhookSignatureHeader),
+	},
+	{
+		env: EnvServerWebhookDeadLetterFile, flag: "webhook-dead-letter-file", scope: scopeServer,
+		doc:   fmt.Sprintf(`Path to the log of webhook deliveries which failed every attempt (default: "%s" next to the hosts file).`, ddns.DefaultWebhookDeadLetterFileName),
+		apply: setString(func(c *Config) *string { return &c.Server.WebhookDeadLetterFile }),
+	},
+	{
+		env: EnvServerHTTPListener, flag: "http-listen", scope: scopeServer,
+		doc:   fmt.Sprintf(`The TCP listener address for the HTTP server (default: "%s").`, ddns.DefaultHTTPListener),
+		apply: setString(func(c *Config) *string { return &c.Server.HTTPListener }),
+	},
+	{
+		env: EnvServerDNSListener, flag: "dns-listen", scope: scopeServer,
+		doc:   fmt.Sprintf(`The TCP listener address for the DNS server (default: "%s").`, ddns.DefaultDNSListener),
+		apply: setString(func(c *Config) *string { return &c.Server.DNSListener }),
+	},
+	{
+		env: EnvServerTLSCertFile, flag: "tls-cert-file", scope: scopeServer,
+		doc:   `Path to a PEM encoded certificate. If set along with the key, the HTTP server will use TLS.`,
+		apply: setString(func(c *Config) *string { return &c.Server.TLSCertFile }),
+	},
+	{
+		env: EnvServerTLSKeyFile, flag: "tls-key-file", scope: scopeServer,
+		doc:   `Path to the PEM encoded private key for the TLS certificate.`,
+		apply: setString(func(c *Config) *string { return &c.Server.TLSKeyFile }),
+	},
+	{
+		env: EnvServerTrustedProxies, flag: "trusted-proxies", scope: scopeServer,
+		doc: `Comma separated list of CIDRs of reverse proxies whose X-Real-Ip, Forwarded and X-Forwarded-For headers will be trusted.`,
+		apply: func(c *Config, v string, _ func(string) string) error {
+			proxies, err := parsePrefixes(v)
+			if err != nil {
+				return err
+			}
+			c.Server.TrustedProxies = proxies
+			return nil
+		},
+	},
+	{
+		env: EnvServerProxyProtocol, flag: "proxy-protocol", scope: scopeServer, kind: kindBool,
+		doc:   `If "true", accept the PROXY protocol (v1 and v2) on the HTTP listener from trusted proxies.`,
+		apply: setBool(func(c *Config) *bool { return &c.Server.ProxyProtocol }),
+	},
+	{
+		env: EnvServerACMEDomains, flag: "acme-domains", scope: scopeServer,
+		doc:   `Comma separated list of domains to obtain an ACME certificate for. Enables automatic TLS using DNS-01 challenges served by the DNS server.`,
+		apply: setList(func(c *Config) *[]string { return &c.acme().Domains }),
+	},
+	{
+		env: EnvServerACMEEmail, flag: "acme-email", scope: scopeServer,
+		doc:   `Contact email for the ACME account.`,
+		apply: setString(func(c *Config) *string { return &c.acme().Email }),
+	},
+	{
+		env: EnvServerACMEDirectory, flag: "acme-directory", scope: scopeServer,
+		doc:   fmt.Sprintf(`The ACME directory URL (default: "%s").`, ddns.DefaultACMEDirectory),
+		apply: setString(func(c *Config) *string { return &c.acme().DirectoryURL }),
+	},
+	{
+		env: EnvServerACMECacheDir, flag: "acme-cache-dir", scope: scopeServer,
+		doc:   `Directory where the ACME account key and certificate are stored.`,
+		apply: setString(func(c *Config) *string { return &c.acme().CacheDir }),
+	},
+	{
+		env: EnvServerZoneOrigin, flag: "zone-origin", scope: scopeServer,
+		doc:   `The name of the zone served by the server, such as "myddns.com". Used by "ddns zone".`,
+		apply: setString(func(c *Config) *string { return &c.zone().Origin }),
+	},
+	{
+		env: EnvServerZoneNameservers, flag: "zone-nameservers", scope: scopeServer,
+		doc:   `Comma separated list of the nameservers for the zone, which are exported as NS records along with an SOA record.`,
+		apply: setList(func(c *Config) *[]string { return &c.zone().Nameservers }),
+	},
+	{
+		env: EnvServerZoneHostmaster, flag: "zone-hostmaster", scope: scopeServer,
+		doc:   `Email address of the person responsible for the zone, for the SOA record (default: "hostmaster@<origin>").`,
+		apply: setString(func(c *Config) *string { return &c.zone().Hostmaster }),
+	},
+}
@@ -16,13 +16,14 @@ var updateCmd = &cobra.Command{
 	Long: `Update the A record for a domain. If an IP is not provided, "auto" will
 be sent in the request.
 
+With --verify, wait until every nameserver for the domain serves the new IP,
+and exit with an error listing the nameservers which are lagging if they do
+not before the timeout. The nameservers are found using an NS lookup, unless
+they are configured.
+
 See "ddns help" for a list of supported environment variables.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		c := &Config{}
-		if err := c.Init(); err != nil {
-			slog.Error(err.Error())
-			os.Exit(1)
-		}
+		c := mustInitConfig(cmd)
 
 		domain := args[0]
 
@@ -35,20 +36,48 @@ See "ddns help" for a list of supported environment variables.`,
 			}
 		}
 
-		updated, err := c.Agent.UpdateIP(domain, ip)
+		// The IP must be known to verify it
+		verify := c.Agent.Verify
+		if verify && ip == "auto" {
+			determined, err := c.Agent.DetermineIP(cmd.Context())
+			if err != nil {
+				slog.Error(err.Error())
+				os.Exit(1)
+			}
+			ip = determined
+		}
+
+		results, err := c.Agent.UpdateIPServers(cmd.Context(), domain, ip)
 		if err != nil {
 			slog.Error(err.Error())
 			os.Exit(1)
 		}
 
-		if updated {
-			slog.Info(fmt.Sprintf("updated dns entry for %s to %s", domain, ip))
-		} else {
-			slog.Info(fmt.Sprintf("dns entry already correct for %s: %s", domain, ip))
+		for _, r := range results {
+			switch {
+			case r.Err != nil:
+				slog.Error(r.Err.Error(), "server", r.Server)
+			case r.Updated:
+				slog.Info(fmt.Sprintf("updated dns entry for %s to %s", domain, ip), "server", r.Server)
+			default:
+				slog.Info(fmt.Sprintf("dns entry already correct for %s: %s", domain, ip), "server", r.Server)
+			}
+		}
+		if _, err := c.Agent.Summarize(results); err != nil {
+			os.Exit(1)
+		}
+
+		if verify {
+			if err := c.Agent.VerifyIP(cmd.Context(), domain, ip); err != nil {
+				slog.Error(err.Error())
+				os.Exit(1)
+			}
+			slog.Info(fmt.Sprintf("verified dns entry for %s on all nameservers: %s", domain, ip))
 		}
 	},
 }
 
 func init() {
+	addSettingFlags(updateCmd.Flags(), scopeClient|scopeUpdate)
 	rootCmd.AddCommand(updateCmd)
 }
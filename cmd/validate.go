@@ -0,0 +1,208 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Manage the configuration",
+}
+
+var configValidateCmd = &cobra.Command{
+	Use:   "validate",
+	Args:  cobra.NoArgs,
+	Short: "Check the configuration for errors",
+	Long: `Check the config file, environment variables and flags for errors, without
+starting the server or the agent. Unknown keys in the config file are errors,
+and are reported with their line. Listeners, matchers, IP sources, hooks and
+the files which are read or written are checked, and insecure settings such as
+plaintext API keys, keys which may update any domain, or trusted proxies which
+allow clients to choose their IP are reported as warnings.
+
+The same checks run when "ddns server" and "ddns agent" start.
+
+Exits with an error if the configuration is invalid.
+
+See "ddns help" for a list of supported environment variables.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		c := mustInitConfig(cmd)
+		mustValidate(c.Validate())
+		slog.Info("config is valid")
+	},
+}
+
+// Validate checks the config of the server and the agent, see
+// [ddns.Server.Validate] and [ddns.Agent.Validate].
+func (c *Config) Validate() (warnings []string, err error) {
+	serverWarnings, serverErr := c.Server.Validate()
+	agentWarnings, agentErr := c.Agent.Validate()
+	warnings = append(serverWarnings, agentWarnings...)
+
+	hasSecrets := c.Agent.APIKey != "" || len(c.Server.AllowedAPIKeys) > 0
+	for _, w := range c.Server.Webhooks {
+		hasSecrets = hasSecrets || w.Secret != ""
+	}
+	if hasSecrets && runtime.GOOS != "windows" && c.path != "" {
+		if info, err := os.Stat(c.path); err == nil && info.Mode().Perm()&0o004 != 0 {
+			warnings = append(warnings, fmt.Sprintf("%s contains secrets, and can be read by any user", c.path))
+		}
+	}
+	return warnings, errors.Join(serverErr, agentErr)
+}
+
+// mustValidate logs the result of a validation, and exits if there are
+// errors.
+func mustValidate(warnings []string, err error) {
+	if !logValidation(warnings, err) {
+		slog.Error("invalid config")
+		os.Exit(1)
+	}
+}
+
+// logValidation logs the result of a validation, and returns false if there
+// are errors.
+func logValidation(warnings []string, err error) bool {
+	for _, w := range warnings {
+		slog.Warn(w)
+	}
+	if err == nil {
+		return true
+	}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		for _, e := range flattenErrors(joined.Unwrap()) {
+			slog.Error(e.Error())
+		}
+	} else {
+		slog.Error(err.Error())
+	}
+	return false
+}
+
+// flattenErrors returns the errors in errs, with joined errors expanded.
+func flattenErrors(errs []error) []error {
+	out := []error{}
+	for _, err := range errs {
+		if joined, ok := err.(interface{ Unwrap() []error }); ok {
+			out = append(out, flattenErrors(joined.Unwrap())...)
+			continue
+		}
+		out = append(out, err)
+	}
+	return out
+}
+
+// decodeConfig decodes the YAML config in b into c. Unlike [yaml.Unmarshal],
+// unknown keys are errors, and every error includes its line.
+func decodeConfig(b []byte, c *Config) error {
+	n := &yaml.Node{}
+	if err := yaml.Unmarshal(b, n); err != nil {
+		return err
+	}
+	if err := checkScalars(n, reflect.TypeOf(c)); err != nil {
+		return err
+	}
+	d := yaml.NewDecoder(bytes.NewReader(b))
+	d.KnownFields(true)
+	if err := d.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+var (
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	timeType            = reflect.TypeOf(time.Time{})
+)
+
+// checkScalars parses the values in n which are decoded using
+// [encoding.TextUnmarshaler], such as domain matchers, when n is decoded into
+// a value of type t. The YAML decoder does not include the line in their
+// errors.
+func checkScalars(n *yaml.Node, t reflect.Type) error {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch n.Kind {
+	case yaml.DocumentNode:
+		for _, child := range n.Content {
+			if err := checkScalars(child, t); err != nil {
+				return err
+			}
+		}
+	case yaml.ScalarNode:
+		// The YAML decoder parses timestamps itself
+		if n.Tag == "!!null" || t == timeType || !reflect.PointerTo(t).Implements(textUnmarshalerType) {
+			return nil
+		}
+		v := reflect.New(t).Interface().(encoding.TextUnmarshaler)
+		if err := v.UnmarshalText([]byte(n.Value)); err != nil {
+			return fmt.Errorf("line %d: %w", n.Line, err)
+		}
+	case yaml.SequenceNode:
+		if t.Kind() != reflect.Slice {
+			return nil
+		}
+		for _, child := range n.Content {
+			if err := checkScalars(child, t.Elem()); err != nil {
+				return err
+			}
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key, value := n.Content[i], n.Content[i+1]
+			switch t.Kind() {
+			case reflect.Map:
+				if err := checkScalars(value, t.Elem()); err != nil {
+					return err
+				}
+			case reflect.Struct:
+				if f, ok := yamlField(t, key.Value); ok {
+					if err := checkScalars(value, f.Type); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// yamlField returns the field of the struct type t which the YAML key is
+// decoded into.
+func yamlField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		if name == key {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+func init() {
+	addSettingFlags(configValidateCmd.Flags(), scopeClient|scopeUpdate|scopeAgent|scopeStatus|scopeServer)
+	configCmd.AddCommand(configValidateCmd)
+	rootCmd.AddCommand(configCmd)
+}
@@ -0,0 +1,142 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+
+	"github.com/spf13/cobra"
+	ddns "github.com/tnyeanderson/ddns/pkg"
+)
+
+var zoneCmd = &cobra.Command{
+	Use:   "zone",
+	Short: "Import and export records in zone file format",
+}
+
+var zoneExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export records as a zone file",
+	Long: `Export the records as an RFC 1035 master file (BIND zone file), written
+to stdout. SOA and NS records are included if the zone origin and nameservers
+are configured.
+
+By default, the records are read from the store configured for the server. With
+--remote, they are read from a running server using the API instead.
+
+See "ddns help" for a list of supported environment variables.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		c := mustInitConfig(cmd)
+
+		var domains ddns.Domains
+		var err error
+		if remote, _ := cmd.Flags().GetBool("remote"); remote {
+			domains, err = c.Agent.ListRecords(cmd.Context())
+		} else {
+			domains, err = localRecords(c.Server)
+		}
+		if err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+
+		if err := ddns.ExportZone(os.Stdout, domains, c.Server.Zone); err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+	},
+}
+
+var zoneImportCmd = &cobra.Command{
+	Use:   "import file",
+	Args:  cobra.ExactArgs(1),
+	Short: "Import records from a zone file",
+	Long: `Import the A and AAAA records from an RFC 1035 master file (BIND zone
+file). Use "-" to read from stdin. Other record types are skipped, as is every
+record after the first for a name, since each domain has a single IP.
+
+By default, the records are saved to the store configured for the server (a
+running server reloads the hosts file automatically). With --remote, they are
+sent to a running server using the API instead.
+
+See "ddns help" for a list of supported environment variables.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		c := mustInitConfig(cmd)
+
+		var r io.Reader = os.Stdin
+		if args[0] != "-" {
+			f, err := os.Open(args[0])
+			if err != nil {
+				slog.Error(err.Error())
+				os.Exit(1)
+			}
+			defer f.Close()
+			r = f
+		}
+
+		origin, _ := cmd.Flags().GetString("origin")
+		if origin == "" && c.Server.Zone != nil {
+			origin = c.Server.Zone.Origin
+		}
+
+		domains, skipped, err := ddns.ImportZone(r, origin)
+		if err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+		for _, rr := range skipped {
+			slog.Warn("skipping unsupported record", "record", rr.String())
+		}
+
+		// Save to the server using the API, or directly to the store
+		put := func(domain string, ip net.IP) error {
+			_, err := c.Agent.UpdateIP(cmd.Context(), domain, ip.String())
+			return err
+		}
+		done := func() {}
+		if remote, _ := cmd.Flags().GetBool("remote"); !remote {
+			if err := c.Server.Load(); err != nil {
+				slog.Error(err.Error())
+				os.Exit(1)
+			}
+			put = c.Server.Store.Put
+			done = func() { c.Server.Store.Close() }
+		}
+
+		failed := 0
+		for domain, ip := range domains {
+			if err := put(domain, ip); err != nil {
+				slog.Error("failed to import record", "domain", domain, "error", err.Error())
+				failed++
+				continue
+			}
+			slog.Info(fmt.Sprintf("imported %s: %s", domain, ip))
+		}
+		done()
+		if failed > 0 {
+			slog.Error(fmt.Sprintf("failed to import %d of %d records", failed, len(domains)))
+			os.Exit(1)
+		}
+	},
+}
+
+// localRecords returns the records in the store configured for s.
+func localRecords(s *ddns.Server) (ddns.Domains, error) {
+	if err := s.Load(); err != nil {
+		return nil, err
+	}
+	defer s.Store.Close()
+	return s.Store.List()
+}
+
+func init() {
+	zoneExportCmd.Flags().Bool("remote", false, "read the records from the server using the API")
+	zoneImportCmd.Flags().Bool("remote", false, "send the records to the server using the API")
+	zoneImportCmd.Flags().String("origin", "", "origin for relative names in the zone file (default: the configured zone origin)")
+
+	zoneCmd.AddCommand(zoneExportCmd)
+	zoneCmd.AddCommand(zoneImportCmd)
+	rootCmd.AddCommand(zoneCmd)
+}
@@ -0,0 +1,343 @@
+package ddns
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+const (
+	// DefaultACMEDirectory is the production Let's Encrypt directory.
+	DefaultACMEDirectory = acme.LetsEncryptURL
+
+	// DefaultACMERenewBefore is how long before expiry a certificate is renewed
+	// when [ACMEConfig.RenewBefore] is not set.
+	DefaultACMERenewBefore = 30 * 24 * time.Hour
+
+	acmeAccountKeyFile = "acme_account.key"
+	acmeCertFile       = "acme_cert.pem"
+	acmeKeyFile        = "acme_key.pem"
+
+	// acmeRetryInterval is how long to wait after a failed attempt to obtain a
+	// certificate. It is intentionally long to stay within CA rate limits.
+	acmeRetryInterval = 15 * time.Minute
+
+	// acmeCheckInterval is the longest time between checks for renewal.
+	acmeCheckInterval = 12 * time.Hour
+)
+
+// ACMEConfig configures automatic certificates for the HTTP API using the ACME
+// protocol (RFC 8555). Challenges are solved using DNS-01, which the server
+// answers from its own DNS listener since it is authoritative for the zone.
+type ACMEConfig struct {
+	// DirectoryURL is the ACME directory of the certificate authority. If not
+	// set, [DefaultACMEDirectory] will be used.
+	DirectoryURL string
+
+	// Email is an optional contact address for the ACME account.
+	Email string
+
+	// Domains are the names that the certificate will be issued for. Each must
+	// resolve using this server's DNS listener.
+	Domains []string
+
+	// CacheDir is the directory where the account key and the issued
+	// certificate are stored, so that they survive restarts.
+	CacheDir string
+
+	// CACertFile is an optional PEM bundle used to verify the ACME server
+	// itself, such as the root certificate of a local Pebble instance.
+	CACertFile string
+
+	// RenewBefore is how long before expiry a certificate will be renewed. If
+	// not set, [DefaultACMERenewBefore] will be used.
+	RenewBefore time.Duration
+}
+
+// acmeManager obtains and renews a certificate for [ACMEConfig.Domains], and
+// serves it as [tls.Config.GetCertificate].
+type acmeManager struct {
+	config *ACMEConfig
+	server *Server
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+	leaf *x509.Certificate
+}
+
+func newACMEManager(s *Server, c *ACMEConfig) (*acmeManager, error) {
+	if len(c.Domains) == 0 {
+		return nil, fmt.Errorf("acme: no domains configured")
+	}
+	if c.CacheDir == "" {
+		return nil, fmt.Errorf("acme: no cache directory configured")
+	}
+	if err := os.MkdirAll(c.CacheDir, 0700); err != nil {
+		return nil, err
+	}
+
+	m := &acmeManager{config: c, server: s}
+	if err := m.loadCached(); err != nil {
+		slog.Info("no usable cached ACME certificate", "path", c.CacheDir, "error", err.Error())
+	}
+	return m, nil
+}
+
+// GetCertificate returns the most recently issued certificate.
+func (m *acmeManager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.cert == nil {
+		return nil, fmt.Errorf("acme: certificate has not been issued yet")
+	}
+	return m.cert, nil
+}
+
+// run obtains a certificate if needed, then renews it before it expires. It
+// blocks until ctx is cancelled.
+func (m *acmeManager) run(ctx context.Context) {
+	for {
+		wait := m.renewIn()
+		if wait <= 0 {
+			slog.Info("obtaining ACME certificate", "domains", m.config.Domains)
+			if err := m.obtain(ctx); err != nil {
+				slog.Error("failed to obtain ACME certificate", "error", err.Error())
+				wait = acmeRetryInterval
+			} else {
+				slog.Info("obtained ACME certificate", "domains", m.config.Domains)
+				continue
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// renewIn returns how long until the current certificate should be renewed,
+// capped at [acmeCheckInterval].
+func (m *acmeManager) renewIn() time.Duration {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.leaf == nil {
+		return 0
+	}
+	renewBefore := m.config.RenewBefore
+	if renewBefore == 0 {
+		renewBefore = DefaultACMERenewBefore
+	}
+	return min(time.Until(m.leaf.NotAfter.Add(-renewBefore)), acmeCheckInterval)
+}
+
+func (m *acmeManager) obtain(ctx context.Context) error {
+	client, err := m.client()
+	if err != nil {
+		return err
+	}
+
+	account := &acme.Account{}
+	if m.config.Email != "" {
+		account.Contact = []string{"mailto:" + m.config.Email}
+	}
+	if _, err := client.Register(ctx, account, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return fmt.Errorf("acme: failed to register account: %w", err)
+	}
+
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(m.config.Domains...))
+	if err != nil {
+		return fmt.Errorf("acme: failed to create order: %w", err)
+	}
+
+	for _, u := range order.AuthzURLs {
+		if err := m.authorize(ctx, client, u); err != nil {
+			return err
+		}
+	}
+
+	order, err = client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return fmt.Errorf("acme: order failed: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: m.config.Domains}, key)
+	if err != nil {
+		return err
+	}
+	der, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return fmt.Errorf("acme: failed to finalize order: %w", err)
+	}
+
+	if err := m.store(der, key); err != nil {
+		return err
+	}
+	return m.loadCached()
+}
+
+// authorize solves the DNS-01 challenge for a single authorization by serving
+// the challenge record from the server's own DNS listener.
+func (m *acmeManager) authorize(ctx context.Context, client *acme.Client, url string) error {
+	z, err := client.GetAuthorization(ctx, url)
+	if err != nil {
+		return fmt.Errorf("acme: failed to get authorization: %w", err)
+	}
+	if z.Status == acme.StatusValid {
+		return nil
+	}
+
+	var chal *acme.Challenge
+	for _, c := range z.Challenges {
+		if c.Type == "dns-01" {
+			chal = c
+			break
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("acme: no dns-01 challenge offered for %s", z.Identifier.Value)
+	}
+
+	value, err := client.DNS01ChallengeRecord(chal.Token)
+	if err != nil {
+		return err
+	}
+	name := "_acme-challenge." + strings.TrimPrefix(z.Identifier.Value, "*.")
+	m.server.addChallenge(name, value)
+	defer m.server.removeChallenge(name, value)
+
+	if _, err := client.Accept(ctx, chal); err != nil {
+		return fmt.Errorf("acme: failed to accept challenge for %s: %w", z.Identifier.Value, err)
+	}
+	if _, err := client.WaitAuthorization(ctx, z.URI); err != nil {
+		return fmt.Errorf("acme: authorization failed for %s: %w", z.Identifier.Value, err)
+	}
+	return nil
+}
+
+func (m *acmeManager) client() (*acme.Client, error) {
+	key, err := m.accountKey()
+	if err != nil {
+		return nil, err
+	}
+
+	client := &acme.Client{
+		Key:          key,
+		DirectoryURL: m.config.DirectoryURL,
+	}
+	if client.DirectoryURL == "" {
+		client.DirectoryURL = DefaultACMEDirectory
+	}
+
+	if m.config.CACertFile != "" {
+		b, err := os.ReadFile(m.config.CACertFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("acme: no certificates found in %s", m.config.CACertFile)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+		client.HTTPClient = &http.Client{Transport: transport}
+	}
+
+	return client, nil
+}
+
+// accountKey loads the ACME account key from the cache directory, creating it
+// if it does not exist yet.
+func (m *acmeManager) accountKey() (crypto.Signer, error) {
+	p := filepath.Join(m.config.CacheDir, acmeAccountKeyFile)
+	b, err := os.ReadFile(p)
+	if err == nil {
+		block, _ := pem.Decode(b)
+		if block == nil {
+			return nil, fmt.Errorf("acme: invalid account key: %s", p)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(p, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (m *acmeManager) store(chain [][]byte, key *ecdsa.PrivateKey) error {
+	certPEM := []byte{}
+	for _, der := range chain {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	if err := os.WriteFile(filepath.Join(m.config.CacheDir, acmeKeyFile), keyPEM, 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(m.config.CacheDir, acmeCertFile), certPEM, 0644)
+}
+
+// loadCached loads the certificate from the cache directory, as long as it
+// covers all of [ACMEConfig.Domains].
+func (m *acmeManager) loadCached() error {
+	cert, err := tls.LoadX509KeyPair(
+		filepath.Join(m.config.CacheDir, acmeCertFile),
+		filepath.Join(m.config.CacheDir, acmeKeyFile),
+	)
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	for _, d := range m.config.Domains {
+		if !slices.Contains(leaf.DNSNames, d) {
+			return fmt.Errorf("acme: cached certificate does not include %s", d)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cert = &cert
+	m.leaf = leaf
+	return nil
+}
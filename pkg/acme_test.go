@@ -0,0 +1,317 @@
+package ddns
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/acme"
+)
+
+func TestACMEChallengeDNS(t *testing.T) {
+	s := &Server{Store: NewMemoryStore()}
+	addr := startNameserver(t, s)
+	name := "_acme-challenge.api.home.com"
+	s.addChallenge(name, "token1")
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), dns.TypeTXT)
+	res, _, err := (&dns.Client{}).Exchange(m, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Authoritative || len(res.Answer) != 1 {
+		t.Fatalf("expected a single authoritative answer, got: %v", res)
+	}
+	if txt, ok := res.Answer[0].(*dns.TXT); !ok || txt.Txt[0] != "token1" {
+		t.Fatalf("incorrect answer: %v", res.Answer[0])
+	}
+
+	s.removeChallenge(name, "token1")
+	res, _, err = (&dns.Client{}).Exchange(m, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Answer) != 0 {
+		t.Fatalf("expected no answers after removing the challenge, got: %v", res.Answer)
+	}
+}
+
+func TestACMEObtain(t *testing.T) {
+	s := &Server{Store: NewMemoryStore()}
+	ca := newMockACME(t, startNameserver(t, s))
+
+	config := &ACMEConfig{
+		DirectoryURL: ca.URL + "/directory",
+		Domains:      []string{"api.home.com"},
+		CacheDir:     t.TempDir(),
+	}
+	m, err := newACMEManager(s, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := m.obtain(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := m.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leaf.DNSNames) != 1 || leaf.DNSNames[0] != "api.home.com" {
+		t.Fatalf("incorrect certificate names: %v", leaf.DNSNames)
+	}
+	if len(s.getChallenges("_acme-challenge.api.home.com")) != 0 {
+		t.Fatalf("expected the challenge to be removed")
+	}
+	if m.renewIn() <= 0 {
+		t.Fatalf("expected the new certificate to not need renewal")
+	}
+
+	// The certificate is loaded from the cache after a restart
+	m, err = newACMEManager(s, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.GetCertificate(&tls.ClientHelloInfo{}); err != nil {
+		t.Fatalf("expected the cached certificate, got: %v", err)
+	}
+}
+
+// mockACME is a minimal ACME server (RFC 8555) which validates dns-01
+// challenges by querying a nameserver, and signs certificates with a
+// throwaway CA. Signatures on requests are not verified.
+type mockACME struct {
+	*httptest.Server
+	t          *testing.T
+	nameserver string
+
+	mu         sync.Mutex
+	nonce      int
+	thumbprint string
+	domain     string
+	token      string
+	valid      bool
+	csr        *x509.CertificateRequest
+	caKey      *ecdsa.PrivateKey
+	caCert     *x509.Certificate
+}
+
+func newMockACME(t *testing.T, nameserver string) *mockACME {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "mock ACME CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &mockACME{t: t, nameserver: nameserver, caKey: caKey, caCert: caCert, token: "mocktoken"}
+	m.Server = httptest.NewServer(http.HandlerFunc(m.handle))
+	t.Cleanup(m.Close)
+	return m
+}
+
+func (m *mockACME) handle(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nonce++
+	w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce%d", m.nonce))
+
+	if r.URL.Path == "/directory" {
+		json.NewEncoder(w).Encode(map[string]string{
+			"newNonce":   m.URL + "/nonce",
+			"newAccount": m.URL + "/account",
+			"newOrder":   m.URL + "/order",
+		})
+		return
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	var body struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	payload, _ := base64.RawURLEncoding.DecodeString(body.Payload)
+
+	switch r.URL.Path {
+	case "/account":
+		if err := m.register(body.Protected); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Location", m.URL+"/account/1")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]any{"status": "valid"})
+	case "/order":
+		req := struct{ Identifiers []struct{ Value string } }{}
+		json.Unmarshal(payload, &req)
+		m.domain = req.Identifiers[0].Value
+		w.Header().Set("Location", m.URL+"/order/1")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(m.order())
+	case "/order/1":
+		w.Header().Set("Location", m.URL+"/order/1")
+		json.NewEncoder(w).Encode(m.order())
+	case "/authz/1":
+		json.NewEncoder(w).Encode(m.authz())
+	case "/challenge/1":
+		if err := m.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		json.NewEncoder(w).Encode(m.authz()["challenges"].([]map[string]any)[0])
+	case "/finalize":
+		req := struct{ CSR string }{}
+		json.Unmarshal(payload, &req)
+		der, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		m.csr = csr
+		w.Header().Set("Location", m.URL+"/order/1")
+		json.NewEncoder(w).Encode(m.order())
+	case "/cert":
+		m.issue(w)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// register stores the thumbprint of the account key, which is part of the
+// expected challenge record.
+func (m *mockACME) register(protected string) error {
+	b, err := base64.RawURLEncoding.DecodeString(protected)
+	if err != nil {
+		return err
+	}
+	header := struct {
+		JWK struct{ X, Y string }
+	}{}
+	if err := json.Unmarshal(b, &header); err != nil {
+		return err
+	}
+	x, _ := base64.RawURLEncoding.DecodeString(header.JWK.X)
+	y, _ := base64.RawURLEncoding.DecodeString(header.JWK.Y)
+	pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	m.thumbprint, err = acme.JWKThumbprint(pub)
+	return err
+}
+
+// validate checks the dns-01 challenge record using the nameserver.
+func (m *mockACME) validate() error {
+	sum := sha256.Sum256([]byte(m.token + "." + m.thumbprint))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn("_acme-challenge."+m.domain), dns.TypeTXT)
+	res, _, err := (&dns.Client{}).Exchange(q, m.nameserver)
+	if err != nil {
+		return err
+	}
+	for _, rr := range res.Answer {
+		if txt, ok := rr.(*dns.TXT); ok && strings.Join(txt.Txt, "") == expected {
+			m.valid = true
+			return nil
+		}
+	}
+	return fmt.Errorf("challenge record not found, got: %v", res.Answer)
+}
+
+func (m *mockACME) authz() map[string]any {
+	status := "pending"
+	if m.valid {
+		status = "valid"
+	}
+	return map[string]any{
+		"status":     status,
+		"identifier": map[string]string{"type": "dns", "value": m.domain},
+		"challenges": []map[string]any{{
+			"type":   "dns-01",
+			"url":    m.URL + "/challenge/1",
+			"token":  m.token,
+			"status": status,
+		}},
+	}
+}
+
+func (m *mockACME) order() map[string]any {
+	o := map[string]any{
+		"status":         "pending",
+		"identifiers":    []map[string]string{{"type": "dns", "value": m.domain}},
+		"authorizations": []string{m.URL + "/authz/1"},
+		"finalize":       m.URL + "/finalize",
+	}
+	switch {
+	case m.csr != nil:
+		o["status"] = "valid"
+		o["certificate"] = m.URL + "/cert"
+	case m.valid:
+		o["status"] = "ready"
+	}
+	return o
+}
+
+func (m *mockACME) issue(w http.ResponseWriter) {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		DNSNames:     m.csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, m.caCert, m.csr.PublicKey, m.caKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: m.caCert.Raw})
+}
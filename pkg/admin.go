@@ -0,0 +1,489 @@
+package ddns
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultKeysFileName is the name of the keys file when [Server.KeysFile] is
+// not set. It is stored in the same directory as the hosts file or database.
+const DefaultKeysFileName = "keys.yaml"
+
+// APIKeyInfo describes an API key in responses from the admin API. It never
+// includes the secret or its hash.
+type APIKeyInfo struct {
+	ID       string    `json:"id"`
+	Label    string    `json:"label,omitempty"`
+	Created  time.Time `json:"created,omitempty"`
+	Expires  time.Time `json:"expires,omitempty"`
+	Disabled bool      `json:"disabled"`
+	Admin    bool      `json:"admin"`
+	Domains  string    `json:"domains,omitempty"`
+	Policy   *Policy   `json:"policy,omitempty"`
+}
+
+// APIKeyRequest is the body used to create or update an API key using the
+// admin API. When updating, nil fields are left unchanged. An empty Domains
+// value removes the domain restriction, and a Policy replaces the existing
+// policy entirely.
+type APIKeyRequest struct {
+	Label    *string    `json:"label,omitempty"`
+	Domains  *string    `json:"domains,omitempty"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	Disabled *bool      `json:"disabled,omitempty"`
+	Admin    *bool      `json:"admin,omitempty"`
+	Policy   *Policy    `json:"policy,omitempty"`
+}
+
+// CreatedAPIKey is the response when an API key is created. Token is the only
+// copy of the secret.
+type CreatedAPIKey struct {
+	Key   APIKeyInfo `json:"key"`
+	Token string     `json:"token"`
+}
+
+func (k *APIKey) info() APIKeyInfo {
+	out := APIKeyInfo{
+		ID:       k.ID,
+		Label:    k.Label,
+		Created:  k.Created,
+		Expires:  k.Expires,
+		Disabled: k.Disabled,
+		Admin:    k.Admin,
+		Policy:   k.Policy,
+	}
+	if k.Domains != nil {
+		out.Domains = k.Domains.String()
+	}
+	return out
+}
+
+// apply updates k using the non-nil fields of req.
+func (req *APIKeyRequest) apply(k *APIKey) error {
+	if req.Domains != nil {
+		k.Domains = nil
+		if *req.Domains != "" {
+			r, err := regexp.Compile(*req.Domains)
+			if err != nil {
+				return err
+			}
+			k.Domains = r
+		}
+	}
+	if req.Label != nil {
+		k.Label = *req.Label
+	}
+	if req.Expires != nil {
+		k.Expires = *req.Expires
+	}
+	if req.Disabled != nil {
+		k.Disabled = *req.Disabled
+	}
+	if req.Admin != nil {
+		k.Admin = *req.Admin
+	}
+	if req.Policy != nil {
+		k.Policy = req.Policy
+	}
+	return nil
+}
+
+// canManage returns an error and the status to respond with if admin may not
+// change or delete k using the admin API.
+func (admin *APIKey) canManage(k *APIKey) (int, error) {
+	if !k.managed {
+		return http.StatusConflict, errors.New("keys from the config can only be changed in the config")
+	}
+	if err := admin.covers(k); err != nil {
+		return http.StatusForbidden, err
+	}
+	return 0, nil
+}
+
+// inherit copies the restrictions of admin which k does not set, so that keys
+// created by an admin with a restricted policy are restricted in the same way
+// by default.
+func (admin *APIKey) inherit(k *APIKey) {
+	if k.Domains == nil {
+		k.Domains = admin.Domains
+	}
+	if admin.Policy == nil {
+		return
+	}
+	ap, kp := admin.Policy, *k.policy()
+	if len(kp.RecordTypes) == 0 {
+		kp.RecordTypes = ap.RecordTypes
+	}
+	if len(kp.Names) == 0 && len(kp.Zones) == 0 {
+		kp.Names, kp.Zones = ap.Names, ap.Zones
+	}
+	if len(kp.Addresses) == 0 {
+		kp.Addresses = ap.Addresses
+	}
+	if len(kp.Sources) == 0 {
+		kp.Sources = ap.Sources
+	}
+	k.Policy = &kp
+}
+
+// covers returns an error if k is allowed to do anything which admin is not.
+// An admin without a policy is not restricted. Regexes are only compared as
+// strings, so a restricted admin must give keys the same [APIKey.Domains] and
+// a subset of its [Policy.Names].
+func (admin *APIKey) covers(k *APIKey) error {
+	if admin.Domains != nil && (k.Domains == nil || k.Domains.String() != admin.Domains.String()) {
+		return fmt.Errorf("domains must be %s", admin.Domains)
+	}
+	if admin.Policy == nil {
+		return nil
+	}
+	for _, op := range []Operation{OperationRead, OperationUpdate, OperationDelete, OperationManageKeys} {
+		if k.allowsOperation(op) && !admin.allowsOperation(op) {
+			return fmt.Errorf("operation not allowed: %s", op)
+		}
+	}
+
+	ap, kp := admin.Policy, k.policy()
+	if len(ap.RecordTypes) > 0 {
+		if len(kp.RecordTypes) == 0 {
+			return fmt.Errorf("record types must be within: %v", ap.RecordTypes)
+		}
+		for _, t := range kp.RecordTypes {
+			if !ap.AllowsRecordType(t) {
+				return fmt.Errorf("record type not allowed: %s", t)
+			}
+		}
+	}
+	if len(ap.Names) > 0 || len(ap.Zones) > 0 {
+		if len(kp.Names) == 0 && len(kp.Zones) == 0 {
+			return errors.New("names or zones are required")
+		}
+		for _, r := range kp.Names {
+			if !slices.ContainsFunc(ap.Names, func(a *regexp.Regexp) bool { return a.String() == r.String() }) {
+				return fmt.Errorf("name not allowed: %s", r)
+			}
+		}
+		for _, z := range kp.Zones {
+			if !(&Policy{Zones: ap.Zones}).AllowsName(z) {
+				return fmt.Errorf("zone not allowed: %s", z)
+			}
+		}
+	}
+	if len(ap.Addresses) > 0 {
+		if len(kp.Addresses) == 0 {
+			return fmt.Errorf("addresses must be within: %v", ap.Addresses)
+		}
+		for _, r := range kp.Addresses {
+			if !slices.ContainsFunc(ap.Addresses, r.within) {
+				return fmt.Errorf("address range not allowed: %s", r)
+			}
+		}
+	}
+	if len(ap.Sources) > 0 {
+		if len(kp.Sources) == 0 {
+			return fmt.Errorf("sources must be within: %v", ap.Sources)
+		}
+		for _, n := range kp.Sources {
+			if !slices.ContainsFunc(ap.Sources, func(a netip.Prefix) bool { return prefixWithin(n, a) }) {
+				return fmt.Errorf("source not allowed: %s", n)
+			}
+		}
+	}
+	return nil
+}
+
+// within returns true if every address in r is also in other. Only CIDRs are
+// compared, so "public" and "private" are only within themselves.
+func (r AddressRange) within(other AddressRange) bool {
+	if r == other {
+		return true
+	}
+	p, err := r.prefix()
+	if err != nil || !p.IsValid() {
+		return false
+	}
+	o, err := other.prefix()
+	return err == nil && o.IsValid() && prefixWithin(p, o)
+}
+
+// prefixWithin returns true if every address in p is also in other.
+func prefixWithin(p, other netip.Prefix) bool {
+	return p.Bits() >= other.Bits() && other.Contains(p.Addr())
+}
+
+// requireAdmin wraps an admin API handler, only allowing requests which use an
+// API key that may perform [OperationManageKeys].
+func (s *Server) requireAdmin(next func(http.ResponseWriter, *http.Request, *APIKey)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if key := s.authorize(w, r, OperationManageKeys); key != nil {
+			next(w, r, key)
+		}
+	}
+}
+
+func (s *Server) handleListKeys() http.HandlerFunc {
+	return s.requireAdmin(func(w http.ResponseWriter, r *http.Request, _ *APIKey) {
+		s.configMu.RLock()
+		out := []APIKeyInfo{}
+		for _, k := range s.APIKeys {
+			out = append(out, k.info())
+		}
+		s.configMu.RUnlock()
+		writeJSON(w, http.StatusOK, out)
+	})
+}
+
+func (s *Server) handleCreateKey() http.HandlerFunc {
+	return s.requireAdmin(func(w http.ResponseWriter, r *http.Request, admin *APIKey) {
+		req := &APIKeyRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		key, token, err := GenerateAPIKey("", nil, time.Time{})
+		if err != nil {
+			slog.Error(err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if err := req.apply(key); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		key.managed = true
+		admin.inherit(key)
+		if err := admin.covers(key); err != nil {
+			slog.Info("key may not create a less restricted key", "admin", admin.ID, "error", err.Error())
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		s.configMu.Lock()
+		s.APIKeys = append(s.APIKeys, key)
+		s.configMu.Unlock()
+		if err := s.saveKeys(); err != nil {
+			// The token is not returned, so the key could never be used
+			s.configMu.Lock()
+			s.APIKeys = slices.DeleteFunc(slices.Clone(s.APIKeys), func(k *APIKey) bool { return k == key })
+			s.configMu.Unlock()
+			s.keysNotSaved(w, err)
+			return
+		}
+
+		slog.Info("created API key", "admin", admin.ID, "key", key.ID)
+		writeJSON(w, http.StatusCreated, CreatedAPIKey{Key: key.info(), Token: token})
+	})
+}
+
+func (s *Server) handleUpdateKey() http.HandlerFunc {
+	return s.requireAdmin(func(w http.ResponseWriter, r *http.Request, admin *APIKey) {
+		req := &APIKeyRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		s.configMu.Lock()
+		i := slices.IndexFunc(s.APIKeys, func(k *APIKey) bool { return k.ID == r.PathValue("id") })
+		if i == -1 {
+			s.configMu.Unlock()
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if status, err := admin.canManage(s.APIKeys[i]); err != nil {
+			s.configMu.Unlock()
+			http.Error(w, err.Error(), status)
+			return
+		}
+		// Modify a copy, so concurrent requests never see a partial update
+		key := *s.APIKeys[i]
+		if err := req.apply(&key); err != nil {
+			s.configMu.Unlock()
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		admin.inherit(&key)
+		if err := admin.covers(&key); err != nil {
+			s.configMu.Unlock()
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		s.APIKeys[i] = &key
+		s.configMu.Unlock()
+		if err := s.saveKeys(); err != nil {
+			s.keysNotSaved(w, err)
+			return
+		}
+
+		slog.Info("updated API key", "admin", admin.ID, "key", key.ID)
+		writeJSON(w, http.StatusOK, key.info())
+	})
+}
+
+func (s *Server) handleDeleteKey() http.HandlerFunc {
+	return s.requireAdmin(func(w http.ResponseWriter, r *http.Request, admin *APIKey) {
+		id := r.PathValue("id")
+		s.configMu.Lock()
+		i := slices.IndexFunc(s.APIKeys, func(k *APIKey) bool { return k.ID == id })
+		if i == -1 {
+			s.configMu.Unlock()
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if status, err := admin.canManage(s.APIKeys[i]); err != nil {
+			s.configMu.Unlock()
+			http.Error(w, err.Error(), status)
+			return
+		}
+		s.APIKeys = slices.Delete(slices.Clone(s.APIKeys), i, i+1)
+		s.configMu.Unlock()
+		if err := s.saveKeys(); err != nil {
+			s.keysNotSaved(w, err)
+			return
+		}
+
+		slog.Info("deleted API key", "admin", admin.ID, "key", id)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// getKeysFile returns the path to the keys file, or an empty string if there
+// is none.
+func (s *Server) getKeysFile() string {
+	if s.KeysFile != "" {
+		return s.KeysFile
+	}
+	if s.HostsFile != "" {
+		return path.Join(path.Dir(s.HostsFile), DefaultKeysFileName)
+	}
+	if s.StorePath != "" {
+		return path.Join(path.Dir(s.StorePath), DefaultKeysFileName)
+	}
+	return ""
+}
+
+// readKeysFile returns the keys saved in the keys file, if it exists.
+func (s *Server) readKeysFile() ([]*APIKey, error) {
+	p := s.getKeysFile()
+	if p == "" {
+		return nil, nil
+	}
+
+	b, err := os.ReadFile(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []*APIKey{}
+	if err := yaml.Unmarshal(b, &keys); err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		k.managed = true
+	}
+	return keys, nil
+}
+
+// loadKeys adds the keys from the keys file to [Server.APIKeys]. Keys with
+// the same ID as a key from the config are ignored, since those can only be
+// changed in the config.
+func (s *Server) loadKeys() error {
+	keys, err := s.readKeysFile()
+
+	s.configMu.Lock()
+	defer s.configMu.Unlock()
+	s.keysFileErr = err
+	if err != nil {
+		return err
+	}
+	s.APIKeys = mergeKeys(s.APIKeys, keys)
+	if keys != nil {
+		slog.Info("loaded API keys from keys file", "path", s.getKeysFile())
+	}
+	return nil
+}
+
+// mergeKeys returns the keys from the config followed by the managed keys,
+// skipping any managed key with the same ID as a key from the config.
+func mergeKeys(config, managed []*APIKey) []*APIKey {
+	out := slices.DeleteFunc(slices.Clone(config), func(k *APIKey) bool { return k.managed })
+	for _, k := range managed {
+		if slices.ContainsFunc(out, func(existing *APIKey) bool { return existing.ID == k.ID }) {
+			slog.Warn("ignoring API key in keys file with the same ID as a key in the config", "key", k.ID)
+			continue
+		}
+		out = append(out, k)
+	}
+	return out
+}
+
+// managedKeys returns the keys which were created using the admin API.
+func managedKeys(keys []*APIKey) []*APIKey {
+	out := []*APIKey{}
+	for _, k := range keys {
+		if k.managed {
+			out = append(out, k)
+		}
+	}
+	return out
+}
+
+// saveKeys writes the keys created using the admin API to the keys file, if
+// there is one. The keys are marshalled and written while holding
+// keysSaveMu, so that concurrent saves can not write an older set of keys
+// last.
+func (s *Server) saveKeys() error {
+	p := s.getKeysFile()
+	if p == "" {
+		return nil
+	}
+	s.keysSaveMu.Lock()
+	defer s.keysSaveMu.Unlock()
+
+	s.configMu.RLock()
+	loadErr := s.keysFileErr
+	b, err := yaml.Marshal(managedKeys(s.APIKeys))
+	s.configMu.RUnlock()
+	if loadErr != nil {
+		return fmt.Errorf("not overwriting keys file which failed to load: %w", loadErr)
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+		return err
+	}
+	// The file only contains hashes, but there is no reason for it to be
+	// readable by others
+	return writeFileAtomic(p, b, 0600)
+}
+
+// keysNotSaved logs an error returned by [Server.saveKeys()], and responds
+// with an internal server error.
+func (s *Server) keysNotSaved(w http.ResponseWriter, err error) {
+	slog.Error("failed to write to keys file", "path", s.getKeysFile(), "error", err.Error())
+	http.Error(w, "failed to save keys", http.StatusInternalServerError)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error(err.Error())
+	}
+}
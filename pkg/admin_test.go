@@ -0,0 +1,197 @@
+package ddns
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminAPI(t *testing.T) {
+	admin, adminToken, err := GenerateAPIKey("admin", nil, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin.Admin = true
+
+	s := &Server{
+		APIKeys:   []*APIKey{admin},
+		HostsFile: filepath.Join(t.TempDir(), "hosts.yaml"),
+	}
+	ts := httptest.NewServer(s.handler())
+	defer ts.Close()
+	a := &Agent{ServerAddress: ts.URL, APIKey: adminToken}
+
+	label, domains := "router", `^home\.com$`
+	created, err := a.CreateKey(context.Background(), &APIKeyRequest{Label: &label, Domains: &domains})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.Key.Label != label || created.Key.Domains != domains || created.Key.Admin {
+		t.Fatalf("incorrect created key: %+v", created.Key)
+	}
+
+	// The new key is not an admin, so it may not manage keys
+	nonAdmin := &Agent{ServerAddress: ts.URL, APIKey: created.Token}
+	if _, err := nonAdmin.ListKeys(context.Background()); err == nil {
+		t.Fatalf("non-admin key was allowed to list keys")
+	}
+
+	disabled := true
+	updated, err := a.UpdateKey(context.Background(), created.Key.ID, &APIKeyRequest{Disabled: &disabled})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !updated.Disabled || updated.Domains != domains {
+		t.Fatalf("incorrect updated key: %+v", updated)
+	}
+	if s.authenticate(created.Token) != nil {
+		t.Fatalf("disabled key was authenticated")
+	}
+
+	keys, err := a.ListKeys(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("expected 2 keys, got: %+v", keys)
+	}
+
+	// Keys from the config can only be changed there
+	if err := a.DeleteKey(context.Background(), admin.ID); err == nil || !strings.Contains(err.Error(), "409") {
+		t.Fatalf("expected a conflict when deleting a key from the config, got: %v", err)
+	}
+
+	// Only the keys created using the admin API are persisted to the keys
+	// file next to the hosts file, so that removing a key from the config
+	// removes it from the server
+	loaded := &Server{HostsFile: s.HostsFile}
+	if err := loaded.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.APIKeys) != 1 || loaded.APIKeys[0].ID != created.Key.ID || !loaded.APIKeys[0].Disabled {
+		t.Fatalf("keys file was not written correctly: %+v", loaded.APIKeys)
+	}
+
+	if err := a.DeleteKey(context.Background(), created.Key.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.DeleteKey(context.Background(), created.Key.ID); err == nil {
+		t.Fatalf("deleting a missing key should fail")
+	}
+	if len(s.APIKeys) != 1 {
+		t.Fatalf("key was not deleted: %+v", s.APIKeys)
+	}
+}
+
+func TestAdminAPIRestrictedAdmin(t *testing.T) {
+	admin, adminToken, err := GenerateAPIKey("admin", nil, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin.Policy = &Policy{
+		Operations: []Operation{OperationRead, OperationUpdate, OperationManageKeys},
+		Zones:      []string{"home.com"},
+	}
+
+	s := &Server{APIKeys: []*APIKey{admin}}
+	ts := httptest.NewServer(s.handler())
+	defer ts.Close()
+	a := &Agent{ServerAddress: ts.URL, APIKey: adminToken}
+
+	// New keys are restricted like the admin by default
+	created, err := a.CreateKey(context.Background(), &APIKeyRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.Key.Policy == nil || len(created.Key.Policy.Zones) != 1 || created.Key.Policy.Zones[0] != "home.com" {
+		t.Fatalf("expected the key to inherit the zones of the admin, got: %+v", created.Key.Policy)
+	}
+
+	// A narrower zone is allowed
+	if _, err := a.CreateKey(context.Background(), &APIKeyRequest{Policy: &Policy{Zones: []string{"a.home.com"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	forbidden := []*APIKeyRequest{
+		{Policy: &Policy{Zones: []string{"work.com"}}},
+		{Policy: &Policy{Operations: []Operation{OperationDelete}, Zones: []string{"home.com"}}},
+	}
+	for _, req := range forbidden {
+		if _, err := a.CreateKey(context.Background(), req); err == nil || !strings.Contains(err.Error(), "403") {
+			t.Fatalf("expected a key with a broader policy to be forbidden, got: %v", err)
+		}
+	}
+
+	// Existing keys can not be widened either
+	if _, err := a.UpdateKey(context.Background(), created.Key.ID, &APIKeyRequest{Policy: &Policy{}}); err != nil {
+		t.Fatalf("expected the removed restrictions to be inherited again, got: %v", err)
+	}
+	if _, err := a.UpdateKey(context.Background(), created.Key.ID, &APIKeyRequest{Policy: &Policy{Zones: []string{"com"}}}); err == nil {
+		t.Fatalf("expected widening the zones of a key to be forbidden")
+	}
+}
+
+func TestServerLoadInvalidKeysFile(t *testing.T) {
+	dir := t.TempDir()
+	hostsFile := filepath.Join(dir, "hosts.yaml")
+	if err := os.WriteFile(hostsFile, []byte("home.com: 1.2.3.4\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keysFile := filepath.Join(dir, DefaultKeysFileName)
+	if err := os.WriteFile(keysFile, []byte("not: [a list"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{HostsFile: hostsFile}
+	if err := s.Load(); err == nil {
+		t.Fatal("expected an error for the invalid keys file")
+	}
+	if ip := s.Get("home.com"); !ip.Equal(net.ParseIP("1.2.3.4")) {
+		t.Fatalf("expected the records to be loaded, got: %s", ip)
+	}
+
+	// The keys file is not overwritten, so no keys are lost
+	s.APIKeys = append(s.APIKeys, &APIKey{ID: "new", managed: true})
+	if err := s.saveKeys(); err == nil {
+		t.Fatal("expected an error for the keys file which failed to load")
+	}
+	if b, _ := os.ReadFile(keysFile); string(b) != "not: [a list" {
+		t.Fatalf("keys file was overwritten: %s", b)
+	}
+}
+
+func TestAdminAPISaveFailure(t *testing.T) {
+	admin, adminToken, err := GenerateAPIKey("admin", nil, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin.Admin = true
+
+	// The keys file can not be written, since its directory is a file
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "file"), nil, 0644)
+	s := &Server{
+		APIKeys:  []*APIKey{admin},
+		KeysFile: filepath.Join(dir, "file", "keys.yaml"),
+	}
+	ts := httptest.NewServer(s.handler())
+	defer ts.Close()
+	a := &Agent{ServerAddress: ts.URL, APIKey: adminToken}
+
+	label := "router"
+	if _, err := a.CreateKey(context.Background(), &APIKeyRequest{Label: &label}); err == nil || !strings.Contains(err.Error(), "500") {
+		t.Fatalf("expected an internal server error, got: %v", err)
+	}
+	keys, err := a.ListKeys(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 {
+		t.Fatalf("expected the unsaved key to be removed, got: %+v", keys)
+	}
+}
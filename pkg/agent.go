@@ -1,11 +1,15 @@
 package ddns
 
 import (
-	"bytes"
-	"fmt"
+	"context"
+	"errors"
 	"io"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 const DefaultServerAddress = "http://localhost:3345"
@@ -18,21 +22,128 @@ type Agent struct {
 
 	// APIKey will be used to authenticate to the DDNS API.
 	APIKey string
+
+	// Interval is how often [Agent.Run] checks for a new IP. If not set,
+	// [DefaultAgentInterval] is used.
+	Interval time.Duration
+
+	// RefreshInterval is how often [Agent.Run] sends an update even if the IP
+	// has not changed, in case the record was changed by someone else. If not
+	// set, [DefaultAgentRefreshInterval] is used.
+	RefreshInterval time.Duration
+
+	// MaxBackoff is the longest [Agent.Run] waits between attempts after
+	// errors. If not set, [DefaultAgentMaxBackoff] is used.
+	MaxBackoff time.Duration
+
+	// Source determines the IP used by [Agent.Run]. If not set, the IP is
+	// determined by the server, see [ServerSource].
+	Source *IPSourceConfig
+
+	// Sources overrides [Agent.Source] for specific domains.
+	Sources map[string]*IPSourceConfig
+
+	// ServerAddresses are more servers, which are used together with
+	// ServerAddress according to ServerMode, for redundancy.
+	ServerAddresses []string
+
+	// ServerMode is [ServerModeFailover] or [ServerModeFanout]. If not set,
+	// [ServerModeFailover] is used.
+	ServerMode string
+
+	// health tracks which servers are down
+	health serverHealth
+
+	// HTTPClient is used for requests to the DDNS API. If not set, a client
+	// is built from the settings below.
+	HTTPClient *http.Client `yaml:"-"`
+
+	// Timeout is how long a request to the DDNS API may take. If not set,
+	// [DefaultAgentTimeout] is used. A negative value disables the timeout.
+	Timeout time.Duration
+
+	// CAFile is a PEM bundle of the certificate authorities which are trusted
+	// for the server, instead of the system ones.
+	CAFile string
+
+	// ClientCertFile and ClientKeyFile are a PEM certificate and key which
+	// are sent to the server, for mutual TLS.
+	ClientCertFile string
+	ClientKeyFile  string
+
+	// Proxy is the URL of the proxy for requests to the DDNS API. If not
+	// set, the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables
+	// are used.
+	Proxy string
+
+	// UserAgent is sent with requests to the DDNS API. If not set,
+	// "ddns/" followed by [Version] is used.
+	UserAgent string
+
+	// Verify enables waiting for the nameservers to serve the new IP after
+	// an update in [Agent.Run], see [Agent.VerifyIP].
+	Verify bool
+
+	// VerifyNameservers are the nameservers which [Agent.VerifyIP] queries,
+	// optionally with a port. If not set, the NS records of the domain are
+	// used.
+	VerifyNameservers []string
+
+	// VerifyTimeout is how long [Agent.VerifyIP] waits. If not set,
+	// [DefaultVerifyTimeout] is used.
+	VerifyTimeout time.Duration
+
+	// Hooks are run by [Agent.Run] when the IP changes.
+	Hooks []*AgentHook
+
+	// StateFile is where [Agent.Run] keeps the status of each domain, so that
+	// it continues from the last pushed IP after a restart. See
+	// [AgentStatus]. If not set, the status is only kept in memory.
+	StateFile string
+
+	// StatusListener is the address for [Agent.ServeStatus], such as
+	// "127.0.0.1:8053".
+	StatusListener string
+
+	// Once makes [Agent.Run] return after a single check, for running the
+	// agent from cron. Use it with StateFile, so that the IP is only sent when
+	// it changes.
+	Once bool
+
+	statusMu sync.Mutex
+	status   *agentStatusStore
+
+	clientMu sync.Mutex
+	client   *http.Client
+
+	// Jobs are run by [Agent.RunJobs], to keep several domains, record types
+	// or servers up to date from a single agent.
+	Jobs []*AgentJob
 }
 
 // DetermineIP returns the public IP of the caller as seen by the DDNS API
-// server. Uses the /api/v1/ip endpoint.
-func (a *Agent) DetermineIP() (string, error) {
-	url := fmt.Sprintf("%s/api/v1/ip", a.getServerAddress())
-	res, err := http.Get(url)
+// server. Uses the /api/v1/ip endpoint. If there are several servers, they
+// are tried in order until one responds, see [Agent.ServerAddresses].
+func (a *Agent) DetermineIP(ctx context.Context) (string, error) {
+	errs := []error{}
+	for _, server := range a.health.order(a.servers()) {
+		ip, err := a.determineIP(ctx, server)
+		a.health.record(server, err, a.backoff)
+		if err == nil {
+			return ip, nil
+		}
+		errs = append(errs, err)
+	}
+	return "", errors.Join(errs...)
+}
+
+func (a *Agent) determineIP(ctx context.Context, server string) (string, error) {
+	res, err := a.do(ctx, http.MethodGet, server+"/api/v1/ip", nil, "", http.StatusOK)
 	if err != nil {
 		return "", err
 	}
 	defer res.Body.Close()
-	if res.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("GET request to %s returned unexpected status code: %d", url, res.StatusCode)
-	}
-	body, err := io.ReadAll(res.Body)
+	body, err := io.ReadAll(io.LimitReader(res.Body, 256))
 	if err != nil {
 		return "", err
 	}
@@ -40,30 +151,61 @@ func (a *Agent) DetermineIP() (string, error) {
 }
 
 // UpdateIP updates the IP for a given DDNS domain. Uses the /api/v1/update
-// endpoint.
-func (a *Agent) UpdateIP(domain, ip string) (bool, error) {
-	url := fmt.Sprintf("%s/api/v1/update?domain=%s&ip=%s", a.getServerAddress(), domain, ip)
-	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(nil))
+// endpoint. If there are several servers, they are updated according to
+// [Agent.ServerMode], and an error is returned unless the update succeeded
+// on the first healthy server ([ServerModeFailover]) or on every server
+// ([ServerModeFanout]). Use [Agent.UpdateIPServers] for the result on each
+// server.
+func (a *Agent) UpdateIP(ctx context.Context, domain, ip string) (bool, error) {
+	results, err := a.UpdateIPServers(ctx, domain, ip)
 	if err != nil {
 		return false, err
 	}
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", a.APIKey))
-	client := http.Client{}
-	res, err := client.Do(req)
+	return a.Summarize(results)
+}
+
+func (a *Agent) updateIP(ctx context.Context, server, domain, ip string) (bool, error) {
+	q := url.Values{}
+	q.Set("domain", domain)
+	q.Set("ip", ip)
+	res, err := a.do(ctx, http.MethodPost, server+"/api/v1/update?"+q.Encode(), nil, "", http.StatusOK, http.StatusCreated)
 	if err != nil {
 		return false, err
 	}
+	res.Body.Close()
+	return res.StatusCode == http.StatusCreated, nil
+}
 
-	updated := false
-	switch res.StatusCode {
-	case http.StatusOK:
-	case http.StatusCreated:
-		updated = true
-	default:
-		return false, fmt.Errorf("POST request to %s returned unexpected status code: %d", url, res.StatusCode)
-	}
+// ListRecords returns the records which the API key may read. Uses the
+// /api/v1/records endpoint.
+func (a *Agent) ListRecords(ctx context.Context) (Domains, error) {
+	out := Domains{}
+	err := a.doJSON(ctx, http.MethodGet, "/api/v1/records", nil, http.StatusOK, &out)
+	return out, err
+}
 
-	return updated, nil
+// History returns the entries in the audit log selected by f, for the domains
+// which the API key may read. Uses the /api/v1/history endpoint.
+func (a *Agent) History(ctx context.Context, f AuditFilter) ([]AuditEntry, error) {
+	q := url.Values{}
+	if f.Domain != "" {
+		q.Set("domain", f.Domain)
+	}
+	if f.KeyID != "" {
+		q.Set("key", f.KeyID)
+	}
+	if !f.Since.IsZero() {
+		q.Set("since", f.Since.Format(time.RFC3339))
+	}
+	if !f.Until.IsZero() {
+		q.Set("until", f.Until.Format(time.RFC3339))
+	}
+	if f.Limit > 0 {
+		q.Set("limit", strconv.Itoa(f.Limit))
+	}
+	out := []AuditEntry{}
+	err := a.doJSON(ctx, http.MethodGet, "/api/v1/history?"+q.Encode(), nil, http.StatusOK, &out)
+	return out, err
 }
 
 func (a *Agent) getServerAddress() string {
@@ -0,0 +1,149 @@
+package ddns
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// DefaultAgentTimeout is how long a request to the DDNS API may take by
+// default, see [Agent.Timeout].
+const DefaultAgentTimeout = 30 * time.Second
+
+// Version is sent in the User-Agent header of requests made by the [Agent].
+// It is set by the ddns command.
+var Version = "dev"
+
+// Errors for the status codes returned by the DDNS API. Errors returned by the
+// [Agent] wrap these, and can be checked with [errors.Is].
+var (
+	ErrBadRequest   = errors.New("bad request")
+	ErrUnauthorized = errors.New("invalid API key")
+	ErrForbidden    = errors.New("not authorized")
+	ErrNotFound     = errors.New("not found")
+)
+
+// statusError is returned when the server responds with an unexpected status
+// code.
+type statusError struct {
+	method string
+	url    string
+	code   int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s request to %s returned unexpected status code: %d", e.method, e.url, e.code)
+}
+
+// Unwrap returns the error for the status code, such as [ErrForbidden].
+func (e *statusError) Unwrap() error {
+	switch e.code {
+	case http.StatusBadRequest:
+		return ErrBadRequest
+	case http.StatusUnauthorized:
+		return ErrUnauthorized
+	case http.StatusForbidden:
+		return ErrForbidden
+	case http.StatusNotFound:
+		return ErrNotFound
+	}
+	return nil
+}
+
+// httpClient returns [Agent.HTTPClient], or a client built from the settings
+// of the agent. The client is built on first use.
+func (a *Agent) httpClient() (*http.Client, error) {
+	if a.HTTPClient != nil {
+		return a.HTTPClient, nil
+	}
+	a.clientMu.Lock()
+	defer a.clientMu.Unlock()
+	if a.client != nil {
+		return a.client, nil
+	}
+
+	tlsConfig := &tls.Config{}
+	if a.CAFile != "" {
+		b, err := os.ReadFile(a.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates found in %s", a.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if a.ClientCertFile != "" || a.ClientKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(a.ClientCertFile, a.ClientKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	if a.Proxy != "" {
+		u, err := url.Parse(a.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+
+	timeout := a.Timeout
+	if timeout == 0 {
+		timeout = DefaultAgentTimeout
+	}
+	a.client = &http.Client{Transport: transport, Timeout: max(timeout, 0)}
+	return a.client, nil
+}
+
+// do sends an authenticated request, and returns the response if its status
+// is one of expected. The caller must close the body.
+func (a *Agent) do(ctx context.Context, method, u string, body io.Reader, contentType string, expected ...int) (*http.Response, error) {
+	client, err := a.httpClient()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if a.APIKey != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", a.APIKey))
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("User-Agent", a.getUserAgent())
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, code := range expected {
+		if res.StatusCode == code {
+			return res, nil
+		}
+	}
+	// Read the rest of the body so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(res.Body, 4096))
+	res.Body.Close()
+	return nil, &statusError{method: method, url: u, code: res.StatusCode}
+}
+
+func (a *Agent) getUserAgent() string {
+	if a.UserAgent != "" {
+		return a.UserAgent
+	}
+	return "ddns/" + Version
+}
@@ -0,0 +1,144 @@
+package ddns
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAgentErrors(t *testing.T) {
+	tests := map[int]error{
+		http.StatusBadRequest:   ErrBadRequest,
+		http.StatusUnauthorized: ErrUnauthorized,
+		http.StatusForbidden:    ErrForbidden,
+		http.StatusNotFound:     ErrNotFound,
+	}
+	for status, expected := range tests {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+		}))
+		a := &Agent{ServerAddress: ts.URL}
+		if _, err := a.UpdateIP(context.Background(), "home.com", "1.2.3.4"); !errors.Is(err, expected) {
+			t.Fatalf("expected %v for status %d, got: %v", expected, status, err)
+		}
+		ts.Close()
+	}
+}
+
+func TestAgentRequests(t *testing.T) {
+	defer func(v string) { Version = v }(Version)
+	Version = "1.2.3"
+	var got *http.Request
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer ts.Close()
+
+	a := &Agent{ServerAddress: ts.URL, APIKey: "mykey"}
+	if _, err := a.UpdateIP(context.Background(), "home.com&ip=6.6.6.6", "1.2.3.4"); err != nil {
+		t.Fatal(err)
+	}
+	if d, ip := got.URL.Query().Get("domain"), got.URL.Query().Get("ip"); d != "home.com&ip=6.6.6.6" || ip != "1.2.3.4" {
+		t.Fatalf(`query parameters were not escaped, got domain: "%s", ip: "%s"`, d, ip)
+	}
+	if ua := got.Header.Get("User-Agent"); ua != "ddns/1.2.3" {
+		t.Fatalf(`incorrect user agent, got: "%s"`, ua)
+	}
+	if auth := got.Header.Get("Authorization"); auth != "Bearer mykey" {
+		t.Fatalf(`incorrect authorization header, got: "%s"`, auth)
+	}
+
+	// Requests are cancelled with the context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := a.UpdateIP(ctx, "home.com", "1.2.3.4"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the request to be cancelled, got: %v", err)
+	}
+
+	// An injected client is used as is
+	used := false
+	a = &Agent{ServerAddress: ts.URL, HTTPClient: &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		used = true
+		return http.DefaultTransport.RoundTrip(r)
+	})}}
+	if _, err := a.UpdateIP(context.Background(), "home.com", "1.2.3.4"); err != nil || !used {
+		t.Fatalf("expected the injected client to be used, error: %v", err)
+	}
+}
+
+func TestAgentTimeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer ts.Close()
+
+	a := &Agent{ServerAddress: ts.URL, Timeout: 10 * time.Millisecond}
+	start := time.Now()
+	if _, err := a.DetermineIP(context.Background()); err == nil {
+		t.Fatalf("expected timeout error")
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("request was not timed out, took: %s", d)
+	}
+}
+
+func TestAgentTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client-key.pem")
+	writeTestCert(t, certFile, keyFile, "agent")
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 || r.TLS.PeerCertificates[0].Subject.CommonName != "agent" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("1.2.3.4"))
+	}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	ts.StartTLS()
+	defer ts.Close()
+
+	caFile := filepath.Join(dir, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	if err := os.WriteFile(caFile, ca, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server certificate is not trusted by default
+	a := &Agent{ServerAddress: ts.URL}
+	if _, err := a.DetermineIP(context.Background()); err == nil {
+		t.Fatalf("expected error for untrusted certificate")
+	}
+
+	a = &Agent{ServerAddress: ts.URL, CAFile: caFile}
+	if _, err := a.DetermineIP(context.Background()); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("expected error without a client certificate, got: %v", err)
+	}
+
+	a = &Agent{ServerAddress: ts.URL, CAFile: caFile, ClientCertFile: certFile, ClientKeyFile: keyFile}
+	ip, err := a.DetermineIP(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip != "1.2.3.4" {
+		t.Fatalf(`incorrect ip, got: "%s"`, ip)
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
@@ -0,0 +1,173 @@
+package ddns
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// DefaultHookTimeout is how long a hook may run by default, see
+// [AgentHook.Timeout].
+const DefaultHookTimeout = 30 * time.Second
+
+// When an [AgentHook] runs.
+const (
+	HookBefore = "before" // before the update is sent
+	HookAfter  = "after"  // after the update, whether it succeeded or not
+)
+
+// The result of an update, passed to [HookAfter] hooks.
+const (
+	HookResultUpdated   = "updated"   // the server changed the record
+	HookResultUnchanged = "unchanged" // the record already had the IP
+	HookResultFailed    = "failed"    // the update failed
+)
+
+// AgentHook is a command or HTTP callback which [Agent.Run] runs when the IP
+// changes, for example to reconfigure a firewall or VPN endpoint. If a
+// [HookBefore] hook fails, the update is not sent, and is retried later.
+//
+// Commands are run by the shell, with these environment variables set:
+// DDNS_HOOK_EVENT, DDNS_HOOK_DOMAIN, DDNS_HOOK_OLD_IP, DDNS_HOOK_NEW_IP,
+// DDNS_HOOK_RESULT and DDNS_HOOK_ERROR. Callbacks receive a POST request
+// with a [HookEvent] as JSON, and must respond with a 2xx status.
+type AgentHook struct {
+	// When is [HookBefore] or [HookAfter]. If not set, [HookAfter] is used.
+	When string
+
+	// Command is run by the shell. Either Command or URL must be set.
+	Command string
+
+	// URL receives the callback.
+	URL string
+
+	// Timeout is how long the hook may run. If not set,
+	// [DefaultHookTimeout] is used.
+	Timeout time.Duration
+}
+
+// HookEvent describes an IP change to an [AgentHook].
+type HookEvent struct {
+	// Event is [HookBefore] or [HookAfter].
+	Event  string `json:"event"`
+	Domain string `json:"domain"`
+
+	// OldIP is the IP which the agent last pushed, which is empty after
+	// starting.
+	OldIP string `json:"old,omitempty"`
+	NewIP string `json:"new"`
+
+	// Result and Error are only set for [HookAfter].
+	Result string `json:"result,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// env returns the environment variables for hook commands.
+func (e *HookEvent) env() []string {
+	return []string{
+		"DDNS_HOOK_EVENT=" + e.Event,
+		"DDNS_HOOK_DOMAIN=" + e.Domain,
+		"DDNS_HOOK_OLD_IP=" + e.OldIP,
+		"DDNS_HOOK_NEW_IP=" + e.NewIP,
+		"DDNS_HOOK_RESULT=" + e.Result,
+		"DDNS_HOOK_ERROR=" + e.Error,
+	}
+}
+
+// runHooks runs the hooks for e.Event in order, logging the outcome of each.
+// It stops at the first [HookBefore] hook which fails, and returns its error.
+func (a *Agent) runHooks(ctx context.Context, e HookEvent) error {
+	for _, h := range a.Hooks {
+		if h.getWhen() != e.Event {
+			continue
+		}
+		start := time.Now()
+		err := h.run(ctx, e)
+		if err != nil {
+			slog.Warn("hook failed", "hook", h.String(), "event", e.Event, "domain", e.Domain, "error", err.Error())
+			if e.Event == HookBefore {
+				return err
+			}
+			continue
+		}
+		slog.Info("hook succeeded", "hook", h.String(), "event", e.Event, "domain", e.Domain, "duration", time.Since(start).String())
+	}
+	return nil
+}
+
+func (h *AgentHook) run(ctx context.Context, e HookEvent) error {
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = DefaultHookTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if h.Command != "" {
+		cmd := exec.CommandContext(ctx, "sh", "-c", h.Command)
+		cmd.Env = append(os.Environ(), e.env()...)
+		// Don't wait for children of the shell which keep the output open
+		cmd.WaitDelay = time.Second
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			if output := strings.TrimSpace(string(out)); output != "" {
+				return fmt.Errorf("%w: %s", err, output)
+			}
+			return err
+		}
+		return nil
+	}
+
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("POST request to %s returned unexpected status code: %d", h.URL, res.StatusCode)
+	}
+	return nil
+}
+
+// validate returns an error if the hook is not configured correctly.
+func (h *AgentHook) validate() error {
+	if w := h.getWhen(); w != HookBefore && w != HookAfter {
+		return fmt.Errorf("hook must run %s or %s, got: %s", HookBefore, HookAfter, h.When)
+	}
+	if h.Command == "" && h.URL == "" {
+		return errors.New("no command or url configured for hook")
+	}
+	return nil
+}
+
+// String returns the command or URL of the hook, for logs.
+func (h *AgentHook) String() string {
+	if h.Command != "" {
+		return h.Command
+	}
+	return h.URL
+}
+
+func (h *AgentHook) getWhen() string {
+	if h.When == "" {
+		return HookAfter
+	}
+	return h.When
+}
@@ -0,0 +1,137 @@
+package ddns
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAgentHooks(t *testing.T) {
+	status := http.StatusCreated
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	events := []HookEvent{}
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e := HookEvent{}
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			t.Error(err)
+		}
+		events = append(events, e)
+	}))
+	defer callback.Close()
+
+	out := filepath.Join(t.TempDir(), "hook.env")
+	a := &Agent{
+		ServerAddress: ts.URL,
+		MaxBackoff:    time.Millisecond,
+		Hooks: []*AgentHook{
+			{When: HookBefore, Command: `echo "$DDNS_HOOK_EVENT $DDNS_HOOK_DOMAIN $DDNS_HOOK_OLD_IP $DDNS_HOOK_NEW_IP" >> ` + out},
+			{Command: `echo "$DDNS_HOOK_EVENT $DDNS_HOOK_RESULT $DDNS_HOOK_ERROR" >> ` + out},
+			{URL: callback.URL},
+		},
+	}
+	state := &agentState{lastIP: "1.1.1.1"}
+	source := &CommandSource{Command: "echo 2.2.2.2"}
+	if err := a.check(context.Background(), "home.com", source, state); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "before home.com 1.1.1.1 2.2.2.2\nafter updated \n"
+	if string(b) != expected {
+		t.Fatalf("incorrect hook output, expected %q, got %q", expected, string(b))
+	}
+	if len(events) != 1 || events[0].Event != HookAfter || events[0].OldIP != "1.1.1.1" || events[0].NewIP != "2.2.2.2" || events[0].Result != HookResultUpdated {
+		t.Fatalf("incorrect callback events: %+v", events)
+	}
+
+	// Hooks are not run when the IP is refreshed
+	state.lastPush = time.Time{}
+	if err := a.check(context.Background(), "home.com", source, state); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("expected no hooks for a refresh, got: %+v", events)
+	}
+
+	// After hooks are told about failed updates
+	status = http.StatusForbidden
+	state.lastIP = "1.1.1.1"
+	if err := a.check(context.Background(), "home.com", source, state); err == nil {
+		t.Fatal("expected the update to fail")
+	}
+	if len(events) != 2 || events[1].Result != HookResultFailed || !strings.Contains(events[1].Error, "403") {
+		t.Fatalf("expected a failed event, got: %+v", events)
+	}
+}
+
+func TestAgentHooksBeforeFails(t *testing.T) {
+	updates := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		updates++
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer ts.Close()
+
+	a := &Agent{
+		ServerAddress: ts.URL,
+		Hooks: []*AgentHook{
+			{When: HookBefore, Command: "echo firewall is locked; exit 1"},
+		},
+	}
+	state := &agentState{}
+	err := a.check(context.Background(), "home.com", &CommandSource{Command: "echo 2.2.2.2"}, state)
+	if err == nil || !strings.Contains(err.Error(), "firewall is locked") {
+		t.Fatalf("expected the hook output in the error, got: %v", err)
+	}
+	if updates != 0 || state.lastIP != "" {
+		t.Fatalf("expected no update after a failed hook")
+	}
+}
+
+func TestAgentHookTimeout(t *testing.T) {
+	h := &AgentHook{Command: "sleep 5", Timeout: 20 * time.Millisecond}
+	start := time.Now()
+	if err := h.run(context.Background(), HookEvent{}); err == nil {
+		t.Fatal("expected the hook to time out")
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Fatal("hook was not stopped after the timeout")
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+	h = &AgentHook{URL: ts.URL}
+	if err := h.run(context.Background(), HookEvent{}); err == nil {
+		t.Fatal("expected an error for a failed callback")
+	}
+}
+
+func TestAgentHookValidate(t *testing.T) {
+	invalid := []*AgentHook{
+		{},
+		{When: "during", Command: "true"},
+	}
+	for _, h := range invalid {
+		if err := h.validate(); err == nil {
+			t.Errorf("expected an error for %+v", h)
+		}
+	}
+	if err := (&AgentHook{When: HookBefore, URL: "http://localhost"}).validate(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,189 @@
+package ddns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AgentJob keeps one or more domains on a server pointing at the IP of the
+// agent. Fields which are not set are inherited from the [Agent] which runs
+// the job.
+type AgentJob struct {
+	// Domains are the domains which are updated.
+	Domains []string
+
+	// RecordType is "A" or "AAAA", and selects the address family of the
+	// source. The server stores a single address per domain, so the same
+	// domain can not be updated with both record types on the same server.
+	RecordType string
+
+	// Source determines the IP for the domains. If not set, the source of the
+	// agent is used, including its overrides in [Agent.Sources].
+	Source *IPSourceConfig
+
+	// ServerAddress, ServerAddresses and APIKey are used to update the
+	// domains, see [Agent.ServerAddress], [Agent.ServerAddresses] and
+	// [Agent.APIKey]. ServerAddresses is only used if ServerAddress is set,
+	// otherwise both are inherited from the agent.
+	ServerAddress   string
+	ServerAddresses []string
+	APIKey          string
+
+	// Interval is how often the IP is checked, see [Agent.Interval].
+	Interval time.Duration
+}
+
+// RunJobs runs every job in [Agent.Jobs], until ctx is cancelled. All jobs are
+// validated before any of them starts.
+func (a *Agent) RunJobs(ctx context.Context) error {
+	if len(a.Jobs) == 0 {
+		return errors.New("no agent jobs configured")
+	}
+	agents := make([]*Agent, len(a.Jobs))
+	seen := map[string]bool{}
+	for i, job := range a.Jobs {
+		agent, err := a.jobAgent(job)
+		if err != nil {
+			return fmt.Errorf("job %d: %w", i+1, err)
+		}
+		for _, domain := range job.Domains {
+			key := agent.getServerAddress() + " " + strings.ToLower(domain)
+			if seen[key] {
+				return fmt.Errorf("job %d: %s is updated on %s by more than one job", i+1, domain, agent.getServerAddress())
+			}
+			seen[key] = true
+		}
+		agents[i] = agent
+	}
+
+	wg := sync.WaitGroup{}
+	mu := sync.Mutex{}
+	errs := []error{}
+	for i, job := range a.Jobs {
+		for _, domain := range job.Domains {
+			agent := agents[i]
+			slog.Info("starting agent", "domain", domain, "server", agent.getServerAddress(), "record_type", job.RecordType)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := agent.Run(ctx, domain); err != nil {
+					mu.Lock()
+					errs = append(errs, fmt.Errorf("%s: %w", domain, err))
+					mu.Unlock()
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// jobAgent returns an agent which runs job, using the settings of a for the
+// fields which the job does not set.
+func (a *Agent) jobAgent(job *AgentJob) (*Agent, error) {
+	if len(job.Domains) == 0 {
+		return nil, errors.New("no domains configured")
+	}
+
+	family := ""
+	switch strings.ToUpper(job.RecordType) {
+	case "A":
+		family = FamilyIPv4
+	case "AAAA":
+		family = FamilyIPv6
+	case "":
+	default:
+		return nil, fmt.Errorf("record type must be A or AAAA: %s", job.RecordType)
+	}
+
+	// jobSource returns a copy of c with the family of the record type
+	jobSource := func(c *IPSourceConfig) (*IPSourceConfig, error) {
+		copied := IPSourceConfig{}
+		if c != nil {
+			copied = *c
+		}
+		if family != "" {
+			if copied.Family != "" && copied.Family != family {
+				return nil, fmt.Errorf("the %s source family does not match the %s record type", copied.Family, job.RecordType)
+			}
+			copied.Family = family
+		}
+		return &copied, nil
+	}
+
+	inherited := job.Source
+	if inherited == nil {
+		inherited = a.Source
+	}
+	source, err := jobSource(inherited)
+	if err != nil {
+		return nil, err
+	}
+	sources := map[string]*IPSourceConfig{}
+	if job.Source == nil {
+		for _, domain := range job.Domains {
+			if c, ok := a.Sources[domain]; ok {
+				if sources[domain], err = jobSource(c); err != nil {
+					return nil, fmt.Errorf("%s: %w", domain, err)
+				}
+			}
+		}
+	}
+
+	out := &Agent{
+		ServerAddress:     a.ServerAddress,
+		APIKey:            a.APIKey,
+		Interval:          a.Interval,
+		RefreshInterval:   a.RefreshInterval,
+		MaxBackoff:        a.MaxBackoff,
+		ServerAddresses:   a.ServerAddresses,
+		ServerMode:        a.ServerMode,
+		HTTPClient:        a.HTTPClient,
+		Timeout:           a.Timeout,
+		CAFile:            a.CAFile,
+		ClientCertFile:    a.ClientCertFile,
+		ClientKeyFile:     a.ClientKeyFile,
+		Proxy:             a.Proxy,
+		UserAgent:         a.UserAgent,
+		Verify:            a.Verify,
+		VerifyNameservers: a.VerifyNameservers,
+		VerifyTimeout:     a.VerifyTimeout,
+		Hooks:             a.Hooks,
+		StateFile:         a.StateFile,
+		Once:              a.Once,
+		Source:            source,
+		Sources:           sources,
+	}
+	// The status of every job is kept in the same state file
+	status, err := a.statusStore()
+	if err != nil {
+		return nil, err
+	}
+	out.status = status
+	if job.ServerAddress != "" {
+		out.ServerAddress = job.ServerAddress
+		out.ServerAddresses = job.ServerAddresses
+	}
+	if job.APIKey != "" {
+		out.APIKey = job.APIKey
+	}
+	if job.Interval != 0 {
+		out.Interval = job.Interval
+	}
+
+	// Catch invalid sources before starting
+	if _, err := source.source(out); err != nil {
+		return nil, err
+	}
+	for domain, c := range sources {
+		if _, err := c.source(out); err != nil {
+			return nil, fmt.Errorf("%s: %w", domain, err)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,176 @@
+package ddns
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAgentRunJobs(t *testing.T) {
+	mu := sync.Mutex{}
+	updates := map[string][]string{}
+	newServer := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			q := r.URL.Query()
+			updates[name] = append(updates[name], q.Get("domain")+"="+q.Get("ip")+" "+r.Header.Get("Authorization"))
+			w.WriteHeader(http.StatusCreated)
+		}))
+	}
+	v4 := newServer("v4")
+	defer v4.Close()
+	v6 := newServer("v6")
+	defer v6.Close()
+
+	a := &Agent{
+		ServerAddress:   v4.URL,
+		APIKey:          "v4key",
+		Interval:        time.Hour,
+		RefreshInterval: time.Hour,
+		Source:          &IPSourceConfig{Type: SourceTypeCommand, Command: "echo 1.2.3.4"},
+		Jobs: []*AgentJob{
+			{Domains: []string{"home.com", "www.home.com"}, RecordType: "A"},
+			{
+				Domains:       []string{"home.com"},
+				RecordType:    "AAAA",
+				ServerAddress: v6.URL,
+				APIKey:        "v6key",
+				Source:        &IPSourceConfig{Type: SourceTypeCommand, Command: "echo 2001:db8::1"},
+			},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- a.RunJobs(ctx) }()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("agent did not stop")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	sort.Strings(updates["v4"])
+	expected := map[string][]string{
+		"v4": {"home.com=1.2.3.4 Bearer v4key", "www.home.com=1.2.3.4 Bearer v4key"},
+		"v6": {"home.com=2001:db8::1 Bearer v6key"},
+	}
+	for name, e := range expected {
+		got := updates[name]
+		if len(got) != len(e) {
+			t.Fatalf("incorrect updates for %s server, got: %v, expected: %v", name, got, e)
+		}
+		for i := range e {
+			if got[i] != e[i] {
+				t.Fatalf("incorrect updates for %s server, got: %v, expected: %v", name, got, e)
+			}
+		}
+	}
+}
+
+func TestAgentJobValidation(t *testing.T) {
+	invalid := [][]*AgentJob{
+		{},
+		{{}},
+		{{Domains: []string{"home.com"}, RecordType: "MX"}},
+		{{Domains: []string{"home.com"}, RecordType: "AAAA", Source: &IPSourceConfig{Family: FamilyIPv4}}},
+		{{Domains: []string{"home.com"}, Source: &IPSourceConfig{Type: SourceTypeCommand}}},
+		{
+			{Domains: []string{"home.com"}, RecordType: "A"},
+			{Domains: []string{"HOME.com"}, RecordType: "AAAA"},
+		},
+	}
+	for _, jobs := range invalid {
+		a := &Agent{Jobs: jobs}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := a.RunJobs(ctx); err == nil {
+			t.Fatalf("expected error for jobs: %+v", jobs)
+		}
+	}
+}
+
+func TestAgentJobInherits(t *testing.T) {
+	a := &Agent{
+		ServerAddress:     "http://server.com",
+		Timeout:           time.Second,
+		CAFile:            "/path/to/ca.pem",
+		UserAgent:         "custom",
+		Verify:            true,
+		VerifyNameservers: []string{"127.0.0.1:5353"},
+		Hooks:             []*AgentHook{{Command: "true"}},
+	}
+	got, err := a.jobAgent(&AgentJob{Domains: []string{"home.com"}, APIKey: "jobkey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Timeout != a.Timeout || got.CAFile != a.CAFile || got.UserAgent != a.UserAgent || !got.Verify || len(got.VerifyNameservers) != 1 || len(got.Hooks) != 1 {
+		t.Fatalf("job agent did not inherit the settings: %+v", got)
+	}
+	if got.APIKey != "jobkey" {
+		t.Fatalf("expected the api key of the job, got: %s", got.APIKey)
+	}
+}
+
+func TestAgentJobInheritsSources(t *testing.T) {
+	a := &Agent{
+		ServerAddress: "http://server.com",
+		Sources: map[string]*IPSourceConfig{
+			"home.com": {Type: SourceTypeCommand, Command: "echo 2001:db8::1"},
+		},
+	}
+	got, err := a.jobAgent(&AgentJob{Domains: []string{"home.com", "work.com"}, RecordType: "AAAA"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := got.sourceConfig("home.com"); c.Type != SourceTypeCommand || c.Family != FamilyIPv6 {
+		t.Fatalf("expected the override of the agent with the family of the job, got: %+v", c)
+	}
+	if c := got.sourceConfig("work.com"); c.Type != "" || c.Family != FamilyIPv6 {
+		t.Fatalf("expected the default source, got: %+v", c)
+	}
+	if a.Sources["home.com"].Family != "" {
+		t.Fatalf("the source of the agent was modified")
+	}
+
+	// The source of the job replaces the overrides
+	got, err = a.jobAgent(&AgentJob{Domains: []string{"home.com"}, Source: &IPSourceConfig{Type: SourceTypeServer}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := got.sourceConfig("home.com"); c.Type != SourceTypeServer {
+		t.Fatalf("expected the source of the job, got: %+v", c)
+	}
+
+	a.Sources["home.com"].Family = FamilyIPv4
+	if _, err := a.jobAgent(&AgentJob{Domains: []string{"home.com"}, RecordType: "AAAA"}); err == nil {
+		t.Fatalf("expected error for an override with the wrong family")
+	}
+}
+
+func TestServerSourceFamily(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("1.2.3.4"))
+	}))
+	defer ts.Close()
+
+	s := &ServerSource{Agent: &Agent{ServerAddress: ts.URL}, Family: FamilyIPv4}
+	if _, err := s.IP(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	s.Family = FamilyIPv6
+	if _, err := s.IP(context.Background()); err == nil {
+		t.Fatalf("expected error when the server sees the wrong address family")
+	}
+}
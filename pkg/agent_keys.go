@@ -0,0 +1,66 @@
+package ddns
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// ListKeys returns the API keys known to the server. Uses the GET
+// /api/v1/keys endpoint, which requires an admin API key.
+func (a *Agent) ListKeys(ctx context.Context) ([]APIKeyInfo, error) {
+	out := []APIKeyInfo{}
+	err := a.doJSON(ctx, http.MethodGet, "/api/v1/keys", nil, http.StatusOK, &out)
+	return out, err
+}
+
+// CreateKey creates a new API key. The returned token is the only copy of the
+// secret. Uses the POST /api/v1/keys endpoint, which requires an admin API
+// key.
+func (a *Agent) CreateKey(ctx context.Context, req *APIKeyRequest) (*CreatedAPIKey, error) {
+	out := &CreatedAPIKey{}
+	err := a.doJSON(ctx, http.MethodPost, "/api/v1/keys", req, http.StatusCreated, out)
+	return out, err
+}
+
+// UpdateKey changes the fields of an API key which are set in req. Uses the
+// PATCH /api/v1/keys/{id} endpoint, which requires an admin API key.
+func (a *Agent) UpdateKey(ctx context.Context, id string, req *APIKeyRequest) (*APIKeyInfo, error) {
+	out := &APIKeyInfo{}
+	err := a.doJSON(ctx, http.MethodPatch, "/api/v1/keys/"+url.PathEscape(id), req, http.StatusOK, out)
+	return out, err
+}
+
+// DeleteKey deletes an API key. Uses the DELETE /api/v1/keys/{id} endpoint,
+// which requires an admin API key.
+func (a *Agent) DeleteKey(ctx context.Context, id string) error {
+	return a.doJSON(ctx, http.MethodDelete, "/api/v1/keys/"+url.PathEscape(id), nil, http.StatusNoContent, nil)
+}
+
+// doJSON sends an authenticated request with body encoded as JSON, and decodes
+// the response into out if it is not nil.
+func (a *Agent) doJSON(ctx context.Context, method, path string, body any, expectedStatus int, out any) error {
+	var reqBody io.Reader
+	contentType := ""
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(b)
+		contentType = "application/json"
+	}
+
+	res, err := a.do(ctx, method, a.getServerAddress()+path, reqBody, contentType, expectedStatus)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
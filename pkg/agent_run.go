@@ -0,0 +1,297 @@
+package ddns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+const (
+	// DefaultAgentInterval is how often [Agent.Run] checks for a new IP by
+	// default.
+	DefaultAgentInterval = 5 * time.Minute
+
+	// DefaultAgentRefreshInterval is how often [Agent.Run] sends an update by
+	// default, even if the IP has not changed.
+	DefaultAgentRefreshInterval = 24 * time.Hour
+
+	// DefaultAgentMaxBackoff is the longest [Agent.Run] waits between
+	// attempts after errors by default.
+	DefaultAgentMaxBackoff = 30 * time.Minute
+)
+
+// agentRetryDelay is the delay before the first retry after an error. It
+// doubles after each consecutive error, up to [Agent.MaxBackoff].
+var agentRetryDelay = 5 * time.Second
+
+// agentState is what [Agent.Run] remembers between checks.
+type agentState struct {
+	// lastIP is the IP which was last pushed successfully, and lastPush is
+	// when
+	lastIP   string
+	lastPush time.Time
+
+	// pushed holds the servers which already have pushingIP, so that only the
+	// servers which failed are retried with [ServerModeFanout]
+	pushingIP string
+	pushed    map[string]bool
+
+	failures int
+}
+
+// Run keeps the record for domain pointing at the IP of the agent, until ctx
+// is cancelled. Every [Agent.Interval], the IP is determined using the source
+// for the domain (see [Agent.Source]), and the server is only updated if the
+// IP differs from the last one pushed, or if [Agent.RefreshInterval] has
+// passed. After an error, it retries with exponential backoff. Sources which
+// implement [IPWatcher] trigger a check as soon as the IP may have changed.
+// The result of each check is kept in [Agent.StateFile], and sent to systemd
+// if the agent runs as a notify service.
+func (a *Agent) Run(ctx context.Context, domain string) error {
+	if _, err := a.getServerMode(); err != nil {
+		return err
+	}
+	for _, h := range a.Hooks {
+		if err := h.validate(); err != nil {
+			return err
+		}
+	}
+	source, err := a.sourceFor(domain)
+	if err != nil {
+		return err
+	}
+	var changes <-chan struct{}
+	if w, ok := source.(IPWatcher); ok {
+		if changes, err = w.Changes(ctx); err != nil {
+			return err
+		}
+	}
+
+	status, err := a.statusStore()
+	if err != nil {
+		return err
+	}
+	server := a.getServerAddress()
+	status.update(domain, server, func(r *RecordStatus) {
+		r.Source = a.sourceConfig(domain).getType()
+	})
+
+	// Continue from the IP which was pushed before a restart
+	last := status.get(domain, server)
+	state := &agentState{lastIP: last.PushedIP, lastPush: last.PushedAt}
+	if err := sdNotify("READY=1"); err != nil {
+		slog.Warn("failed to notify systemd", "error", err.Error())
+	}
+
+	// The loop wakes up at half of the watchdog interval, to show that it is
+	// not stuck. See [NotifyWatchdog].
+	var keepAlive <-chan time.Time
+	keepAliveInterval := watchdogInterval()
+	if keepAliveInterval > 0 {
+		ticker := time.NewTicker(keepAliveInterval)
+		defer ticker.Stop()
+		keepAlive = ticker.C
+		agentWatchdog.progress(state, time.Now().Add(2*keepAliveInterval))
+		defer agentWatchdog.stop(state)
+	}
+
+	delay := time.Duration(0)
+	for {
+		timer := time.After(delay)
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				slog.Info("stopping agent", "domain", domain)
+				return nil
+			case <-keepAlive:
+				agentWatchdog.progress(state, time.Now().Add(2*keepAliveInterval))
+				continue
+			case _, ok := <-changes:
+				if !ok {
+					// Receiving from a nil channel blocks, leaving the timer
+					slog.Warn("stopped watching for address changes, checking at each interval instead", "domain", domain)
+					changes = nil
+					continue
+				}
+				slog.Debug("address change detected", "domain", domain)
+			case <-timer:
+			}
+			break wait
+		}
+
+		if keepAlive != nil {
+			agentWatchdog.progress(state, time.Now().Add(2*keepAliveInterval+a.checkTimeout()))
+		}
+		err := a.check(ctx, domain, source, state)
+		if keepAlive != nil {
+			agentWatchdog.progress(state, time.Now().Add(2*keepAliveInterval))
+		}
+		a.saveStatus(domain, err)
+		if a.Once {
+			return err
+		}
+		if err != nil {
+			state.failures++
+			delay = a.backoff(state.failures)
+			if errors.Is(err, ErrCGNAT) {
+				slog.Warn("not updating ip, the router is behind carrier-grade NAT and can not be reached from the internet", "domain", domain, "error", err.Error(), "retry_in", delay.String())
+				continue
+			}
+			slog.Error("failed to update ip", "domain", domain, "error", err.Error(), "retry_in", delay.String())
+			continue
+		}
+		state.failures = 0
+		delay = a.getInterval()
+	}
+}
+
+// checkTimeout is how long a check may take, beyond the watchdog interval,
+// before [NotifyWatchdog] considers the run loop to be stuck.
+func (a *Agent) checkTimeout() time.Duration {
+	timeout := watchdogCheckTimeout
+	if a.Verify {
+		timeout += a.getVerifyTimeout()
+	}
+	return timeout
+}
+
+// saveStatus records the result of a check for domain, writes the state
+// file, and tells systemd.
+func (a *Agent) saveStatus(domain string, err error) {
+	now := time.Now()
+	a.setStatus(domain, func(r *RecordStatus) {
+		if err != nil {
+			r.LastFailure = now
+			r.Error = err.Error()
+			return
+		}
+		r.LastSuccess = now
+		r.Error = ""
+	})
+	status, _ := a.statusStore()
+	if err := status.save(); err != nil {
+		slog.Warn("failed to write agent state", "path", a.StateFile, "error", err.Error())
+	}
+	if err := sdNotify("STATUS=" + status.snapshot().summary()); err != nil {
+		slog.Warn("failed to notify systemd", "error", err.Error())
+	}
+}
+
+// check updates the record for domain if the IP has changed or the refresh
+// interval has passed.
+func (a *Agent) check(ctx context.Context, domain string, source IPSource, state *agentState) error {
+	addr, err := source.IP(ctx)
+	if err != nil {
+		return err
+	}
+	ip := addr.String()
+	a.setStatus(domain, func(r *RecordStatus) {
+		r.DetectedIP = ip
+		r.DetectedAt = time.Now()
+	})
+
+	if ip == state.lastIP && time.Since(state.lastPush) < a.getRefreshInterval() {
+		slog.Debug("ip has not changed", "domain", domain, "ip", ip)
+		return nil
+	}
+
+	// Hooks only run when the IP changes, not for refreshes
+	changed := ip != state.lastIP
+	event := HookEvent{Event: HookBefore, Domain: domain, OldIP: state.lastIP, NewIP: ip}
+	if changed {
+		if err := a.runHooks(ctx, event); err != nil {
+			return fmt.Errorf("not updating ip, a hook failed: %w", err)
+		}
+	}
+
+	if ip != state.pushingIP {
+		state.pushingIP = ip
+		state.pushed = map[string]bool{}
+	}
+	updated, err := a.update(ctx, domain, ip, state.pushed)
+	if changed {
+		event.Event = HookAfter
+		switch {
+		case err != nil:
+			event.Result = HookResultFailed
+			event.Error = err.Error()
+		case updated:
+			event.Result = HookResultUpdated
+		default:
+			event.Result = HookResultUnchanged
+		}
+		a.runHooks(ctx, event)
+	}
+	if err != nil {
+		return err
+	}
+	state.lastIP = ip
+	state.lastPush = time.Now()
+	state.pushingIP, state.pushed = "", nil
+	a.setStatus(domain, func(r *RecordStatus) {
+		r.PushedIP = ip
+		r.PushedAt = state.lastPush
+	})
+
+	// A failed verification is only logged, since the update succeeded and
+	// sending it again would not help
+	if updated && a.Verify {
+		if err := a.VerifyIP(ctx, domain, ip); err != nil {
+			slog.Warn("failed to verify ip", "domain", domain, "ip", ip, "error", err.Error())
+		} else {
+			slog.Info("verified ip on all nameservers", "domain", domain, "ip", ip)
+		}
+	}
+	return nil
+}
+
+// update sends the update to the servers, except those in pushed, and logs the
+// result for each.
+func (a *Agent) update(ctx context.Context, domain, ip string, pushed map[string]bool) (bool, error) {
+	results, err := a.updateIPServers(ctx, domain, ip, pushed)
+	if err != nil {
+		return false, err
+	}
+	for _, r := range results {
+		switch {
+		case r.Err != nil && len(results) > 1:
+			slog.Warn("failed to update ip on server", "domain", domain, "ip", ip, "server", r.Server, "error", r.Err.Error())
+		case r.Err != nil:
+		case r.Updated:
+			slog.Info("updated ip", "domain", domain, "ip", ip, "server", r.Server)
+		default:
+			slog.Info("ip already correct", "domain", domain, "ip", ip, "server", r.Server)
+		}
+	}
+	return a.Summarize(results)
+}
+
+// backoff returns the delay after the given number of consecutive failures.
+func (a *Agent) backoff(failures int) time.Duration {
+	maxBackoff := a.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = DefaultAgentMaxBackoff
+	}
+	delay := agentRetryDelay
+	for i := 1; i < failures && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxBackoff)
+}
+
+func (a *Agent) getInterval() time.Duration {
+	if a.Interval <= 0 {
+		return DefaultAgentInterval
+	}
+	return a.Interval
+}
+
+func (a *Agent) getRefreshInterval() time.Duration {
+	if a.RefreshInterval <= 0 {
+		return DefaultAgentRefreshInterval
+	}
+	return a.RefreshInterval
+}
@@ -0,0 +1,92 @@
+package ddns
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAgentRun(t *testing.T) {
+	agentRetryDelay = time.Millisecond
+
+	mu := sync.Mutex{}
+	ip := "1.1.1.1"
+	fail := false
+	updates := []string{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		switch r.URL.Path {
+		case "/api/v1/ip":
+			w.Write([]byte(ip))
+		case "/api/v1/update":
+			updates = append(updates, r.URL.Query().Get("ip"))
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+	defer ts.Close()
+
+	set := func(newIP string, newFail bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		ip, fail = newIP, newFail
+	}
+	got := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, updates...)
+	}
+
+	a := &Agent{
+		ServerAddress:   ts.URL,
+		Interval:        5 * time.Millisecond,
+		RefreshInterval: time.Hour,
+		MaxBackoff:      5 * time.Millisecond,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- a.Run(ctx, "home.com") }()
+
+	// Only the first check sends an update while the IP is unchanged
+	time.Sleep(50 * time.Millisecond)
+	if u := got(); len(u) != 1 || u[0] != "1.1.1.1" {
+		t.Fatalf("expected a single update, got: %v", u)
+	}
+
+	// Errors are retried, and a changed IP is pushed once the server recovers
+	set("2.2.2.2", true)
+	time.Sleep(30 * time.Millisecond)
+	set("2.2.2.2", false)
+	time.Sleep(50 * time.Millisecond)
+	if u := got(); len(u) != 2 || u[1] != "2.2.2.2" {
+		t.Fatalf("expected an update for the new ip, got: %v", u)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("agent did not stop")
+	}
+}
+
+func TestAgentBackoff(t *testing.T) {
+	agentRetryDelay = time.Second
+	a := &Agent{MaxBackoff: 10 * time.Second}
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for i, e := range expected {
+		if got := a.backoff(i + 1); got != e {
+			t.Fatalf("incorrect backoff after %d failures, got: %s, expected: %s", i+1, got, e)
+		}
+	}
+}
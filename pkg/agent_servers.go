@@ -0,0 +1,192 @@
+package ddns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The mode of [Agent.ServerMode].
+const (
+	ServerModeFailover = "failover" // update the first healthy server
+	ServerModeFanout   = "fanout"   // update every server
+)
+
+// ErrServerDown is the result for a server which was skipped, because
+// requests to it failed recently.
+var ErrServerDown = errors.New("server is down")
+
+// ServerResult is the result of updating a record on one server.
+type ServerResult struct {
+	Server  string
+	Updated bool
+	Err     error
+}
+
+// serverHealth tracks consecutive failures for each server. A server which
+// fails is considered down until a backoff has passed, so that it does not
+// slow down every check while it is unreachable.
+type serverHealth struct {
+	mu        sync.Mutex
+	failures  map[string]int
+	downUntil map[string]time.Time
+}
+
+// record updates the health of server after a request which returned err.
+// Errors caused by the request itself, such as an invalid API key, do not
+// count as failures.
+func (h *serverHealth) record(server string, err error, backoff func(int) time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.failures == nil {
+		h.failures = map[string]int{}
+		h.downUntil = map[string]time.Time{}
+	}
+	if !isServerFailure(err) {
+		delete(h.failures, server)
+		delete(h.downUntil, server)
+		return
+	}
+	h.failures[server]++
+	h.downUntil[server] = time.Now().Add(backoff(h.failures[server]))
+}
+
+// isServerFailure returns true if err is a network error or a 5xx response,
+// and not an error caused by the request itself.
+func isServerFailure(err error) bool {
+	se := &statusError{}
+	return err != nil && !(errors.As(err, &se) && se.code < http.StatusInternalServerError)
+}
+
+// isDown returns true if server failed recently, and its backoff has not
+// passed yet.
+func (h *serverHealth) isDown(server string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return time.Now().Before(h.downUntil[server])
+}
+
+// order returns the servers which are up, followed by the servers which are
+// down, with the one which will be back first leading.
+func (h *serverHealth) order(servers []string) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	out := make([]string, len(servers))
+	copy(out, servers)
+	sort.SliceStable(out, func(i, j int) bool {
+		ui, uj := h.downUntil[out[i]], h.downUntil[out[j]]
+		if !now.Before(ui) || !now.Before(uj) {
+			return !now.Before(ui) && now.Before(uj)
+		}
+		return ui.Before(uj)
+	})
+	return out
+}
+
+// UpdateIPServers updates the IP for domain on the servers, according to
+// [Agent.ServerMode], and returns the result for each server which was tried.
+// With [ServerModeFailover], the next server is only tried after a network
+// error or a 5xx response.
+// With [ServerModeFanout], servers which are down are skipped with
+// [ErrServerDown].
+func (a *Agent) UpdateIPServers(ctx context.Context, domain, ip string) ([]ServerResult, error) {
+	return a.updateIPServers(ctx, domain, ip, nil)
+}
+
+// updateIPServers is like [Agent.UpdateIPServers], but with
+// [ServerModeFanout], the servers in pushed are skipped and left out of the
+// results, and servers which are updated successfully are added to it.
+func (a *Agent) updateIPServers(ctx context.Context, domain, ip string, pushed map[string]bool) ([]ServerResult, error) {
+	mode, err := a.getServerMode()
+	if err != nil {
+		return nil, err
+	}
+
+	if mode == ServerModeFailover {
+		results := []ServerResult{}
+		for _, server := range a.health.order(a.servers()) {
+			updated, err := a.updateIP(ctx, server, domain, ip)
+			a.health.record(server, err, a.backoff)
+			results = append(results, ServerResult{Server: server, Updated: updated, Err: err})
+			// A rejected request would be rejected by the other servers too
+			if !isServerFailure(err) {
+				break
+			}
+		}
+		return results, nil
+	}
+
+	servers := []string{}
+	for _, server := range a.servers() {
+		if !pushed[server] {
+			servers = append(servers, server)
+		}
+	}
+	results := make([]ServerResult, len(servers))
+	wg := sync.WaitGroup{}
+	for i, server := range servers {
+		results[i].Server = server
+		if a.health.isDown(server) {
+			results[i].Err = fmt.Errorf("%w, skipped: %s", ErrServerDown, server)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i].Updated, results[i].Err = a.updateIP(ctx, server, domain, ip)
+			a.health.record(server, results[i].Err, a.backoff)
+		}()
+	}
+	wg.Wait()
+	for _, r := range results {
+		if r.Err == nil && pushed != nil {
+			pushed[r.Server] = true
+		}
+	}
+	return results, nil
+}
+
+// Summarize returns whether the record was updated, and an error unless the
+// update succeeded on the first server which responded
+// ([ServerModeFailover]) or on every server ([ServerModeFanout]).
+func (a *Agent) Summarize(results []ServerResult) (bool, error) {
+	updated := false
+	errs := []error{}
+	for _, r := range results {
+		updated = updated || r.Updated
+		if r.Err != nil {
+			errs = append(errs, r.Err)
+		}
+	}
+	if mode, _ := a.getServerMode(); mode == ServerModeFailover {
+		if n := len(results); n > 0 && results[n-1].Err == nil {
+			return updated, nil
+		}
+	}
+	return updated, errors.Join(errs...)
+}
+
+// servers returns [Agent.ServerAddress] followed by [Agent.ServerAddresses].
+func (a *Agent) servers() []string {
+	out := []string{a.getServerAddress()}
+	for _, s := range a.ServerAddresses {
+		out = append(out, strings.TrimSuffix(s, "/"))
+	}
+	return out
+}
+
+func (a *Agent) getServerMode() (string, error) {
+	switch a.ServerMode {
+	case "", ServerModeFailover:
+		return ServerModeFailover, nil
+	case ServerModeFanout:
+		return ServerModeFanout, nil
+	}
+	return "", fmt.Errorf("unknown server mode: %s", a.ServerMode)
+}
@@ -0,0 +1,138 @@
+package ddns
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testUpdateServer starts a server which responds to updates with status,
+// and counts the requests.
+func testUpdateServer(t *testing.T, status int) (*httptest.Server, *atomic.Int32) {
+	count := &atomic.Int32{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count.Add(1)
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(ts.Close)
+	return ts, count
+}
+
+func TestAgentFailover(t *testing.T) {
+	agentRetryDelay = time.Hour
+	down, _ := testUpdateServer(t, http.StatusServiceUnavailable)
+	up, upCount := testUpdateServer(t, http.StatusCreated)
+
+	a := &Agent{ServerAddress: down.URL, ServerAddresses: []string{up.URL}}
+	for i := 0; i < 2; i++ {
+		results, err := a.UpdateIPServers(context.Background(), "home.com", "1.2.3.4")
+		if err != nil {
+			t.Fatal(err)
+		}
+		updated, err := a.Summarize(results)
+		if err != nil || !updated {
+			t.Fatalf("expected the update to fail over, got: %v", err)
+		}
+
+		// The server which is down is only tried the first time
+		if n := len(results); n != 2-i || results[n-1].Server != up.URL {
+			t.Fatalf("incorrect results for attempt %d: %+v", i+1, results)
+		}
+	}
+	if n := upCount.Load(); n != 2 {
+		t.Fatalf("expected 2 requests to the healthy server, got: %d", n)
+	}
+
+	// Rejected requests do not mark a server as down, or fail over
+	forbidden, _ := testUpdateServer(t, http.StatusForbidden)
+	next, nextCount := testUpdateServer(t, http.StatusCreated)
+	a = &Agent{ServerAddress: forbidden.URL, ServerAddresses: []string{next.URL}}
+	results, err := a.UpdateIPServers(context.Background(), "home.com", "1.2.3.4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Err == nil {
+		t.Fatalf("expected error for forbidden update, got: %+v", results)
+	}
+	if n := nextCount.Load(); n != 0 {
+		t.Fatalf("expected no failover after a rejected request, got %d requests", n)
+	}
+	if a.health.isDown(forbidden.URL) {
+		t.Fatalf("server was marked as down after a rejected request")
+	}
+}
+
+func TestAgentFanout(t *testing.T) {
+	agentRetryDelay = time.Hour
+	first, firstCount := testUpdateServer(t, http.StatusCreated)
+	second, secondCount := testUpdateServer(t, http.StatusOK)
+	broken, brokenCount := testUpdateServer(t, http.StatusInternalServerError)
+
+	a := &Agent{ServerAddress: first.URL, ServerAddresses: []string{second.URL}, ServerMode: ServerModeFanout}
+	updated, err := a.UpdateIP(context.Background(), "home.com", "1.2.3.4")
+	if err != nil || !updated {
+		t.Fatalf("expected the update to succeed, got: %v", err)
+	}
+	if firstCount.Load() != 1 || secondCount.Load() != 1 {
+		t.Fatalf("expected every server to be updated")
+	}
+
+	a.ServerAddresses = append(a.ServerAddresses, broken.URL)
+	for i := 0; i < 2; i++ {
+		results, err := a.UpdateIPServers(context.Background(), "home.com", "1.2.3.4")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 3 || results[0].Err != nil || results[1].Err != nil || results[2].Err == nil {
+			t.Fatalf("incorrect results for attempt %d: %+v", i+1, results)
+		}
+		if _, err := a.Summarize(results); err == nil {
+			t.Fatalf("expected error when a server fails")
+		}
+	}
+
+	// The broken server is skipped while it is down
+	if n := brokenCount.Load(); n != 1 {
+		t.Fatalf("expected 1 request to the broken server, got: %d", n)
+	}
+	results, _ := a.UpdateIPServers(context.Background(), "home.com", "1.2.3.4")
+	if !errors.Is(results[2].Err, ErrServerDown) {
+		t.Fatalf("expected the broken server to be skipped, got: %v", results[2].Err)
+	}
+
+	a.ServerMode = "unknown"
+	if _, err := a.UpdateIPServers(context.Background(), "home.com", "1.2.3.4"); err == nil {
+		t.Fatalf("expected error for unknown server mode")
+	}
+}
+
+func TestAgentFanoutRetry(t *testing.T) {
+	agentRetryDelay = time.Millisecond
+	up, upCount := testUpdateServer(t, http.StatusCreated)
+	broken, brokenCount := testUpdateServer(t, http.StatusInternalServerError)
+
+	a := &Agent{ServerAddress: up.URL, ServerAddresses: []string{broken.URL}, ServerMode: ServerModeFanout}
+	source := &CommandSource{Command: "echo 1.2.3.4"}
+	state := &agentState{}
+	for i := 0; i < 2; i++ {
+		if err := a.check(context.Background(), "home.com", source, state); err == nil {
+			t.Fatalf("expected error for attempt %d", i+1)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Only the server which failed is retried
+	if n := upCount.Load(); n != 1 {
+		t.Fatalf("expected 1 request to the healthy server, got: %d", n)
+	}
+	if n := brokenCount.Load(); n != 2 {
+		t.Fatalf("expected 2 requests to the broken server, got: %d", n)
+	}
+	if state.lastIP != "" {
+		t.Fatalf("expected the ip to not be pushed, got: %s", state.lastIP)
+	}
+}
@@ -0,0 +1,370 @@
+package ddns
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AgentStatus is the state of an [Agent], which is kept in [Agent.StateFile]
+// between runs.
+type AgentStatus struct {
+	Records []*RecordStatus `json:"records"`
+}
+
+// RecordStatus is the state of a domain which the agent keeps up to date on a
+// server.
+type RecordStatus struct {
+	Domain string `json:"domain"`
+	Server string `json:"server"`
+
+	// Source is the type of the source of the IP, and DetectedIP is the IP
+	// which it returned last.
+	Source     string    `json:"source"`
+	DetectedIP string    `json:"detected_ip,omitempty"`
+	DetectedAt time.Time `json:"detected_at"`
+
+	// PushedIP is the IP which was last sent to the server successfully.
+	PushedIP string    `json:"pushed_ip,omitempty"`
+	PushedAt time.Time `json:"pushed_at"`
+
+	// LastSuccess and LastFailure are the times of the last checks which
+	// succeeded and failed. Error is the error of the last check, and is
+	// empty if it succeeded.
+	LastSuccess time.Time `json:"last_success"`
+	LastFailure time.Time `json:"last_failure"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// Failing returns the records for which the last check failed.
+func (s *AgentStatus) Failing() []*RecordStatus {
+	out := []*RecordStatus{}
+	for _, r := range s.Records {
+		if r.Error != "" {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// summary returns a single line describing the status, for systemd.
+func (s *AgentStatus) summary() string {
+	failing := s.Failing()
+	if len(s.Records) == 1 {
+		r := s.Records[0]
+		if r.Error != "" {
+			return fmt.Sprintf("%s: %s", r.Domain, r.Error)
+		}
+		return fmt.Sprintf("%s: %s", r.Domain, r.PushedIP)
+	}
+	return fmt.Sprintf("%d records, %d failing", len(s.Records), len(failing))
+}
+
+// ReadAgentStatus reads a state file written by an [Agent]. See
+// [Agent.StateFile].
+func ReadAgentStatus(path string) (*AgentStatus, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	status := &AgentStatus{}
+	if err := json.Unmarshal(b, status); err != nil {
+		return nil, fmt.Errorf("invalid state file %s: %w", path, err)
+	}
+	return status, nil
+}
+
+// agentStatusStore holds the status of an agent, and of the agents for its
+// jobs, and writes it to the state file.
+type agentStatusStore struct {
+	mu     sync.Mutex
+	path   string
+	status AgentStatus
+
+	// saveMu serializes saves, so an older snapshot is never written over a
+	// newer one.
+	saveMu sync.Mutex
+}
+
+// loadAgentStatus returns a store for the state file at path, which may not
+// exist yet. If path is empty, the status is only kept in memory.
+func loadAgentStatus(path string) (*agentStatusStore, error) {
+	s := &agentStatusStore{path: path}
+	if path == "" {
+		return s, nil
+	}
+	status, err := ReadAgentStatus(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.status = *status
+	return s, nil
+}
+
+// get returns a copy of the status of domain on server.
+func (s *agentStatusStore) get(domain, server string) RecordStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return *s.record(domain, server)
+}
+
+// update calls f with the status of domain on server, to change it.
+func (s *agentStatusStore) update(domain, server string, f func(r *RecordStatus)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f(s.record(domain, server))
+}
+
+// record returns the status of domain on server, adding it if needed. The
+// caller must hold the lock.
+func (s *agentStatusStore) record(domain, server string) *RecordStatus {
+	for _, r := range s.status.Records {
+		if r.Domain == domain && r.Server == server {
+			return r
+		}
+	}
+	r := &RecordStatus{Domain: domain, Server: server}
+	s.status.Records = append(s.status.Records, r)
+	return r
+}
+
+// snapshot returns a copy of the status.
+func (s *agentStatusStore) snapshot() *AgentStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := &AgentStatus{Records: make([]*RecordStatus, len(s.status.Records))}
+	for i, r := range s.status.Records {
+		copied := *r
+		out.Records[i] = &copied
+	}
+	return out
+}
+
+// save writes the status to the state file, if there is one.
+func (s *agentStatusStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+	b, err := json.MarshalIndent(s.snapshot(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := mkdirParent(s.path); err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, b, 0644)
+}
+
+// statusStore returns the status of the agent, loading [Agent.StateFile] on
+// first use.
+func (a *Agent) statusStore() (*agentStatusStore, error) {
+	a.statusMu.Lock()
+	defer a.statusMu.Unlock()
+	if a.status != nil {
+		return a.status, nil
+	}
+	s, err := loadAgentStatus(a.StateFile)
+	if err != nil {
+		return nil, err
+	}
+	a.status = s
+	return s, nil
+}
+
+// setStatus calls f with the status of domain, to change it.
+func (a *Agent) setStatus(domain string, f func(r *RecordStatus)) {
+	s, err := a.statusStore()
+	if err != nil {
+		slog.Warn("failed to load agent state", "error", err.Error())
+		return
+	}
+	s.update(domain, a.getServerAddress(), f)
+}
+
+// Status returns the status of a running agent, from [Agent.StateFile] if it
+// is set, or otherwise from the status endpoint at [Agent.StatusListener].
+func (a *Agent) Status(ctx context.Context) (*AgentStatus, error) {
+	if a.StateFile != "" {
+		return ReadAgentStatus(a.StateFile)
+	}
+	if a.StatusListener == "" {
+		return nil, errors.New("no state file or status listener configured")
+	}
+
+	host, port, err := net.SplitHostPort(a.StatusListener)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+	u := "http://" + net.JoinHostPort(host, port) + "/status"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	// The status is also returned when some records are failing
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusServiceUnavailable {
+		io.Copy(io.Discard, io.LimitReader(res.Body, 4096))
+		return nil, &statusError{method: http.MethodGet, url: u, code: res.StatusCode}
+	}
+	status := &AgentStatus{}
+	if err := json.NewDecoder(res.Body).Decode(status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// ServeStatus serves the status of the agent as JSON on
+// [Agent.StatusListener], until ctx is cancelled. The response has status 503
+// if the last check failed for any record, so it can be used as a health
+// check.
+func (a *Agent) ServeStatus(ctx context.Context) error {
+	ln, err := net.Listen("tcp", a.StatusListener)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: a.statusHandler()}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	if err := server.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (a *Agent) statusHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		s, err := a.statusStore()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		status := s.snapshot()
+		code := http.StatusOK
+		if len(status.Failing()) > 0 {
+			code = http.StatusServiceUnavailable
+		}
+		writeJSON(w, code, status)
+	})
+	return mux
+}
+
+// sdNotify sends state to systemd, if the agent was started by a service
+// with Type=notify. See sd_notify(3).
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogCheckTimeout is how long a check may take before the run loop is
+// considered stuck, in addition to [Agent.VerifyTimeout] if the IP is
+// verified.
+const watchdogCheckTimeout = 2 * time.Minute
+
+// watchdog tracks the progress of each run loop, so that [NotifyWatchdog]
+// stops telling systemd that the agent is alive when one of them is stuck.
+type watchdog struct {
+	mu        sync.Mutex
+	deadlines map[*agentState]time.Time
+}
+
+var agentWatchdog = &watchdog{deadlines: map[*agentState]time.Time{}}
+
+// progress records that the run loop with state made progress, and must make
+// progress again before deadline.
+func (w *watchdog) progress(state *agentState, deadline time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.deadlines[state] = deadline
+}
+
+// stop removes the run loop with state, which returned.
+func (w *watchdog) stop(state *agentState) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.deadlines, state)
+}
+
+// stuck returns true if any run loop missed its deadline.
+func (w *watchdog) stuck() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := time.Now()
+	for _, deadline := range w.deadlines {
+		if now.After(deadline) {
+			return true
+		}
+	}
+	return false
+}
+
+// watchdogInterval returns half of the watchdog interval of the service, which
+// is how often systemd should be told that the agent is alive, or zero if the
+// service does not have WatchdogSec set.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.Atoi(os.Getenv("WATCHDOG_USEC"))
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// NotifyWatchdog tells systemd that the agent is alive at half of the watchdog
+// interval, until ctx is cancelled. Nothing is sent while a run loop of the
+// agent is stuck, so that systemd restarts it. It returns immediately if the
+// service does not have WatchdogSec set.
+func NotifyWatchdog(ctx context.Context) {
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if agentWatchdog.stuck() {
+			slog.Error("agent is not making progress, not notifying systemd watchdog")
+		} else if err := sdNotify("WATCHDOG=1"); err != nil {
+			slog.Warn("failed to notify systemd watchdog", "error", err.Error())
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package ddns
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAgentStateFile(t *testing.T) {
+	status := http.StatusCreated
+	updates := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		updates++
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	newAgent := func() *Agent {
+		return &Agent{
+			ServerAddress: ts.URL,
+			StateFile:     stateFile,
+			Once:          true,
+			Source:        &IPSourceConfig{Type: SourceTypeCommand, Command: "echo 1.1.1.1"},
+		}
+	}
+	if err := newAgent().Run(context.Background(), "home.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ReadAgentStatus(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Records) != 1 {
+		t.Fatalf("expected a single record, got: %+v", got.Records)
+	}
+	r := got.Records[0]
+	if r.Domain != "home.com" || r.Server != ts.URL || r.Source != SourceTypeCommand || r.DetectedIP != "1.1.1.1" || r.PushedIP != "1.1.1.1" || r.LastSuccess.IsZero() || r.Error != "" {
+		t.Fatalf("incorrect status: %+v", r)
+	}
+
+	// A new run continues from the pushed IP, and does not send it again
+	if err := newAgent().Run(context.Background(), "home.com"); err != nil {
+		t.Fatal(err)
+	}
+	if updates != 1 {
+		t.Fatalf("expected a single update, got: %d", updates)
+	}
+
+	// Failures are recorded, without losing the pushed IP
+	status = http.StatusInternalServerError
+	a := newAgent()
+	a.RefreshInterval = time.Nanosecond
+	if err := a.Run(context.Background(), "home.com"); err == nil {
+		t.Fatal("expected the update to fail")
+	}
+	got, err = ReadAgentStatus(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = got.Records[0]
+	if r.PushedIP != "1.1.1.1" || r.LastFailure.IsZero() || !strings.Contains(r.Error, "500") {
+		t.Fatalf("incorrect status after a failure: %+v", r)
+	}
+	if len(got.Failing()) != 1 {
+		t.Fatalf("expected the record to be failing")
+	}
+}
+
+func TestAgentStatusStoreSave(t *testing.T) {
+	s, err := loadAgentStatus(filepath.Join(t.TempDir(), "missing", "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Concurrent saves leave the latest status in the state file
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.update("home.com", fmt.Sprint(i), func(r *RecordStatus) { r.PushedIP = "1.1.1.1" })
+			if err := s.save(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	got, err := ReadAgentStatus(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Records) != 20 {
+		t.Fatalf("expected 20 records, got: %d", len(got.Records))
+	}
+}
+
+func TestAgentStatusEndpoint(t *testing.T) {
+	a := &Agent{ServerAddress: "http://server.com"}
+	a.setStatus("home.com", func(r *RecordStatus) { r.PushedIP = "1.1.1.1" })
+	a.setStatus("work.com", func(r *RecordStatus) { r.Error = "failed" })
+
+	ts := httptest.NewServer(a.statusHandler())
+	defer ts.Close()
+	res, err := http.Get(ts.URL + "/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 while a record is failing, got: %d", res.StatusCode)
+	}
+	got := &AgentStatus{}
+	if err := json.NewDecoder(res.Body).Decode(got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Records) != 2 || got.Records[0].PushedIP != "1.1.1.1" || got.Records[1].Error != "failed" {
+		t.Fatalf("incorrect status: %+v", got.Records)
+	}
+
+	// The status command reads it from the listener
+	client := &Agent{StatusListener: strings.TrimPrefix(ts.URL, "http://")}
+	fetched, err := client.Status(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fetched.Records) != 2 {
+		t.Fatalf("incorrect fetched status: %+v", fetched.Records)
+	}
+}
+
+func TestSdNotify(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Skip("unix sockets are not supported: ", err)
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", socket)
+
+	if err := sdNotify("READY=1"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "READY=1" {
+		t.Fatalf("incorrect message: %s", buf[:n])
+	}
+
+	// Nothing is sent outside of systemd
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := sdNotify("READY=1"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNotifyWatchdog(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Skip("unix sockets are not supported: ", err)
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", socket)
+	t.Setenv("WATCHDOG_USEC", "20000")
+
+	// A run loop which missed its deadline stops the keep-alive messages
+	state := &agentState{}
+	agentWatchdog.progress(state, time.Now().Add(-time.Second))
+	defer agentWatchdog.stop(state)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go NotifyWatchdog(ctx)
+
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := conn.Read(buf); err == nil {
+		t.Fatalf("expected no message while a run loop is stuck, got: %s", buf[:n])
+	}
+
+	agentWatchdog.progress(state, time.Now().Add(time.Minute))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "WATCHDOG=1" {
+		t.Fatalf("incorrect message: %s", buf[:n])
+	}
+}
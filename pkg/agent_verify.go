@@ -0,0 +1,176 @@
+package ddns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultVerifyTimeout is how long [Agent.VerifyIP] waits for the nameservers
+// to serve a new IP by default.
+const DefaultVerifyTimeout = time.Minute
+
+// verifyInterval is how often [Agent.VerifyIP] queries the nameservers which
+// do not serve the new IP yet. It is a variable for tests.
+var verifyInterval = 2 * time.Second
+
+// lookupNS finds the nameservers of a zone. It is a variable for tests.
+var lookupNS = net.DefaultResolver.LookupNS
+
+// PropagationError is returned by [Agent.VerifyIP] when some nameservers did
+// not serve the new IP before the timeout.
+type PropagationError struct {
+	Domain string
+	IP     string
+
+	// Lagging maps each nameserver which did not serve the IP to what it
+	// answered, or the error from the last query.
+	Lagging map[string]string
+}
+
+func (e *PropagationError) Error() string {
+	lagging := []string{}
+	for ns, got := range e.Lagging {
+		lagging = append(lagging, fmt.Sprintf("%s (%s)", ns, got))
+	}
+	sort.Strings(lagging)
+	return fmt.Sprintf("%s does not resolve to %s on: %s", e.Domain, e.IP, strings.Join(lagging, ", "))
+}
+
+// VerifyIP waits until every nameserver for domain serves ip, or returns a
+// [*PropagationError] listing the nameservers which are lagging once
+// [Agent.VerifyTimeout] has passed. The nameservers are
+// [Agent.VerifyNameservers], or the NS records of the closest zone which
+// contains domain.
+func (a *Agent) VerifyIP(ctx context.Context, domain, ip string) error {
+	want := net.ParseIP(ip)
+	if want == nil {
+		return fmt.Errorf("invalid ip: %s", ip)
+	}
+	nameservers, err := a.nameservers(ctx, domain)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, a.getVerifyTimeout())
+	defer cancel()
+
+	qtype := dns.TypeA
+	if want.To4() == nil {
+		qtype = dns.TypeAAAA
+	}
+	lagging := map[string]string{}
+	for _, ns := range nameservers {
+		lagging[ns] = "no answer"
+	}
+	for {
+		pending := []string{}
+		for ns := range lagging {
+			pending = append(pending, ns)
+		}
+		mu := sync.Mutex{}
+		wg := sync.WaitGroup{}
+		for _, ns := range pending {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				got, err := queryNameserver(ctx, ns, domain, qtype)
+				mu.Lock()
+				defer mu.Unlock()
+				switch {
+				case err != nil && ctx.Err() != nil:
+					// Keep the previous answer rather than the timeout
+				case err != nil:
+					lagging[ns] = err.Error()
+				case got.Equal(want):
+					delete(lagging, ns)
+				case got == nil:
+					lagging[ns] = "no answer"
+				default:
+					lagging[ns] = got.String()
+				}
+			}()
+		}
+		wg.Wait()
+		if len(lagging) == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return &PropagationError{Domain: domain, IP: ip, Lagging: lagging}
+		case <-time.After(verifyInterval):
+		}
+	}
+}
+
+// nameservers returns the addresses of the nameservers to verify domain on.
+func (a *Agent) nameservers(ctx context.Context, domain string) ([]string, error) {
+	out := []string{}
+	if len(a.VerifyNameservers) > 0 {
+		for _, ns := range a.VerifyNameservers {
+			if _, _, err := net.SplitHostPort(ns); err != nil {
+				ns = net.JoinHostPort(ns, "53")
+			}
+			out = append(out, ns)
+		}
+		return out, nil
+	}
+
+	// Walk up from the domain to the closest zone which has NS records
+	name := strings.TrimSuffix(domain, ".")
+	for name != "" {
+		records, err := lookupNS(ctx, name)
+		if len(records) > 0 {
+			for _, ns := range records {
+				out = append(out, net.JoinHostPort(strings.TrimSuffix(ns.Host, "."), "53"))
+			}
+			return out, nil
+		}
+		dnsErr := &net.DNSError{}
+		if err != nil && !(errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+			return nil, err
+		}
+		_, name, _ = strings.Cut(name, ".")
+	}
+	return nil, fmt.Errorf("no nameservers found for %s", domain)
+}
+
+// queryNameserver asks ns for the address of domain, without recursion, and
+// returns the first one in the answer.
+func queryNameserver(ctx context.Context, ns, domain string, qtype uint16) (net.IP, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(domain), qtype)
+	m.RecursionDesired = false
+	c := &dns.Client{Timeout: publicSourceTimeout}
+	r, _, err := c.ExchangeContext(ctx, m, ns)
+	if err != nil {
+		return nil, err
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("%s", dns.RcodeToString[r.Rcode])
+	}
+	for _, rr := range r.Answer {
+		switch v := rr.(type) {
+		case *dns.A:
+			return v.A, nil
+		case *dns.AAAA:
+			return v.AAAA, nil
+		}
+	}
+	return nil, nil
+}
+
+func (a *Agent) getVerifyTimeout() time.Duration {
+	if a.VerifyTimeout <= 0 {
+		return DefaultVerifyTimeout
+	}
+	return a.VerifyTimeout
+}
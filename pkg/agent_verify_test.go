@@ -0,0 +1,92 @@
+package ddns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startNameserver starts a DNS server for s on a local port, and returns its
+// address.
+func startNameserver(t *testing.T, s *Server) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{PacketConn: conn, Handler: s.handleDNS()}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+	return conn.LocalAddr().String()
+}
+
+func TestAgentVerifyIP(t *testing.T) {
+	verifyInterval = 5 * time.Millisecond
+	updated := &Server{Store: NewMemoryStore()}
+	updated.Set("home.com", net.ParseIP("2.2.2.2"))
+	lagging := &Server{Store: NewMemoryStore()}
+	lagging.Set("home.com", net.ParseIP("1.1.1.1"))
+	laggingAddr := startNameserver(t, lagging)
+
+	a := &Agent{
+		VerifyNameservers: []string{startNameserver(t, updated), laggingAddr},
+		VerifyTimeout:     50 * time.Millisecond,
+	}
+	err := a.VerifyIP(context.Background(), "home.com", "2.2.2.2")
+	perr := &PropagationError{}
+	if !errors.As(err, &perr) {
+		t.Fatalf("expected a propagation error, got: %v", err)
+	}
+	if len(perr.Lagging) != 1 || perr.Lagging[laggingAddr] != "1.1.1.1" {
+		t.Fatalf("incorrect lagging nameservers: %v", perr.Lagging)
+	}
+
+	// Succeeds once every nameserver catches up
+	a.VerifyTimeout = time.Second
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		lagging.Set("home.com", net.ParseIP("2.2.2.2"))
+	}()
+	if err := a.VerifyIP(context.Background(), "home.com", "2.2.2.2"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAgentNameservers(t *testing.T) {
+	previous := lookupNS
+	defer func() { lookupNS = previous }()
+	lookups := []string{}
+	lookupNS = func(ctx context.Context, name string) ([]*net.NS, error) {
+		lookups = append(lookups, name)
+		if name == "myddns.com" {
+			return []*net.NS{{Host: "ns1.server.com."}, {Host: "ns2.server.com."}}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+
+	got, err := (&Agent{}).nameservers(context.Background(), "home.myddns.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0] != "ns1.server.com:53" || got[1] != "ns2.server.com:53" {
+		t.Fatalf("incorrect nameservers: %v", got)
+	}
+	if len(lookups) != 2 {
+		t.Fatalf("expected the lookup to walk up to the zone, got: %v", lookups)
+	}
+
+	got, err = (&Agent{VerifyNameservers: []string{"192.0.2.1", "192.0.2.2:5353"}}).nameservers(context.Background(), "home.myddns.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0] != "192.0.2.1:53" || got[1] != "192.0.2.2:5353" {
+		t.Fatalf("incorrect configured nameservers: %v", got)
+	}
+
+	if _, err := (&Agent{}).nameservers(context.Background(), "home.example.org"); err == nil {
+		t.Fatalf("expected error when no nameservers are found")
+	}
+}
@@ -0,0 +1,110 @@
+package ddns
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// writeFileAtomic writes data to a temporary file in the same directory as
+// name, syncs it, and renames it over name. A crash at any point leaves either
+// the old or the new contents, never a partial file.
+func writeFileAtomic(name string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(name)
+	f, err := os.CreateTemp(dir, "."+filepath.Base(name)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+
+	// Clean up the temporary file if anything fails before the rename
+	ok := false
+	defer func() {
+		if !ok {
+			f.Close()
+			os.Remove(tmp)
+		}
+	}()
+
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		return err
+	}
+	ok = true
+
+	return syncDir(dir)
+}
+
+// syncDir flushes a directory, so that a rename within it is durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// backupName returns the name of the nth most recent backup of name, starting
+// at 1.
+func backupName(name string, n int) string {
+	return fmt.Sprintf("%s.%d.bak", name, n)
+}
+
+// rotateBackups keeps the current contents of name as its most recent backup,
+// shifting older backups and removing any beyond keep. It must be called
+// before name is replaced.
+func rotateBackups(name string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	if _, err := os.Stat(name); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	if err := os.Remove(backupName(name, keep)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for i := keep - 1; i >= 1; i-- {
+		if err := os.Rename(backupName(name, i), backupName(name, i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	// A hard link is free, and remains valid after name is replaced by a rename
+	if err := os.Link(name, backupName(name, 1)); err == nil {
+		return nil
+	}
+	return copyFile(name, backupName(name, 1))
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	b, err := io.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(dst, b, info.Mode().Perm())
+}
@@ -0,0 +1,318 @@
+package ddns
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultAuditLogFileName is the name of the audit log when
+// [Server.AuditLogFile] is not set. It is stored in the same directory as the
+// hosts file or database.
+const DefaultAuditLogFileName = "audit.jsonl"
+
+// DefaultAuditRetention is how long audit log entries are kept by default.
+const DefaultAuditRetention = 90 * 24 * time.Hour
+
+// auditPruneInterval is how often old entries are removed from the audit log.
+const auditPruneInterval = time.Hour
+
+// The result of a change recorded in the audit log.
+const (
+	AuditResultUpdated   = "updated"   // the record was created or changed
+	AuditResultDeleted   = "deleted"   // the record was deleted
+	AuditResultNotFound  = "not-found" // the record to delete did not exist
+	AuditResultForbidden = "forbidden" // the key is not allowed to make the change
+	AuditResultInvalid   = "invalid"   // the request was invalid
+	AuditResultFailed    = "failed"    // the change could not be saved
+)
+
+// AuditEntry records an attempt to change a record.
+type AuditEntry struct {
+	Time      time.Time `json:"time"`
+	KeyID     string    `json:"key"`
+	CallerIP  string    `json:"caller"`
+	Operation Operation `json:"operation"`
+	Domain    string    `json:"domain"`
+	OldIP     net.IP    `json:"old,omitempty"`
+	NewIP     net.IP    `json:"new,omitempty"`
+	Result    string    `json:"result"`
+}
+
+// AuditFilter selects entries from the audit log. Empty fields match all
+// entries.
+type AuditFilter struct {
+	Domain string
+	KeyID  string
+	Since  time.Time
+	Until  time.Time
+
+	// Limit is the maximum number of entries to return. The newest entries are
+	// kept.
+	Limit int
+}
+
+// Matches returns true if e is selected by the filter.
+func (f *AuditFilter) Matches(e *AuditEntry) bool {
+	return (f.Domain == "" || e.Domain == f.Domain) &&
+		(f.KeyID == "" || e.KeyID == f.KeyID) &&
+		(f.Since.IsZero() || !e.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || e.Time.Before(f.Until))
+}
+
+// AuditLog is an append-only log of changes to records, saved as a file with
+// one JSON object per line.
+type AuditLog struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewAuditLog returns an audit log saved to the file at path, which is created
+// when the first entry is appended.
+func NewAuditLog(path string) *AuditLog {
+	return &AuditLog{path: path}
+}
+
+// Append adds an entry to the end of the log.
+func (a *AuditLog) Append(e AuditEntry) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return appendJSONLine(a.path, e)
+}
+
+// appendJSONLine appends v to the file at p as a line of JSON, creating the
+// file if needed.
+func appendJSONLine(p string, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := mkdirParent(p); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Query returns the entries selected by f, oldest first.
+func (a *AuditLog) Query(f AuditFilter) ([]AuditEntry, error) {
+	out := []AuditEntry{}
+	err := a.scan(func(e *AuditEntry, _ []byte) {
+		if f.Matches(e) {
+			out = append(out, *e)
+		}
+	})
+	if f.Limit > 0 && len(out) > f.Limit {
+		out = out[len(out)-f.Limit:]
+	}
+	return out, err
+}
+
+// Prune removes entries older than retention.
+func (a *AuditLog) Prune(retention time.Duration) error {
+	cutoff := time.Now().Add(-retention)
+	kept := &bytes.Buffer{}
+	pruned := 0
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	err := a.scanLocked(func(e *AuditEntry, line []byte) {
+		if e.Time.Before(cutoff) {
+			pruned++
+			return
+		}
+		kept.Write(line)
+		kept.WriteByte('\n')
+	})
+	if err != nil || pruned == 0 {
+		return err
+	}
+	slog.Info("pruned audit log", "path", a.path, "entries", pruned)
+	return writeFileAtomic(a.path, kept.Bytes(), 0600)
+}
+
+// scan calls fn for each entry in the log. Lines which cannot be parsed are
+// logged and skipped.
+func (a *AuditLog) scan(fn func(e *AuditEntry, line []byte)) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.scanLocked(fn)
+}
+
+// scanLocked is like scan, but the caller must hold the lock.
+func (a *AuditLog) scanLocked(fn func(e *AuditEntry, line []byte)) error {
+	f, err := os.Open(a.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		e := &AuditEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), e); err != nil {
+			slog.Error("skipping invalid audit log entry", "path", a.path, "line", n, "error", err.Error())
+			continue
+		}
+		fn(e, scanner.Bytes())
+	}
+	return scanner.Err()
+}
+
+// History returns the entries in the audit log selected by f.
+func (s *Server) History(f AuditFilter) ([]AuditEntry, error) {
+	a := s.getAuditLog()
+	if a == nil {
+		return []AuditEntry{}, nil
+	}
+	return a.Query(f)
+}
+
+// getAuditLog returns the audit log, or nil if there is nowhere to save it.
+func (s *Server) getAuditLog() *AuditLog {
+	s.auditOnce.Do(func() {
+		if p := s.getAuditLogFile(); p != "" {
+			s.auditLog = NewAuditLog(p)
+		}
+	})
+	return s.auditLog
+}
+
+func (s *Server) getAuditLogFile() string {
+	if s.AuditLogFile != "" {
+		return s.AuditLogFile
+	}
+	if s.HostsFile != "" {
+		return path.Join(path.Dir(s.HostsFile), DefaultAuditLogFileName)
+	}
+	if s.StorePath != "" {
+		return path.Join(path.Dir(s.StorePath), DefaultAuditLogFileName)
+	}
+	return ""
+}
+
+func (s *Server) getAuditRetention() time.Duration {
+	if s.AuditRetention == 0 {
+		return DefaultAuditRetention
+	}
+	return s.AuditRetention
+}
+
+// audit records an attempt by key to change the record for domain.
+func (s *Server) audit(r *http.Request, key *APIKey, op Operation, domain string, oldIP, newIP net.IP, result string) {
+	a := s.getAuditLog()
+	if a == nil {
+		return
+	}
+	caller := r.RemoteAddr
+	if ip, err := s.getCallerIP(r); err == nil {
+		caller = ip.String()
+	}
+	e := AuditEntry{
+		Time:      time.Now().UTC(),
+		KeyID:     key.ID,
+		CallerIP:  caller,
+		Operation: op,
+		Domain:    domain,
+		OldIP:     oldIP,
+		NewIP:     newIP,
+		Result:    result,
+	}
+	if err := a.Append(e); err != nil {
+		slog.Error("failed to write audit log", "error", err.Error())
+	}
+}
+
+// pruneAuditLog removes old entries from the audit log periodically, until ctx
+// is done.
+func (s *Server) pruneAuditLog(ctx context.Context) {
+	a := s.getAuditLog()
+	if a == nil || s.AuditRetention < 0 {
+		return
+	}
+	ticker := time.NewTicker(auditPruneInterval)
+	defer ticker.Stop()
+	for {
+		if err := a.Prune(s.getAuditRetention()); err != nil {
+			slog.Error("failed to prune audit log", "error", err.Error())
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// handleHistory returns the entries in the audit log for the domains which the
+// key may read.
+func (s *Server) handleHistory() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := s.authorize(w, r, OperationRead)
+		if key == nil {
+			return
+		}
+
+		q := r.URL.Query()
+		f := AuditFilter{Domain: q.Get("domain"), KeyID: q.Get("key")}
+		var err error
+		if v := q.Get("since"); v != "" {
+			if f.Since, err = time.Parse(time.RFC3339, v); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		if v := q.Get("until"); v != "" {
+			if f.Until, err = time.Parse(time.RFC3339, v); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+
+		entries, err := s.History(f)
+		if err != nil {
+			slog.Error("failed to read audit log", "error", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		out := []AuditEntry{}
+		for _, e := range entries {
+			if key.allowsName(e.Domain) {
+				out = append(out, e)
+			}
+		}
+
+		// Apply the limit after filtering, so the newest visible entries are kept
+		if v := q.Get("limit"); v != "" {
+			limit, err := strconv.Atoi(v)
+			if err != nil || limit < 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if limit > 0 && len(out) > limit {
+				out = out[len(out)-limit:]
+			}
+		}
+		writeJSON(w, http.StatusOK, out)
+	}
+}
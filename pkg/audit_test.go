@@ -0,0 +1,169 @@
+package ddns
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAuditHistory(t *testing.T) {
+	s := &Server{
+		HostsFile: filepath.Join(t.TempDir(), "hosts.yaml"),
+		AllowedAPIKeys: APIKeyMatcher{
+			"homekey": regexp.MustCompile(`^home\.com$`),
+			"workkey": regexp.MustCompile(`^work\.com$`),
+		},
+	}
+	ts := httptest.NewServer(s.handler())
+	defer ts.Close()
+	home := &Agent{ServerAddress: ts.URL, APIKey: "homekey"}
+	work := &Agent{ServerAddress: ts.URL, APIKey: "workkey"}
+
+	home.UpdateIP(context.Background(), "home.com", "1.1.1.1")
+	home.UpdateIP(context.Background(), "home.com", "1.1.1.1") // unchanged, not recorded
+	home.UpdateIP(context.Background(), "home.com", "2.2.2.2")
+	home.UpdateIP(context.Background(), "work.com", "3.3.3.3") // forbidden
+	work.UpdateIP(context.Background(), "work.com", "4.4.4.4")
+
+	entries, err := s.History(AuditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		domain, old, new, result string
+	}{
+		{"home.com", "<nil>", "1.1.1.1", AuditResultUpdated},
+		{"home.com", "1.1.1.1", "2.2.2.2", AuditResultUpdated},
+		{"work.com", "<nil>", "<nil>", AuditResultForbidden},
+		{"work.com", "<nil>", "4.4.4.4", AuditResultUpdated},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("expected %d entries, got: %+v", len(expected), entries)
+	}
+	for i, e := range expected {
+		got := entries[i]
+		if got.Domain != e.domain || got.OldIP.String() != e.old || got.NewIP.String() != e.new || got.Result != e.result {
+			t.Fatalf("incorrect entry %d, got: %+v, expected: %+v", i, got, e)
+		}
+		if got.KeyID == "" || got.CallerIP != "127.0.0.1" {
+			t.Fatalf("entry %d is missing the key or caller: %+v", i, got)
+		}
+	}
+
+	// Keys only see the history of domains they are allowed to read
+	got, err := work.History(context.Background(), AuditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Domain != "work.com" || got[1].Domain != "work.com" {
+		t.Fatalf("incorrect history for key, got: %+v", got)
+	}
+	got, err = home.History(context.Background(), AuditFilter{Domain: "home.com", Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || !got[0].NewIP.Equal(net.ParseIP("2.2.2.2")) {
+		t.Fatalf("incorrect limited history, got: %+v", got)
+	}
+	got, err = home.History(context.Background(), AuditFilter{Since: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Fatalf("expected no entries in the future, got: %+v", got)
+	}
+}
+
+func TestAuditFailedUpdate(t *testing.T) {
+	// The hosts file can not be written, since its parent is a file
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	hookCalls := atomic.Int32{}
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hookCalls.Add(1)
+	}))
+	defer hook.Close()
+	s := &Server{
+		HostsFile:      filepath.Join(dir, "file", "hosts.yaml"),
+		AuditLogFile:   filepath.Join(dir, "audit.jsonl"),
+		AllowedAPIKeys: APIKeyMatcher{"mykey": nil},
+		Webhooks:       []*Webhook{{URL: hook.URL}},
+	}
+	ts := httptest.NewServer(s.handler())
+	defer ts.Close()
+	a := &Agent{ServerAddress: ts.URL, APIKey: "mykey"}
+
+	if _, err := a.UpdateIP(context.Background(), "home.com", "1.1.1.1"); err == nil || !strings.Contains(err.Error(), "500") {
+		t.Fatalf("expected the update to fail, got: %v", err)
+	}
+	entries, err := s.History(AuditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Result != AuditResultFailed {
+		t.Fatalf("expected a failed entry, got: %+v", entries)
+	}
+	s.webhookWG.Wait()
+	if n := hookCalls.Load(); n != 0 {
+		t.Fatalf("expected no webhooks for a failed update, got: %d", n)
+	}
+}
+
+func TestAuditLogPrune(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "audit.jsonl")
+	a := NewAuditLog(p)
+	a.Append(AuditEntry{Time: time.Now().Add(-48 * time.Hour), Domain: "old.com"})
+	a.Append(AuditEntry{Time: time.Now(), Domain: "new.com"})
+
+	// Invalid lines are skipped
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("{not json\n")
+	f.Close()
+
+	if err := a.Prune(24 * time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := a.Query(AuditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Domain != "new.com" {
+		t.Fatalf("incorrect entries after pruning, got: %+v", entries)
+	}
+}
+
+func TestServerPruneAuditLog(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "audit.jsonl")
+	s := &Server{AuditLogFile: p, AuditRetention: 24 * time.Hour}
+	s.getAuditLog().Append(AuditEntry{Time: time.Now().Add(-48 * time.Hour), Domain: "old.com"})
+
+	// The log is pruned straight away, and pruning stops with ctx
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.pruneAuditLog(ctx)
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("pruning did not stop")
+	}
+	if entries, _ := s.getAuditLog().Query(AuditFilter{}); len(entries) != 0 {
+		t.Fatalf("expected the old entry to be pruned, got: %+v", entries)
+	}
+}
@@ -0,0 +1,281 @@
+package ddns
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// eventHistorySize is the number of recent events kept so that clients can
+// resume the event stream after reconnecting.
+const eventHistorySize = 1000
+
+// eventKeepAlive is how often a comment is sent on an idle event stream, so
+// that proxies do not close the connection.
+const eventKeepAlive = 30 * time.Second
+
+// The type of an [Event].
+const (
+	EventCreated = "created" // a record was created
+	EventUpdated = "updated" // the IP of a record was changed
+	EventDeleted = "deleted" // a record was deleted
+
+	// EventReset is sent to a resuming client when events have been missed,
+	// for example because the server was restarted. The client should fetch
+	// all records again.
+	EventReset = "reset"
+)
+
+// Event describes a change to a record, as sent by the /api/v2/events
+// endpoint.
+type Event struct {
+	ID     string    `json:"id"`
+	Type   string    `json:"type"`
+	Domain string    `json:"domain,omitempty"`
+	IP     net.IP    `json:"ip,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// eventHub turns changes in the store into events, and keeps a history of
+// recent events so that clients can resume.
+type eventHub struct {
+	// epoch identifies this process, so that IDs from before a restart are not
+	// mistaken for current ones
+	epoch string
+
+	mu      sync.Mutex
+	seq     uint64
+	history []Event
+	subs    map[chan Event]struct{}
+}
+
+// getEvents returns the event hub, starting it if needed.
+func (s *Server) getEvents() *eventHub {
+	s.eventsOnce.Do(func() {
+		h := &eventHub{
+			epoch: strconv.FormatInt(time.Now().UnixNano(), 36),
+			subs:  map[chan Event]struct{}{},
+		}
+		st, err := s.getStore()
+		if err != nil {
+			slog.Error("failed to open store, no events will be sent", "error", err.Error())
+		} else {
+			go h.run(st)
+		}
+		s.events = h
+	})
+	return s.events
+}
+
+// run publishes an event for each change to a record in st. It does not
+// return.
+func (h *eventHub) run(st Store) {
+	var known Domains
+	for {
+		// Watch before listing, so that no change is missed in between. Changes
+		// which are already in the list are ignored below.
+		changes := st.Watch(context.Background())
+		current, err := st.List()
+		switch {
+		case err != nil:
+			slog.Error("failed to list records, events may be incorrect", "error", err.Error())
+			if known == nil {
+				known = Domains{}
+			}
+		case known == nil:
+			known = current
+		default:
+			h.resync(known, current)
+		}
+
+		for c := range changes {
+			h.apply(known, c.Domain, c.IP)
+		}
+
+		// The store closes the channel if the hub falls behind
+		slog.Warn("missed changes to records, listing them again")
+	}
+}
+
+// resync publishes events for the differences between known and current, after
+// changes were missed.
+func (h *eventHub) resync(known, current Domains) {
+	domains := []string{}
+	for d := range known {
+		if _, ok := current[d]; !ok {
+			domains = append(domains, d)
+		}
+	}
+	for d := range current {
+		domains = append(domains, d)
+	}
+	sort.Strings(domains)
+	for _, d := range domains {
+		h.apply(known, d, current[d])
+	}
+}
+
+// apply updates known with the IP of domain, which is nil if it was deleted,
+// and publishes an event if it changed.
+func (h *eventHub) apply(known Domains, domain string, ip net.IP) {
+	old, exists := known[domain]
+	e := Event{Domain: domain, IP: ip, Time: time.Now().UTC()}
+	switch {
+	case ip == nil && !exists:
+		return
+	case ip == nil:
+		e.Type = EventDeleted
+		delete(known, domain)
+	case !exists:
+		e.Type = EventCreated
+		known[domain] = ip
+	case old.Equal(ip):
+		return
+	default:
+		e.Type = EventUpdated
+		known[domain] = ip
+	}
+	h.publish(e)
+}
+
+func (h *eventHub) publish(e Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.seq++
+	e.ID = fmt.Sprintf("%s-%d", h.epoch, h.seq)
+	h.history = append(h.history, e)
+	if len(h.history) > eventHistorySize {
+		h.history = h.history[len(h.history)-eventHistorySize:]
+	}
+
+	for ch := range h.subs {
+		select {
+		case ch <- e:
+		default:
+			// Disconnect subscribers which do not keep up, so that they resume
+			// from the last event they received instead of missing events
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe returns a channel which receives new events, along with the
+// events after lastID which are still in the history. If the events after
+// lastID are no longer available, a reset event is returned first.
+func (h *eventHub) subscribe(lastID string) (<-chan Event, []Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ch := make(chan Event, 64)
+	h.subs[ch] = struct{}{}
+
+	if lastID == "" {
+		return ch, nil
+	}
+	epoch, seqStr, _ := strings.Cut(lastID, "-")
+	seq, err := strconv.ParseUint(seqStr, 10, 64)
+	// The reset event carries the latest ID, so the client resumes from here
+	reset := Event{ID: fmt.Sprintf("%s-%d", h.epoch, h.seq), Type: EventReset, Time: time.Now().UTC()}
+	if epoch != h.epoch || err != nil || seq > h.seq {
+		return ch, []Event{reset}
+	}
+
+	// IDs in the history are consecutive, ending with h.seq
+	first := h.seq - uint64(len(h.history)) + 1
+	if seq+1 < first {
+		return ch, []Event{reset}
+	}
+	return ch, append([]Event{}, h.history[seq+1-first:]...)
+}
+
+func (h *eventHub) unsubscribe(ch <-chan Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sub := range h.subs {
+		if sub == ch {
+			delete(h.subs, sub)
+			close(sub)
+		}
+	}
+}
+
+// handleEvents streams events for the domains which the key may read, as
+// Server-Sent Events. Clients resume by sending the Last-Event-ID header. The
+// stream ends when the key is changed, disabled, deleted or expires.
+func (s *Server) handleEvents() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := s.authorize(w, r, OperationRead)
+		if key == nil {
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		lastID := r.Header.Get("Last-Event-ID")
+		if lastID == "" {
+			lastID = r.URL.Query().Get("lastEventId")
+		}
+		h := s.getEvents()
+		ch, backlog := h.subscribe(lastID)
+		defer h.unsubscribe(ch)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		send := func(e Event) bool {
+			if e.Type != EventReset && !key.allowsName(e.Domain) {
+				return true
+			}
+			b, err := json.Marshal(e)
+			if err != nil {
+				return false
+			}
+			if _, err := fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", e.ID, e.Type, b); err != nil {
+				return false
+			}
+			flusher.Flush()
+			return true
+		}
+
+		for _, e := range backlog {
+			if !send(e) {
+				return
+			}
+		}
+
+		keepAlive := time.NewTicker(eventKeepAlive)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case e, ok := <-ch:
+				if !ok || !s.stillAllowed(token, key) || !send(e) {
+					return
+				}
+			case <-keepAlive.C:
+				if !s.stillAllowed(token, key) {
+					return
+				}
+				if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+					return
+				}
+				flusher.Flush()
+			}
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package ddns
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEvents(t *testing.T) {
+	s := &Server{
+		Store: NewMemoryStore(),
+		AllowedAPIKeys: APIKeyMatcher{
+			"adminkey": nil,
+			"homekey":  regexp.MustCompile(`^home\.com$`),
+		},
+	}
+	s.getEvents()
+	ts := httptest.NewServer(s.handler())
+	defer ts.Close()
+
+	// Reads events from the stream until n have been received
+	stream := func(apiKey, lastID string, n int) []Event {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/api/v2/events", nil)
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+		if lastID != "" {
+			req.Header.Set("Last-Event-ID", lastID)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status code: %d", res.StatusCode)
+		}
+
+		out := []Event{}
+		scanner := bufio.NewScanner(res.Body)
+		for len(out) < n && scanner.Scan() {
+			data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+			if !ok {
+				continue
+			}
+			e := Event{}
+			if err := json.Unmarshal([]byte(data), &e); err != nil {
+				t.Fatal(err)
+			}
+			out = append(out, e)
+		}
+		if len(out) < n {
+			t.Fatalf("expected %d events, got: %+v", n, out)
+		}
+		return out
+	}
+
+	update := func(domain, ip string) {
+		a := &Agent{ServerAddress: ts.URL, APIKey: "adminkey"}
+		if _, err := a.UpdateIP(context.Background(), domain, ip); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	done := make(chan []Event)
+	go func() { done <- stream("homekey", "", 2) }()
+	time.Sleep(100 * time.Millisecond)
+	update("work.com", "1.1.1.1") // filtered out for homekey
+	update("home.com", "1.1.1.1")
+	update("home.com", "2.2.2.2")
+	events := <-done
+
+	if events[0].Type != EventCreated || events[0].Domain != "home.com" || events[0].IP.String() != "1.1.1.1" {
+		t.Fatalf("incorrect first event: %+v", events[0])
+	}
+	if events[1].Type != EventUpdated || events[1].IP.String() != "2.2.2.2" {
+		t.Fatalf("incorrect second event: %+v", events[1])
+	}
+
+	// A reconnecting client receives the events it missed
+	s.Delete("home.com")
+	resumed := stream("homekey", events[0].ID, 2)
+	if resumed[0].ID != events[1].ID || resumed[1].Type != EventDeleted {
+		t.Fatalf("incorrect resumed events: %+v", resumed)
+	}
+
+	// An ID from another process cannot be resumed
+	reset := stream("homekey", "otherepoch-1", 1)
+	if reset[0].Type != EventReset || reset[0].ID != resumed[1].ID {
+		t.Fatalf("expected reset event, got: %+v", reset[0])
+	}
+}
+
+func TestEventsKeyDisabled(t *testing.T) {
+	key, token, err := GenerateAPIKey("events", nil, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Store: NewMemoryStore(), APIKeys: []*APIKey{key}}
+	s.getEvents()
+	ts := httptest.NewServer(s.handler())
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/api/v2/events", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", res.StatusCode)
+	}
+
+	// Keys are replaced rather than modified
+	disabled := *key
+	disabled.Disabled = true
+	s.configMu.Lock()
+	s.APIKeys = []*APIKey{&disabled}
+	s.configMu.Unlock()
+	if err := s.Set("home.com", net.ParseIP("1.1.1.1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The stream ends without sending the event
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "data:") {
+		t.Fatalf("expected no events for a disabled key, got: %s", b)
+	}
+}
+
+func TestEventHubResync(t *testing.T) {
+	h := &eventHub{epoch: "test", subs: map[chan Event]struct{}{}}
+	ch, _ := h.subscribe("")
+
+	known := Domains{"a.com": net.ParseIP("1.1.1.1"), "b.com": net.ParseIP("2.2.2.2")}
+	current := Domains{"b.com": net.ParseIP("3.3.3.3"), "c.com": net.ParseIP("4.4.4.4")}
+	h.resync(known, current)
+
+	expected := []Event{
+		{Type: EventDeleted, Domain: "a.com"},
+		{Type: EventUpdated, Domain: "b.com"},
+		{Type: EventCreated, Domain: "c.com"},
+	}
+	for _, want := range expected {
+		if e := <-ch; e.Type != want.Type || e.Domain != want.Domain {
+			t.Fatalf("expected %s event for %s, got: %+v", want.Type, want.Domain, e)
+		}
+	}
+	if len(known) != 2 || !known["b.com"].Equal(current["b.com"]) || !known["c.com"].Equal(current["c.com"]) {
+		t.Fatalf("expected known records to match the store, got: %v", known)
+	}
+}
@@ -0,0 +1,184 @@
+package ddns
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// apiKeySeparator separates the key ID from the secret in an API key token.
+const apiKeySeparator = "."
+
+// APIKey is an API key which is allowed by the server. Only a salted hash of
+// the secret is stored, so the config does not need to be kept secret. The
+// token presented by clients has the form "<ID>.<secret>".
+type APIKey struct {
+	// ID is a non-secret identifier for the key. It is used to find the key
+	// when validating a token, and to refer to the key in logs.
+	ID string
+
+	// Label is a human readable description of the key.
+	Label string `yaml:"label,omitempty"`
+
+	// Hash is the bcrypt hash of the secret.
+	Hash string
+
+	// Created is when the key was generated.
+	Created time.Time `yaml:"created,omitempty"`
+
+	// Expires is when the key stops being valid. A zero value never expires.
+	Expires time.Time `yaml:"expires,omitempty"`
+
+	// Disabled keys are not allowed by the server.
+	Disabled bool `yaml:"disabled,omitempty"`
+
+	// Admin keys may manage other API keys using the admin API. It is a
+	// shorthand for allowing [OperationManageKeys] in the policy.
+	Admin bool `yaml:"admin,omitempty"`
+
+	// Domains must match the incoming domain in order for the API key to be
+	// authorized to change the DNS record for that domain. A nil matcher allows
+	// changing the DNS record for any domain (no restrictions). It is a
+	// shorthand which applies in addition to [Policy.Names] and [Policy.Zones].
+	Domains *regexp.Regexp `yaml:"domains,omitempty"`
+
+	// Policy restricts what the key is allowed to do. If nil, the key may read
+	// and update any record, subject to the shorthands above.
+	Policy *Policy `yaml:"policy,omitempty"`
+
+	// managed is set for keys created using the admin API, which are saved to
+	// the keys file. Keys from the config can only be changed there.
+	managed bool
+}
+
+// GenerateAPIKey creates a new API key with a random ID and secret. The
+// returned token is the only copy of the secret, and should be given to the
+// client.
+func GenerateAPIKey(label string, domains *regexp.Regexp, expires time.Time) (*APIKey, string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, "", err
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+
+	key := &APIKey{
+		ID:      hex.EncodeToString(id),
+		Label:   label,
+		Created: time.Now().UTC().Truncate(time.Second),
+		Expires: expires,
+		Domains: domains,
+	}
+	secretStr := base64.RawURLEncoding.EncodeToString(secret)
+	if err := key.SetSecret(secretStr); err != nil {
+		return nil, "", err
+	}
+	return key, key.ID + apiKeySeparator + secretStr, nil
+}
+
+// SetSecret replaces [APIKey.Hash] with a hash of secret.
+func (k *APIKey) SetSecret(secret string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	k.Hash = string(hash)
+	return nil
+}
+
+// Active returns true if the key is enabled and has not expired.
+func (k *APIKey) Active() bool {
+	return !k.Disabled && (k.Expires.IsZero() || time.Now().Before(k.Expires))
+}
+
+// verify checks secret against the stored hash in constant time.
+func (k *APIKey) verify(secret string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(k.Hash), []byte(secret)) == nil
+}
+
+// authenticate returns the API key matching the bearer token, or nil if the
+// token is not allowed. Keys in [Server.APIKeys] are checked first, followed by
+// the plaintext keys in [Server.AllowedAPIKeys].
+func (s *Server) authenticate(token string) *APIKey {
+	if token == "" {
+		return nil
+	}
+
+	if id, secret, ok := strings.Cut(token, apiKeySeparator); ok {
+		// Keys are never modified in place, so it is safe to verify the secret
+		// (which is slow) without holding the lock
+		s.configMu.RLock()
+		i := slices.IndexFunc(s.APIKeys, func(k *APIKey) bool { return k.ID == id })
+		var key *APIKey
+		if i != -1 {
+			key = s.APIKeys[i]
+		}
+		s.configMu.RUnlock()
+		if key != nil {
+			if key.Active() && key.verify(secret) {
+				return key
+			}
+			return nil
+		}
+	}
+
+	// Compare hashes so the comparison does not leak the length of the keys,
+	// and check every key so it does not leak which one matched.
+	tokenSum := sha256.Sum256([]byte(token))
+	var match *APIKey
+	s.configMu.RLock()
+	defer s.configMu.RUnlock()
+	for k, matcher := range s.AllowedAPIKeys {
+		keySum := sha256.Sum256([]byte(k))
+		if subtle.ConstantTimeCompare(tokenSum[:], keySum[:]) == 1 {
+			match = &APIKey{ID: plaintextKeyID(k), Domains: matcher}
+		}
+	}
+	return match
+}
+
+// stillAllowed returns true if key, which was returned by
+// [Server.authenticate()] for token, is still allowed with the same
+// permissions. It is checked by long-lived requests, which end when the key is
+// changed, disabled, deleted or expires.
+func (s *Server) stillAllowed(token string, key *APIKey) bool {
+	// Keys are replaced rather than modified, so an unchanged key is the same
+	// pointer
+	s.configMu.RLock()
+	found := slices.Contains(s.APIKeys, key)
+	s.configMu.RUnlock()
+	if found {
+		return key.Active()
+	}
+
+	// Plaintext keys are created by each call, and are cheap to check again
+	match := s.authenticate(token)
+	return match != nil && match.ID == key.ID && match.Hash == "" &&
+		regexpString(match.Domains) == regexpString(key.Domains)
+}
+
+// regexpString returns the expression of r, or an empty string if r is nil.
+func regexpString(r *regexp.Regexp) string {
+	if r == nil {
+		return ""
+	}
+	return r.String()
+}
+
+// plaintextKeyID derives a stable, non-secret ID for a key from
+// [Server.AllowedAPIKeys], so it can be referenced in logs.
+func plaintextKeyID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return fmt.Sprintf("plaintext-%x", sum[:4])
+}
@@ -0,0 +1,53 @@
+package ddns
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestServerAuthenticate(t *testing.T) {
+	active, activeToken, err := GenerateAPIKey("active", regexp.MustCompile(`^home\.com$`), time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	disabled, disabledToken, err := GenerateAPIKey("disabled", nil, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	disabled.Disabled = true
+	expired, expiredToken, err := GenerateAPIKey("expired", nil, time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := Server{
+		APIKeys:        []*APIKey{active, disabled, expired},
+		AllowedAPIKeys: APIKeyMatcher{"plaintextkey": nil},
+	}
+
+	if got := s.authenticate(activeToken); got != active {
+		t.Fatalf("active key was not authenticated")
+	}
+	for name, token := range map[string]string{
+		"empty":          "",
+		"disabled":       disabledToken,
+		"expired":        expiredToken,
+		"wrong secret":   active.ID + ".wrongsecret",
+		"unknown id":     "unknown.secret",
+		"secret only":    activeToken[len(active.ID)+1:],
+		"plaintext typo": "plaintextkeyy",
+	} {
+		if got := s.authenticate(token); got != nil {
+			t.Fatalf("%s token should not be authenticated, got key: %s", name, got.ID)
+		}
+	}
+
+	got := s.authenticate("plaintextkey")
+	if got == nil {
+		t.Fatalf("plaintext key was not authenticated")
+	}
+	if got.ID != plaintextKeyID("plaintextkey") {
+		t.Fatalf(`incorrect ID for plaintext key, got: "%s"`, got.ID)
+	}
+}
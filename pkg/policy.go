@@ -0,0 +1,212 @@
+package ddns
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Operation is an action which an API key may be allowed to perform.
+type Operation string
+
+const (
+	OperationRead       Operation = "read"        // read records
+	OperationUpdate     Operation = "update"      // create and update records
+	OperationDelete     Operation = "delete"      // delete records
+	OperationManageKeys Operation = "manage-keys" // use the admin API
+)
+
+// DefaultOperations are allowed when [Policy.Operations] is empty.
+var DefaultOperations = []Operation{OperationRead, OperationUpdate}
+
+// Policy restricts what an API key is allowed to do. Empty fields place no
+// restriction, except for [Policy.Operations].
+type Policy struct {
+	// Operations are the actions the key may perform. If empty,
+	// [DefaultOperations] are allowed.
+	Operations []Operation `json:"operations,omitempty"`
+
+	// RecordTypes are the DNS record types the key may change, such as "A",
+	// "AAAA" or "TXT".
+	RecordTypes []string `json:"recordtypes,omitempty"`
+
+	// Names and Zones restrict the domains the key may access. A domain is
+	// allowed if it matches any regex in Names, or if it is equal to or a
+	// subdomain of any zone in Zones.
+	Names []*regexp.Regexp `json:"names,omitempty"`
+	Zones []string         `json:"zones,omitempty"`
+
+	// Addresses are the ranges that the key may point a record at.
+	Addresses []AddressRange `json:"addresses,omitempty"`
+
+	// Sources are the networks that requests using the key must come from.
+	Sources []netip.Prefix `json:"sources,omitempty"`
+}
+
+// AddressRange is a range of IP addresses. It is either a CIDR, "public" for
+// any globally routable unicast address, or "private" for any RFC 1918 or RFC
+// 4193 address.
+type AddressRange string
+
+// sharedAddressSpace is the RFC 6598 carrier-grade NAT range, which is not
+// public even though it is globally unique.
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// UnmarshalText validates the range when decoding.
+func (r *AddressRange) UnmarshalText(b []byte) error {
+	v := AddressRange(b)
+	if _, err := v.prefix(); err != nil {
+		return err
+	}
+	*r = v
+	return nil
+}
+
+func (r AddressRange) prefix() (netip.Prefix, error) {
+	switch r {
+	case "public", "private":
+		return netip.Prefix{}, nil
+	}
+	p, err := netip.ParsePrefix(string(r))
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf(`address range must be a CIDR, "public" or "private": %s`, r)
+	}
+	return p, nil
+}
+
+// Contains returns true if ip is within the range.
+func (r AddressRange) Contains(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	switch r {
+	case "public":
+		return ip.IsGlobalUnicast() && !ip.IsPrivate() && !sharedAddressSpace.Contains(ip)
+	case "private":
+		return ip.IsPrivate()
+	}
+	p, err := r.prefix()
+	return err == nil && p.Contains(ip)
+}
+
+// AllowsOperation returns true if the policy allows op.
+func (p *Policy) AllowsOperation(op Operation) bool {
+	if len(p.Operations) == 0 {
+		return slices.Contains(DefaultOperations, op)
+	}
+	return slices.Contains(p.Operations, op)
+}
+
+// AllowsRecordType returns true if the policy allows changing records of type
+// t.
+func (p *Policy) AllowsRecordType(t string) bool {
+	if len(p.RecordTypes) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(p.RecordTypes, func(v string) bool {
+		return strings.EqualFold(v, t)
+	})
+}
+
+// AllowsName returns true if the policy allows accessing the domain.
+func (p *Policy) AllowsName(domain string) bool {
+	if len(p.Names) == 0 && len(p.Zones) == 0 {
+		return true
+	}
+	for _, r := range p.Names {
+		if r.MatchString(domain) {
+			return true
+		}
+	}
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	for _, z := range p.Zones {
+		z = strings.ToLower(strings.Trim(z, "."))
+		if domain == z || strings.HasSuffix(domain, "."+z) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsAddress returns true if the policy allows pointing a record at ip.
+func (p *Policy) AllowsAddress(ip netip.Addr) bool {
+	if len(p.Addresses) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(p.Addresses, func(r AddressRange) bool {
+		return r.Contains(ip)
+	})
+}
+
+// AllowsSource returns true if the policy allows requests from ip.
+func (p *Policy) AllowsSource(ip netip.Addr) bool {
+	if len(p.Sources) == 0 {
+		return true
+	}
+	ip = ip.Unmap()
+	return slices.ContainsFunc(p.Sources, func(n netip.Prefix) bool {
+		return n.Contains(ip)
+	})
+}
+
+// policy returns the policy of the key, which is empty if not set.
+func (k *APIKey) policy() *Policy {
+	if k.Policy == nil {
+		return &Policy{}
+	}
+	return k.Policy
+}
+
+// allowsOperation returns true if the key may perform op. The [APIKey.Admin]
+// shorthand allows [OperationManageKeys].
+func (k *APIKey) allowsOperation(op Operation) bool {
+	if op == OperationManageKeys && k.Admin {
+		return true
+	}
+	return k.policy().AllowsOperation(op)
+}
+
+// allowsName returns true if both the [APIKey.Domains] shorthand and the
+// policy allow accessing the domain.
+func (k *APIKey) allowsName(domain string) bool {
+	if k.Domains != nil && !k.Domains.MatchString(domain) {
+		return false
+	}
+	return k.policy().AllowsName(domain)
+}
+
+// authorize authenticates the request, and checks that its API key may
+// perform op from the IP of the caller. If not, an error status is written and
+// nil is returned.
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request, op Operation) *APIKey {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	key := s.authenticate(token)
+	if key == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil
+	}
+
+	if !key.allowsOperation(op) {
+		slog.Info("key is not allowed to perform operation", "key", key.ID, "operation", op)
+		w.WriteHeader(http.StatusForbidden)
+		return nil
+	}
+
+	if p := key.policy(); len(p.Sources) > 0 {
+		callerIP, err := s.getCallerIP(r)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return nil
+		}
+		ip, _ := netip.AddrFromSlice(callerIP)
+		if !p.AllowsSource(ip) {
+			slog.Info("key is not allowed to be used from caller ip", "key", key.ID, "ip", callerIP)
+			w.WriteHeader(http.StatusForbidden)
+			return nil
+		}
+	}
+
+	return key
+}
@@ -0,0 +1,121 @@
+package ddns
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"regexp"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestPolicyYAML(t *testing.T) {
+	b := []byte(`
+operations: [read, update]
+recordtypes: [AAAA]
+names: ['^home\.']
+zones: [example.com]
+addresses: [public, 10.0.0.0/8]
+sources: [192.168.0.0/16]
+`)
+	p := &Policy{}
+	if err := yaml.Unmarshal(b, p); err != nil {
+		t.Fatal(err)
+	}
+
+	if !p.AllowsOperation(OperationUpdate) || p.AllowsOperation(OperationDelete) {
+		t.Fatalf("incorrect operations: %v", p.Operations)
+	}
+	if !p.AllowsRecordType("aaaa") || p.AllowsRecordType("A") {
+		t.Fatalf("incorrect record types: %v", p.RecordTypes)
+	}
+
+	names := map[string]bool{
+		"home.other.com":       true,
+		"example.com":          true,
+		"sub.example.com":      true,
+		"notexample.com":       false,
+		"example.com.evil.com": false,
+	}
+	for name, expected := range names {
+		if got := p.AllowsName(name); got != expected {
+			t.Fatalf(`incorrect result for AllowsName("%s"), got: %t, expected: %t`, name, got, expected)
+		}
+	}
+
+	addresses := map[string]bool{
+		"1.2.3.4":        true,
+		"10.1.2.3":       true,
+		"192.168.1.1":    false,
+		"100.64.0.1":     false,
+		"2001:db8::1":    true,
+		"fd00::1":        false,
+		"::ffff:1.2.3.4": true,
+	}
+	for ip, expected := range addresses {
+		if got := p.AllowsAddress(netip.MustParseAddr(ip)); got != expected {
+			t.Fatalf(`incorrect result for AllowsAddress("%s"), got: %t, expected: %t`, ip, got, expected)
+		}
+	}
+
+	if !p.AllowsSource(netip.MustParseAddr("192.168.5.5")) || p.AllowsSource(netip.MustParseAddr("1.2.3.4")) {
+		t.Fatalf("incorrect sources: %v", p.Sources)
+	}
+
+	if err := yaml.Unmarshal([]byte(`addresses: [somewhere]`), &Policy{}); err == nil {
+		t.Fatalf("expected error for invalid address range")
+	}
+}
+
+func TestServerHandleUpdateIPPolicy(t *testing.T) {
+	key, token, err := GenerateAPIKey("", regexp.MustCompile(`\.com$`), time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key.Policy = &Policy{
+		RecordTypes: []string{"A"},
+		Zones:       []string{"home.com", "other.org"},
+		Addresses:   []AddressRange{"10.0.0.0/8"},
+		Sources:     []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")},
+	}
+	s := &Server{APIKeys: []*APIKey{key}}
+	h := s.handler()
+
+	tests := []struct {
+		name       string
+		query      string
+		remoteAddr string
+		expected   int
+	}{
+		{"allowed", "domain=a.home.com&ip=10.1.1.1", "192.0.2.1:1234", http.StatusCreated},
+		{"unchanged", "domain=a.home.com&ip=10.1.1.1", "192.0.2.1:1234", http.StatusOK},
+		{"zone not allowed", "domain=a.away.com&ip=10.1.1.1", "192.0.2.1:1234", http.StatusForbidden},
+		{"shorthand not matched", "domain=a.other.org&ip=10.1.1.1", "192.0.2.1:1234", http.StatusForbidden},
+		{"address not allowed", "domain=a.home.com&ip=1.2.3.4", "192.0.2.1:1234", http.StatusForbidden},
+		{"record type not allowed", "domain=a.home.com&ip=2001:db8::1", "192.0.2.1:1234", http.StatusForbidden},
+		{"source not allowed", "domain=a.home.com&ip=10.1.1.2", "198.51.100.1:1234", http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/update?"+test.query, nil)
+		r.RemoteAddr = test.remoteAddr
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != test.expected {
+			t.Fatalf("%s: incorrect status code, got: %d, expected: %d", test.name, w.Code, test.expected)
+		}
+	}
+
+	// The default operations do not include delete
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/delete?domain=a.home.com", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("delete: incorrect status code, got: %d, expected: %d", w.Code, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,267 @@
+package ddns
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyHeaderTimeout is how long a trusted proxy has to send the PROXY
+// protocol header after connecting.
+const proxyHeaderTimeout = 5 * time.Second
+
+// proxyV2Signature is the fixed prefix of a PROXY protocol v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// isTrustedProxy returns true if ip is within [Server.TrustedProxies].
+func (s *Server) isTrustedProxy(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	s.configMu.RLock()
+	defer s.configMu.RUnlock()
+	for _, p := range s.TrustedProxies {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// getCallerIP determines the IP of the client making the request. Forwarding
+// headers are only used when the direct peer is a trusted proxy, in which case
+// the right-most untrusted hop is the caller.
+func (s *Server) getCallerIP(r *http.Request) (net.IP, error) {
+	peer, err := parseHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	if !s.isTrustedProxy(peer) {
+		return net.IP(peer.AsSlice()), nil
+	}
+
+	// Use X-Real-Ip header if available
+	if v := r.Header.Get("X-Real-Ip"); v != "" {
+		ip, err := parseHostPort(v)
+		if err != nil {
+			return nil, err
+		}
+		return net.IP(ip.AsSlice()), nil
+	}
+
+	// Otherwise walk the Forwarded or X-Forwarded-For hops, right to left
+	hops := forwardedHops(r.Header)
+	if len(hops) == 0 {
+		hops = xForwardedForHops(r.Header)
+	}
+	caller := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		if isHiddenNode(hops[i]) {
+			// The proxy does not know or reveal its client, so the last
+			// trusted hop is as close to the caller as we can get
+			break
+		}
+		ip, err := parseHostPort(hops[i])
+		if err != nil {
+			return nil, err
+		}
+		caller = ip
+		if !s.isTrustedProxy(ip) {
+			break
+		}
+	}
+
+	return net.IP(caller.AsSlice()), nil
+}
+
+// forwardedHops returns the "for" parameters of an RFC 7239 Forwarded header,
+// in order.
+func forwardedHops(h http.Header) []string {
+	hops := []string{}
+	for _, v := range h.Values("Forwarded") {
+		for _, element := range strings.Split(v, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(k, "for") {
+					hops = append(hops, strings.Trim(v, `"`))
+				}
+			}
+		}
+	}
+	return hops
+}
+
+// isHiddenNode returns true if node is an RFC 7239 node which does not
+// reveal an IP, either "unknown" or an obfuscated identifier such as
+// "_hidden", optionally with a port.
+func isHiddenNode(node string) bool {
+	name, _, _ := strings.Cut(node, ":")
+	return strings.EqualFold(name, "unknown") || strings.HasPrefix(name, "_")
+}
+
+// xForwardedForHops returns the addresses in the X-Forwarded-For header, in
+// order.
+func xForwardedForHops(h http.Header) []string {
+	hops := []string{}
+	for _, v := range h.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(v, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	return hops
+}
+
+// parseHostPort parses an IP which may be bracketed and may include a port,
+// such as "1.2.3.4", "1.2.3.4:80", "[::1]" or "[::1]:80".
+func parseHostPort(s string) (netip.Addr, error) {
+	s = strings.TrimSpace(s)
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return ap.Addr().Unmap(), nil
+	}
+	ip, err := netip.ParseAddr(strings.Trim(s, "[]"))
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("not a valid ip: %s", s)
+	}
+	return ip.Unmap(), nil
+}
+
+// proxyProtoListener wraps a listener to accept the PROXY protocol (v1 and v2)
+// from trusted proxies. Connections from any other peer are returned as-is.
+type proxyProtoListener struct {
+	net.Listener
+	trusted func(netip.Addr) bool
+}
+
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	peer, err := parseHostPort(c.RemoteAddr().String())
+	if err != nil || !l.trusted(peer) {
+		return c, nil
+	}
+	return &proxyProtoConn{Conn: c, r: bufio.NewReader(c)}, nil
+}
+
+// proxyProtoConn reads the PROXY protocol header lazily, so that a slow proxy
+// does not block the accept loop.
+type proxyProtoConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	once       sync.Once
+	err        error
+	remoteAddr net.Addr
+}
+
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtoConn) readHeader() {
+	c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+	c.remoteAddr, c.err = readProxyHeader(c.r)
+	if c.err != nil {
+		c.Conn.Close()
+	}
+}
+
+// readProxyHeader consumes a PROXY protocol v1 or v2 header from r, if one is
+// present, and returns the source address it contains. A nil address is
+// returned if there is no header or if it does not carry an address.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	if b, _ := r.Peek(len(proxyV2Signature)); bytes.Equal(b, proxyV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+	if b, _ := r.Peek(6); string(b) == "PROXY " {
+		return readProxyHeaderV1(r)
+	}
+	return nil, nil
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	// The v1 header is at most 107 bytes, including the CRLF
+	line := make([]byte, 0, 107)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == cap(line) {
+			return nil, fmt.Errorf("proxy protocol: v1 header too long")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("proxy protocol: %w", err)
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("proxy protocol: invalid v1 header: %q", line)
+	}
+	ap, err := netip.ParseAddrPort(net.JoinHostPort(fields[2], fields[4]))
+	if err != nil {
+		return nil, fmt.Errorf("proxy protocol: invalid v1 source address: %w", err)
+	}
+	return net.TCPAddrFromAddrPort(ap), nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("proxy protocol: %w", err)
+	}
+	verCmd, family := header[12], header[13]
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("proxy protocol: %w", err)
+	}
+
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("proxy protocol: unsupported version: %d", verCmd>>4)
+	}
+	if verCmd&0xf == 0 {
+		// LOCAL command, such as a health check from the proxy itself
+		return nil, nil
+	}
+
+	var ipLen int
+	switch family >> 4 {
+	case 1: // AF_INET
+		ipLen = 4
+	case 2: // AF_INET6
+		ipLen = 16
+	default:
+		return nil, nil
+	}
+	if len(payload) < 2*ipLen+4 {
+		return nil, fmt.Errorf("proxy protocol: v2 address block too short")
+	}
+	ip, _ := netip.AddrFromSlice(payload[:ipLen])
+	port := binary.BigEndian.Uint16(payload[2*ipLen:])
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip.Unmap(), port)), nil
+}
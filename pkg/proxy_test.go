@@ -0,0 +1,172 @@
+package ddns
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/netip"
+	"testing"
+)
+
+func TestServerGetCallerIP(t *testing.T) {
+	s := Server{
+		TrustedProxies: []netip.Prefix{
+			netip.MustParsePrefix("10.0.0.0/8"),
+			netip.MustParsePrefix("fd00::/8"),
+		},
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		expected   string
+	}{
+		{
+			name:       "untrusted peer without headers",
+			remoteAddr: "1.2.3.4:5678",
+			expected:   "1.2.3.4",
+		},
+		{
+			name:       "untrusted peer headers are ignored",
+			remoteAddr: "1.2.3.4:5678",
+			headers: map[string]string{
+				"X-Real-Ip":       "6.6.6.6",
+				"X-Forwarded-For": "6.6.6.6",
+				"Forwarded":       "for=6.6.6.6",
+			},
+			expected: "1.2.3.4",
+		},
+		{
+			name:       "untrusted ipv6 peer",
+			remoteAddr: "[2001:db8::1]:5678",
+			expected:   "2001:db8::1",
+		},
+		{
+			name:       "trusted peer with X-Real-Ip",
+			remoteAddr: "10.0.0.1:5678",
+			headers:    map[string]string{"X-Real-Ip": "1.2.3.4"},
+			expected:   "1.2.3.4",
+		},
+		{
+			name:       "trusted peer with multi-hop X-Forwarded-For",
+			remoteAddr: "10.0.0.1:5678",
+			headers:    map[string]string{"X-Forwarded-For": "6.6.6.6, 1.2.3.4, 10.0.0.2"},
+			expected:   "1.2.3.4",
+		},
+		{
+			name:       "trusted peer with only trusted hops",
+			remoteAddr: "10.0.0.1:5678",
+			headers:    map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.2"},
+			expected:   "10.0.0.3",
+		},
+		{
+			name:       "trusted peer with Forwarded",
+			remoteAddr: "[fd00::1]:5678",
+			headers:    map[string]string{"Forwarded": `for=6.6.6.6, for="[2001:db8::2]:4711";proto=https, for=10.0.0.2;by=10.0.0.1`},
+			expected:   "2001:db8::2",
+		},
+		{
+			name:       "trusted peer with Forwarded for=unknown",
+			remoteAddr: "10.0.0.1:5678",
+			headers:    map[string]string{"Forwarded": "for=6.6.6.6, for=unknown, for=10.0.0.2"},
+			expected:   "10.0.0.2",
+		},
+		{
+			name:       "trusted peer with an obfuscated Forwarded identifier",
+			remoteAddr: "10.0.0.1:5678",
+			headers:    map[string]string{"Forwarded": `for="_hidden:_port"`},
+			expected:   "10.0.0.1",
+		},
+		{
+			name:       "trusted peer without headers",
+			remoteAddr: "10.0.0.1:5678",
+			expected:   "10.0.0.1",
+		},
+	}
+
+	for _, test := range tests {
+		r, _ := http.NewRequest(http.MethodGet, "/api/v1/ip", nil)
+		r.RemoteAddr = test.remoteAddr
+		for k, v := range test.headers {
+			r.Header.Set(k, v)
+		}
+		got, err := s.getCallerIP(r)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if !got.Equal(net.ParseIP(test.expected)) {
+			t.Fatalf(`%s: incorrect caller ip, got: "%s", expected: "%s"`, test.name, got, test.expected)
+		}
+	}
+
+	r, _ := http.NewRequest(http.MethodGet, "/api/v1/ip", nil)
+	r.RemoteAddr = "10.0.0.1:5678"
+	r.Header.Set("X-Forwarded-For", "notanip")
+	if _, err := s.getCallerIP(r); err == nil {
+		t.Fatalf("expected error for invalid X-Forwarded-For hop")
+	}
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := func(family byte, addrs []byte) []byte {
+		b := append([]byte{}, proxyV2Signature...)
+		b = append(b, 0x21, family)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(addrs)))
+		return append(b, addrs...)
+	}
+
+	tests := []struct {
+		name     string
+		header   []byte
+		expected string
+	}{
+		{
+			name:     "v1 tcp4",
+			header:   []byte("PROXY TCP4 1.2.3.4 10.0.0.1 5678 3345\r\n"),
+			expected: "1.2.3.4:5678",
+		},
+		{
+			name:     "v1 tcp6",
+			header:   []byte("PROXY TCP6 2001:db8::1 fd00::1 5678 3345\r\n"),
+			expected: "[2001:db8::1]:5678",
+		},
+		{
+			name:     "v1 unknown",
+			header:   []byte("PROXY UNKNOWN\r\n"),
+			expected: "",
+		},
+		{
+			name:     "v2 tcp4",
+			header:   v2(0x11, []byte{1, 2, 3, 4, 10, 0, 0, 1, 0x16, 0x2e, 0x0d, 0x11}),
+			expected: "1.2.3.4:5678",
+		},
+		{
+			name:     "no header",
+			header:   []byte{},
+			expected: "",
+		},
+	}
+
+	for _, test := range tests {
+		body := "GET / HTTP/1.1\r\n"
+		r := bufio.NewReader(bytes.NewReader(append(test.header, body...)))
+		addr, err := readProxyHeader(r)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		got := ""
+		if addr != nil {
+			got = addr.String()
+		}
+		if got != test.expected {
+			t.Fatalf(`%s: incorrect source address, got: "%s", expected: "%s"`, test.name, got, test.expected)
+		}
+		rest, _ := r.ReadString('\n')
+		if rest != body {
+			t.Fatalf(`%s: header was not fully consumed, got: "%s"`, test.name, rest)
+		}
+	}
+}
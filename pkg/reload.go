@@ -0,0 +1,100 @@
+package ddns
+
+import (
+	"fmt"
+	"log/slog"
+	"reflect"
+)
+
+// Reload applies the settings from next, which is typically a freshly parsed
+// copy of the config, to the running server. API keys, domain matchers,
+// trusted proxies, webhooks and the zone are swapped in atomically. Domains in
+// next which are not yet in the store are added, as in [Server.Load()].
+//
+// Settings which only take effect when the server starts, such as the
+// listeners, are not changed. Their names are returned if they differ, so that
+// the caller can report that a restart is required.
+func (s *Server) Reload(next *Server) (restartRequired []string, err error) {
+	s.configMu.Lock()
+	// Keys created using the admin API are kept, as in Server.Load(). If the
+	// keys file could not be loaded before, it is read again.
+	managed := managedKeys(s.APIKeys)
+	if s.keysFileErr != nil {
+		keys, err := s.readKeysFile()
+		if err != nil {
+			s.configMu.Unlock()
+			return nil, fmt.Errorf("failed to load keys file: %w", err)
+		}
+		managed, s.keysFileErr = keys, nil
+	}
+	s.APIKeys = mergeKeys(next.APIKeys, managed)
+	s.AllowedAPIKeys = next.AllowedAPIKeys
+	s.TrustedProxies = next.TrustedProxies
+	s.Webhooks = next.Webhooks
+	s.Zone = next.Zone
+	s.configMu.Unlock()
+
+	st, err := s.getStore()
+	if err != nil {
+		return nil, err
+	}
+	for domain, ip := range next.Domains {
+		existing, err := st.Get(domain)
+		if err != nil {
+			return nil, err
+		}
+		if existing == nil {
+			if err := st.Put(domain, ip); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	changed := func(name string, a, b any) {
+		if !reflect.DeepEqual(a, b) {
+			restartRequired = append(restartRequired, name)
+		}
+	}
+	changed("HTTPListener", s.HTTPListener, next.HTTPListener)
+	changed("DNSListener", s.DNSListener, next.DNSListener)
+	changed("StoreType", s.StoreType, next.StoreType)
+	changed("StorePath", s.StorePath, next.StorePath)
+	changed("HostsFile", s.HostsFile, next.HostsFile)
+	changed("HostsFileBackups", s.HostsFileBackups, next.HostsFileBackups)
+	changed("KeysFile", s.KeysFile, next.KeysFile)
+	changed("TLSCertFile", s.TLSCertFile, next.TLSCertFile)
+	changed("TLSKeyFile", s.TLSKeyFile, next.TLSKeyFile)
+	changed("ACME", s.ACME, next.ACME)
+	changed("ProxyProtocol", s.ProxyProtocol, next.ProxyProtocol)
+	changed("AuditLogFile", s.AuditLogFile, next.AuditLogFile)
+	changed("AuditRetention", s.AuditRetention, next.AuditRetention)
+	changed("WebhookDeadLetterFile", s.WebhookDeadLetterFile, next.WebhookDeadLetterFile)
+
+	return restartRequired, nil
+}
+
+// ReloadHostsFile replaces the records in the store with the contents of the
+// hosts file. It does nothing unless the store is a [YAMLStore], or if the
+// hosts file has not changed since the store last wrote or read it, so that
+// the store's own writes can be ignored.
+func (s *Server) ReloadHostsFile() error {
+	st, err := s.getStore()
+	if err != nil {
+		return err
+	}
+	y, ok := st.(*YAMLStore)
+	if !ok {
+		return nil
+	}
+	changed, err := y.reload()
+	if err != nil {
+		return fmt.Errorf("failed to reload hosts file: %w", err)
+	}
+	if !changed {
+		// Such as after the store's own writes
+		slog.Debug("hosts file is unchanged, not reloading", "path", y.path)
+		return nil
+	}
+	slog.Info("reloaded hosts file", "path", y.path)
+	return nil
+}
@@ -0,0 +1,78 @@
+package ddns
+
+import (
+	"net"
+	"net/netip"
+	"regexp"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestServerReload(t *testing.T) {
+	s := &Server{
+		HTTPListener:   ":3345",
+		AllowedAPIKeys: APIKeyMatcher{"old": nil},
+		Store:          NewMemoryStore(),
+	}
+	s.Set("existing.com", net.ParseIP("1.1.1.1"))
+
+	next := &Server{
+		HTTPListener:   ":8080",
+		AllowedAPIKeys: APIKeyMatcher{"new": regexp.MustCompile(`^new\.com$`)},
+		TrustedProxies: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+		Zone:           &ZoneConfig{Origin: "home.com"},
+		Domains: Domains{
+			"existing.com": net.ParseIP("2.2.2.2"),
+			"new.com":      net.ParseIP("3.3.3.3"),
+		},
+	}
+	restartRequired, err := s.Reload(next)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(restartRequired, []string{"HTTPListener"}) {
+		t.Fatalf("incorrect settings requiring restart: %v", restartRequired)
+	}
+	if s.HTTPListener != ":3345" {
+		t.Fatalf("listener should not change without a restart")
+	}
+	if s.authenticate("old") != nil {
+		t.Fatalf("old key should be removed")
+	}
+	if s.authenticate("new") == nil {
+		t.Fatalf("new key should be allowed")
+	}
+	if !s.isTrustedProxy(netip.MustParseAddr("10.1.2.3")) {
+		t.Fatalf("trusted proxies should be updated")
+	}
+	if s.Zone == nil || s.Zone.Origin != "home.com" {
+		t.Fatalf("zone should be updated, got: %+v", s.Zone)
+	}
+	if got := s.Get("existing.com"); !got.Equal(net.ParseIP("1.1.1.1")) {
+		t.Fatalf(`existing record should not be overwritten, got: "%s"`, got)
+	}
+	if got := s.Get("new.com"); !got.Equal(net.ParseIP("3.3.3.3")) {
+		t.Fatalf(`new domain should be added, got: "%s"`, got)
+	}
+}
+
+func TestServerReloadKeepsManagedKeys(t *testing.T) {
+	managed, token, err := GenerateAPIKey("", nil, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	managed.managed = true
+	s := &Server{
+		APIKeys: []*APIKey{{ID: "fromconfig"}, managed},
+		Store:   NewMemoryStore(),
+	}
+
+	if _, err := s.Reload(&Server{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.APIKeys) != 1 || s.authenticate(token) == nil {
+		t.Fatalf("expected only the managed key to be kept, got: %+v", s.APIKeys)
+	}
+}
@@ -1,19 +1,21 @@
 package ddns
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"log/slog"
 	"net"
 	"net/http"
-	"os"
-	"path"
+	"net/netip"
 	"regexp"
+	"slices"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/miekg/dns"
-	"gopkg.in/yaml.v3"
 )
 
 const (
@@ -21,6 +23,11 @@ const (
 	DefaultHTTPListener = ":3345"
 )
 
+// shutdownTimeout is how long to wait for requests and webhook deliveries in
+// progress when the server stops. It is longer than [webhookTimeout], so that
+// the last attempt of each delivery can finish.
+const shutdownTimeout = 15 * time.Second
+
 // APIKeyMatcher is a map of API keys that will be allowed by the server
 // when provided as a bearer token in the authorization header. The value
 // associated with each API key is a [*regexp.Regexp] matcher that must match
@@ -34,8 +41,18 @@ type APIKeyMatcher map[string]*regexp.Regexp
 type Domains map[string]net.IP
 
 type Server struct {
-	// AllowedAPIKeys contains the API keys allowed by the server and their
-	// permissions.
+	// APIKeys contains the hashed API keys allowed by the server and their
+	// permissions. See [GenerateAPIKey].
+	APIKeys []*APIKey
+
+	// KeysFile is the path to the keys file, where keys created using the
+	// admin API are saved. They are added to [Server.APIKeys] when
+	// [Server.Load()] is called. If not set, [DefaultKeysFileName] in the same
+	// directory as [Server.HostsFile] or [Server.StorePath] is used.
+	KeysFile string
+
+	// AllowedAPIKeys contains plaintext API keys allowed by the server and their
+	// permissions. Prefer [Server.APIKeys], which does not store the secret.
 	AllowedAPIKeys APIKeyMatcher
 
 	// HTTPListener is the TCP address that will be passed to
@@ -46,15 +63,111 @@ type Server struct {
 	// [dns.Server]. If not set, [DefaultDNSListener] will be used.
 	DNSListener string
 
-	// Domains stores the domain/IP associations for the server.
+	// Domains contains initial domain/IP associations for the server. They are
+	// added to the store when [Server.Load()] is called, unless the store
+	// already has a record for the domain.
 	Domains Domains
 
-	// HostsFile is the path to the hosts file. If set, [Server.Domains] will be
-	// prepopulated with the values from the hosts file when [Server.Load()] is
-	// called. In addition, any time [Server.Set()] is called, the value of
-	// [Server.Domains] will be marshaled to YAML and saved to the hosts file.
-	// An empty value disables the hosts file completely.
+	// Store persists the domain/IP associations for the server. If nil, it is
+	// opened using [Server.StoreType] when first needed.
+	Store Store `yaml:"-"`
+
+	// StoreType is the type of store to open when [Server.Store] is nil. It is
+	// one of the StoreType constants. If not set, [StoreTypeYAML] is used if
+	// [Server.HostsFile] is set, and [StoreTypeMemory] otherwise.
+	StoreType string
+
+	// StorePath is the path to the database used by the [StoreTypeSQLite] and
+	// [StoreTypeBolt] store types.
+	StorePath string
+
+	// HostsFile is the path to the hosts file used by the [StoreTypeYAML] store
+	// type. If set, the store will be prepopulated with the values from the
+	// hosts file when [Server.Load()] is called. In addition, any time
+	// [Server.Set()] is called, all records will be marshaled to YAML and saved
+	// to the hosts file.
 	HostsFile string
+
+	// HostsFileBackups is the number of previous versions of the hosts file to
+	// keep. See [YAMLStore.Backups].
+	HostsFileBackups int
+
+	// TLSCertFile and TLSKeyFile are paths to a PEM encoded certificate and
+	// private key. If both are set, the HTTP API will be served over TLS. The
+	// files are reloaded automatically when they change on disk.
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// ACME, if set, enables automatic certificates for the HTTP API. It takes
+	// precedence over [Server.TLSCertFile] and [Server.TLSKeyFile].
+	ACME *ACMEConfig
+
+	// TrustedProxies lists the networks of reverse proxies whose forwarding
+	// headers (X-Real-Ip, Forwarded and X-Forwarded-For) are honoured when
+	// determining the IP of a caller. Headers from any other peer are ignored.
+	TrustedProxies []netip.Prefix
+
+	// ProxyProtocol enables the PROXY protocol (v1 and v2) on the HTTP listener
+	// for connections from [Server.TrustedProxies].
+	ProxyProtocol bool
+
+	// Zone, if set, describes the zone served by the server. See [ExportZone].
+	Zone *ZoneConfig
+
+	// AuditLogFile is the path to the audit log, where changes to records made
+	// using the API are recorded. If not set, [DefaultAuditLogFileName] in the
+	// same directory as [Server.HostsFile] or [Server.StorePath] is used. If
+	// there is neither, changes are not recorded.
+	AuditLogFile string
+
+	// AuditRetention is how long entries are kept in the audit log. If zero,
+	// [DefaultAuditRetention] is used. A negative value keeps entries forever.
+	AuditRetention time.Duration
+
+	// Webhooks are called after each change to a record made using the API.
+	Webhooks []*Webhook
+
+	// WebhookDeadLetterFile is the path to the log of webhook deliveries which
+	// failed every attempt. If not set, [DefaultWebhookDeadLetterFileName] in
+	// the same directory as [Server.HostsFile] or [Server.StorePath] is used.
+	WebhookDeadLetterFile string
+
+	// storeMu guards opening [Server.Store].
+	storeMu sync.Mutex
+
+	// configMu guards [Server.APIKeys], [Server.AllowedAPIKeys],
+	// [Server.TrustedProxies], [Server.Webhooks] and [Server.Zone], which can
+	// change at runtime using the admin API or [Server.Reload()].
+	configMu sync.RWMutex
+
+	// keysSaveMu serializes writes to the keys file. See [Server.saveKeys()].
+	keysSaveMu sync.Mutex
+
+	// keysFileErr is set when the keys file could not be loaded, so that it is
+	// not overwritten with only the keys created since. Guarded by configMu.
+	keysFileErr error
+
+	// auditLog is opened when first needed. See [Server.getAuditLog()].
+	auditLog  *AuditLog
+	auditOnce sync.Once
+
+	// webhookWG tracks webhook deliveries in progress, and deadLetterMu
+	// serializes writes to the dead letter log. webhookCtx is cancelled when
+	// the server stops. See [Server.getWebhookCtx()].
+	webhookWG     sync.WaitGroup
+	deadLetterMu  sync.Mutex
+	webhookCtx    context.Context
+	webhookCancel context.CancelFunc
+	webhookOnce   sync.Once
+
+	// events is started when first needed. See [Server.getEvents()].
+	events     *eventHub
+	eventsOnce sync.Once
+
+	// challenges holds the values of pending ACME DNS-01 challenge records,
+	// which are served as TXT records by the DNS server.
+	challenges  map[string][]string
+	challengeMu sync.RWMutex
 }
 
 // Allow is a convenience function for adding API keys which are allowed to
@@ -64,124 +177,251 @@ type Server struct {
 // restrictions). If the apiKey already exists in [Server.AllowedAPIKeys], its
 // matcher will be overwritten with domainMatcher.
 func (s *Server) Allow(apiKey string, domainMatcher *regexp.Regexp) {
+	s.configMu.Lock()
+	defer s.configMu.Unlock()
 	if s.AllowedAPIKeys == nil {
 		s.AllowedAPIKeys = APIKeyMatcher{}
 	}
 	s.AllowedAPIKeys[apiKey] = domainMatcher
 }
 
+// Get returns the IP for the provided domain, or nil if there is no record.
+func (s *Server) Get(domain string) net.IP {
+	st, err := s.getStore()
+	if err != nil {
+		slog.Error("failed to open store", "error", err.Error())
+		return nil
+	}
+	ip, err := st.Get(domain)
+	if err != nil {
+		slog.Error("failed to get record from store", "domain", domain, "error", err.Error())
+	}
+	return ip
+}
+
 // Set updates the DNS record for the provided domain.
-func (s *Server) Set(domain string, ip net.IP) {
-	if s.Domains == nil {
-		s.Domains = map[string]net.IP{}
+func (s *Server) Set(domain string, ip net.IP) error {
+	st, err := s.getStore()
+	if err != nil {
+		return fmt.Errorf("failed to open store: %w", err)
 	}
-	s.Domains[domain] = ip
+	if err := st.Put(domain, ip); err != nil {
+		return fmt.Errorf("failed to save record to store: %w", err)
+	}
+	return nil
+}
 
-	if s.HostsFile != "" {
-		if err := s.writeToHostsFile(); err != nil {
-			slog.Error("failed to write to hosts file", "path", s.HostsFile, "error", err.Error())
-		}
+// Delete removes the DNS record for the provided domain.
+func (s *Server) Delete(domain string) error {
+	st, err := s.getStore()
+	if err != nil {
+		return fmt.Errorf("failed to open store: %w", err)
 	}
+	if err := st.Delete(domain); err != nil {
+		return fmt.Errorf("failed to delete record from store: %w", err)
+	}
+	return nil
 }
 
-// Load updates the values in [s.Domains] using the hosts file if it exists.
+// Load opens the store and loads the hosts file into it (if it exists), then
+// adds any [Server.Domains] which are missing from the store. It also adds the
+// keys from the keys file to [Server.APIKeys], if it exists. The records are
+// loaded even if the keys file can not be.
 func (s *Server) Load() error {
-	if s.HostsFile == "" {
-		return nil
+	keysErr := s.loadKeys()
+	if keysErr != nil {
+		keysErr = fmt.Errorf("failed to load keys file: %w", keysErr)
 	}
+	return errors.Join(keysErr, s.loadRecords())
+}
 
-	if _, err := os.Stat(s.HostsFile); errors.Is(err, os.ErrNotExist) {
-		slog.Info("hosts file does not exist", "path", s.HostsFile)
-		return nil
+// loadRecords opens the store and loads the hosts file and [Server.Domains]
+// into it, see [Server.Load()].
+func (s *Server) loadRecords() error {
+	st, err := s.getStore()
+	if err != nil {
+		return err
+	}
+
+	if y, ok := st.(*YAMLStore); ok {
+		if err := y.Load(); err != nil {
+			return err
+		}
+	}
+
+	for domain, ip := range s.Domains {
+		existing, err := st.Get(domain)
+		if err != nil {
+			return err
+		}
+		if existing == nil {
+			if err := st.Put(domain, ip); err != nil {
+				return err
+			}
+		}
 	}
 
-	return s.loadFromHostsFile()
+	return nil
 }
 
 // Listen starts a DNS server and an HTTP server for the API, and blocks until
 // either of them exits.
 func (s *Server) Listen() error {
-	// If any exits, end the program
-	wg := sync.WaitGroup{}
-	wg.Add(1)
+	return s.ListenContext(context.Background())
+}
+
+// ListenContext is like [Server.Listen], but also stops when ctx is done. The
+// servers are then shut down gracefully, and webhook deliveries in progress
+// are finished or written to the dead letter log, waiting at most
+// [shutdownTimeout].
+func (s *Server) ListenContext(ctx context.Context) error {
+	// If either exits, stop the other
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errs := make(chan error, 2)
+
+	go s.pruneAuditLog(ctx)
 
-	var out error
+	// Start recording events now, so that clients can resume the event stream
+	s.getEvents()
 
 	go func() {
 		l := s.getHTTPListener()
 		slog.Info("starting HTTP server", "listener", l)
-		if err := s.listenHTTP(l); err != nil {
-			out = err
-		}
-		wg.Done()
+		errs <- s.listenHTTP(ctx, l)
 	}()
 
 	go func() {
 		l := s.getDNSListener()
 		slog.Info("starting DNS server", "listener", l)
-		if err := s.listenDNS(l); err != nil {
-			out = err
-		}
-		wg.Done()
+		errs <- s.listenDNS(ctx, l)
 	}()
 
-	wg.Wait()
-	return out
+	err := <-errs
+	cancel()
+	err = errors.Join(err, <-errs)
+
+	slog.Info("waiting for webhook deliveries")
+	shutdownCtx, stop := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer stop()
+	return errors.Join(err, s.stopWebhooks(shutdownCtx))
 }
 
-func (s *Server) loadFromHostsFile() error {
-	domains := Domains{}
+// getStore returns [Server.Store], opening it first if needed.
+func (s *Server) getStore() (Store, error) {
+	s.storeMu.Lock()
+	defer s.storeMu.Unlock()
+	if s.Store != nil {
+		return s.Store, nil
+	}
 
-	b, err := os.ReadFile(s.HostsFile)
-	if err != nil {
-		return err
+	storeType := s.StoreType
+	if storeType == "" {
+		storeType = StoreTypeMemory
+		if s.HostsFile != "" {
+			storeType = StoreTypeYAML
+		}
 	}
 
-	if err := yaml.Unmarshal(b, &domains); err != nil {
-		return err
+	p := s.StorePath
+	if storeType == StoreTypeYAML {
+		p = s.HostsFile
+	}
+	if p == "" && storeType != StoreTypeMemory {
+		return nil, fmt.Errorf("no path configured for %s store", storeType)
 	}
 
-	if s.Domains == nil {
-		s.Domains = Domains{}
+	st, err := OpenStore(storeType, p)
+	if err != nil {
+		return nil, err
 	}
-	for k, v := range domains {
-		s.Domains[k] = v
+	if y, ok := st.(*YAMLStore); ok {
+		y.Backups = s.HostsFileBackups
 	}
-	slog.Info("loaded domains from hosts file", "path", s.HostsFile)
-	return nil
+	s.Store = st
+	return st, nil
+}
+
+// handler returns the HTTP handler for the API.
+func (s *Server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/ip", s.handleGetIP())
+	mux.HandleFunc("POST /api/v1/update", s.handleUpdateIP())
+	mux.HandleFunc("POST /api/v1/delete", s.handleDeleteRecord())
+	mux.HandleFunc("GET /api/v1/records", s.handleListRecords())
+	mux.HandleFunc("GET /api/v1/history", s.handleHistory())
+	mux.HandleFunc("GET /api/v2/events", s.handleEvents())
+	mux.HandleFunc("GET /api/v1/keys", s.handleListKeys())
+	mux.HandleFunc("POST /api/v1/keys", s.handleCreateKey())
+	mux.HandleFunc("PATCH /api/v1/keys/{id}", s.handleUpdateKey())
+	mux.HandleFunc("DELETE /api/v1/keys/{id}", s.handleDeleteKey())
+	return mux
 }
 
-func (s *Server) writeToHostsFile() error {
-	b, err := yaml.Marshal(s.Domains)
+func (s *Server) listenHTTP(ctx context.Context, listener string) error {
+	tlsConfig, err := s.tlsConfig(ctx)
 	if err != nil {
 		return err
 	}
 
-	// Try to create parent directories if needed
-	hostsDir := path.Dir(s.HostsFile)
-	if _, err := os.Stat(hostsDir); errors.Is(err, os.ErrNotExist) {
-		slog.Info("creating directory for hosts file", "path", hostsDir)
-		if err := os.MkdirAll(hostsDir, 0755); err != nil {
-			return err
-		}
-	}
-
-	if err := os.WriteFile(s.HostsFile, b, 0644); err != nil {
+	ln, err := net.Listen("tcp", listener)
+	if err != nil {
 		return err
 	}
+	if s.ProxyProtocol {
+		ln = &proxyProtoListener{Listener: ln, trusted: s.isTrustedProxy}
+	}
 
-	return nil
+	httpServer := &http.Server{Handler: s.handler(), TLSConfig: tlsConfig}
+	stopped := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		stopped <- httpServer.Shutdown(shutdownCtx)
+	}()
+
+	if tlsConfig == nil {
+		err = httpServer.Serve(ln)
+	} else {
+		err = httpServer.ServeTLS(ln, "", "")
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return <-stopped
+	}
+	return err
 }
 
-func (s *Server) listenHTTP(listener string) error {
-	http.HandleFunc("GET /api/v1/ip", s.handleGetIP())
-	http.HandleFunc("POST /api/v1/update", s.handleUpdateIP())
-	return http.ListenAndServe(listener, nil)
+// tlsConfig returns the TLS configuration for the HTTP server, or nil if TLS
+// is not enabled. If ACME is configured, certificate management is started in
+// the background, until ctx is done.
+func (s *Server) tlsConfig(ctx context.Context) (*tls.Config, error) {
+	if s.ACME != nil {
+		m, err := newACMEManager(s, s.ACME)
+		if err != nil {
+			return nil, err
+		}
+		go m.run(ctx)
+		return &tls.Config{GetCertificate: m.GetCertificate}, nil
+	}
+
+	if s.TLSCertFile == "" && s.TLSKeyFile == "" {
+		return nil, nil
+	}
+	if s.TLSCertFile == "" || s.TLSKeyFile == "" {
+		return nil, fmt.Errorf("both a TLS certificate and key are required")
+	}
+
+	c, err := newCertReloader(s.TLSCertFile, s.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{GetCertificate: c.GetCertificate}, nil
 }
 
 func (s *Server) handleGetIP() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		ip, err := getCallerIP(r)
+		ip, err := s.getCallerIP(r)
 		if err != nil {
 			slog.Error(err.Error())
 			w.WriteHeader(http.StatusInternalServerError)
@@ -195,9 +435,8 @@ func (s *Server) handleGetIP() http.HandlerFunc {
 func (s *Server) handleUpdateIP() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Validate token
-		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
-		if !s.validateToken(token) {
-			w.WriteHeader(http.StatusUnauthorized)
+		key := s.authorize(w, r, OperationUpdate)
+		if key == nil {
 			return
 		}
 
@@ -209,7 +448,9 @@ func (s *Server) handleUpdateIP() http.HandlerFunc {
 		}
 
 		// Only allow changing domains that are allowed by the token
-		if r := s.AllowedAPIKeys[token]; r != nil && !r.MatchString(domain) {
+		if !key.allowsName(domain) {
+			slog.Info("key is not allowed to update domain", "key", key.ID, "domain", domain)
+			s.audit(r, key, OperationUpdate, domain, nil, nil, AuditResultForbidden)
 			w.WriteHeader(http.StatusForbidden)
 			return
 		}
@@ -217,7 +458,7 @@ func (s *Server) handleUpdateIP() http.HandlerFunc {
 		// Determine IP
 		ipStr := r.URL.Query().Get("ip")
 		if ipStr == "auto" {
-			callerIP, err := getCallerIP(r)
+			callerIP, err := s.getCallerIP(r)
 			if err != nil {
 				w.WriteHeader(http.StatusInternalServerError)
 				return
@@ -226,31 +467,140 @@ func (s *Server) handleUpdateIP() http.HandlerFunc {
 		}
 
 		// Validate IP
+		existingIP := s.Get(domain)
 		ip := net.ParseIP(ipStr)
 		if ip == nil || ip.IsLoopback() || ip.IsMulticast() || ip.IsUnspecified() {
+			s.audit(r, key, OperationUpdate, domain, existingIP, ip, AuditResultInvalid)
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
 
+		// Only allow record types and addresses that are allowed by the token
+		addr, _ := netip.AddrFromSlice(ip)
+		policy := key.policy()
+		if rtype := recordType(ip); !policy.AllowsRecordType(rtype) {
+			slog.Info("key is not allowed to update record type", "key", key.ID, "domain", domain, "type", rtype)
+			s.audit(r, key, OperationUpdate, domain, existingIP, ip, AuditResultForbidden)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if !policy.AllowsAddress(addr) {
+			slog.Info("key is not allowed to point domain at ip", "key", key.ID, "domain", domain, "ip", ip)
+			s.audit(r, key, OperationUpdate, domain, existingIP, ip, AuditResultForbidden)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
 		// Skip if already correct
-		if existingIP, ok := s.Domains[domain]; ok {
-			if ip.Equal(existingIP) {
-				slog.Debug("skipping update for domain already set to same IP", "domain", domain, "ip", ip)
-				return
-			}
+		if ip.Equal(existingIP) {
+			slog.Debug("skipping update for domain already set to same IP", "key", key.ID, "domain", domain, "ip", ip)
+			return
 		}
 
 		// Update
-		slog.Info("updating IP for domain", "domain", domain, "ip", ip)
-		s.Set(domain, ip)
+		slog.Info("updating IP for domain", "key", key.ID, "domain", domain, "ip", ip)
+		if err := s.Set(domain, ip); err != nil {
+			slog.Error(err.Error(), "domain", domain)
+			s.audit(r, key, OperationUpdate, domain, existingIP, ip, AuditResultFailed)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		s.audit(r, key, OperationUpdate, domain, existingIP, ip, AuditResultUpdated)
+		s.notify(key, WebhookEventUpdated, domain, existingIP, ip)
 		w.WriteHeader(http.StatusCreated)
 	}
 }
 
-func (s *Server) listenDNS(listener string) error {
-	dnsServer := &dns.Server{Addr: listener, Net: "udp"}
-	dns.HandleFunc(".", s.handleDNS())
-	return dnsServer.ListenAndServe()
+func (s *Server) handleDeleteRecord() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := s.authorize(w, r, OperationDelete)
+		if key == nil {
+			return
+		}
+
+		domain := r.URL.Query().Get("domain")
+		if domain == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if !key.allowsName(domain) {
+			slog.Info("key is not allowed to delete domain", "key", key.ID, "domain", domain)
+			s.audit(r, key, OperationDelete, domain, nil, nil, AuditResultForbidden)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		ip := s.Get(domain)
+		if ip == nil {
+			s.audit(r, key, OperationDelete, domain, nil, nil, AuditResultNotFound)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if rtype := recordType(ip); !key.policy().AllowsRecordType(rtype) {
+			slog.Info("key is not allowed to delete record type", "key", key.ID, "domain", domain, "type", rtype)
+			s.audit(r, key, OperationDelete, domain, ip, nil, AuditResultForbidden)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		slog.Info("deleting domain", "key", key.ID, "domain", domain)
+		if err := s.Delete(domain); err != nil {
+			slog.Error(err.Error(), "domain", domain)
+			s.audit(r, key, OperationDelete, domain, ip, nil, AuditResultFailed)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		s.audit(r, key, OperationDelete, domain, ip, nil, AuditResultDeleted)
+		s.notify(key, WebhookEventDeleted, domain, ip, nil)
+	}
+}
+
+func (s *Server) handleListRecords() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := s.authorize(w, r, OperationRead)
+		if key == nil {
+			return
+		}
+
+		st, err := s.getStore()
+		if err != nil {
+			slog.Error("failed to open store", "error", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		domains, err := st.List()
+		if err != nil {
+			slog.Error("failed to list records from store", "error", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		// Only include the domains the key is allowed to see
+		out := Domains{}
+		for domain, ip := range domains {
+			if key.allowsName(domain) {
+				out[domain] = ip
+			}
+		}
+		writeJSON(w, http.StatusOK, out)
+	}
+}
+
+func (s *Server) listenDNS(ctx context.Context, listener string) error {
+	conn, err := net.ListenPacket("udp", listener)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	dnsServer := &dns.Server{PacketConn: conn, Handler: s.handleDNS()}
+	if err := dnsServer.ActivateAndServe(); ctx.Err() == nil {
+		return err
+	}
+	return nil
 }
 
 func (s *Server) handleDNS() dns.HandlerFunc {
@@ -260,35 +610,68 @@ func (s *Server) handleDNS() dns.HandlerFunc {
 		defer w.WriteMsg(r)
 		for _, q := range r.Question {
 			domain := strings.TrimSuffix(q.Name, ".")
-			ip := s.Domains[domain]
-			if q.Qtype == dns.TypeA && ip != nil {
-				r.MsgHdr.Authoritative = true
-				answer := &dns.A{
-					A: ip,
-					Hdr: dns.RR_Header{
-						Name:   q.Name,
-						Rrtype: q.Qtype,
-						Class:  q.Qclass,
-					},
+			hdr := dns.RR_Header{
+				Name:   q.Name,
+				Rrtype: q.Qtype,
+				Class:  q.Qclass,
+			}
+			switch q.Qtype {
+			case dns.TypeA:
+				if ip := s.Get(domain); ip != nil && ip.To4() != nil {
+					r.MsgHdr.Authoritative = true
+					r.Answer = append(r.Answer, &dns.A{Hdr: hdr, A: ip})
+				}
+			case dns.TypeAAAA:
+				if ip := s.Get(domain); ip != nil && ip.To4() == nil {
+					r.MsgHdr.Authoritative = true
+					r.Answer = append(r.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+				}
+			case dns.TypeTXT:
+				for _, v := range s.getChallenges(domain) {
+					r.MsgHdr.Authoritative = true
+					r.Answer = append(r.Answer, &dns.TXT{Hdr: hdr, Txt: []string{v}})
 				}
-				r.Ns = append(r.Answer, answer)
 			}
 		}
 	}
 }
 
-func (s *Server) validateToken(key string) bool {
-	if key == "" {
-		return false
+// addChallenge serves value as a TXT record for name until it is removed with
+// [Server.removeChallenge].
+func (s *Server) addChallenge(name, value string) {
+	s.challengeMu.Lock()
+	defer s.challengeMu.Unlock()
+	if s.challenges == nil {
+		s.challenges = map[string][]string{}
 	}
+	name = strings.ToLower(name)
+	s.challenges[name] = append(s.challenges[name], value)
+}
 
-	for k, _ := range s.AllowedAPIKeys {
-		if k == key {
-			return true
-		}
+func (s *Server) removeChallenge(name, value string) {
+	s.challengeMu.Lock()
+	defer s.challengeMu.Unlock()
+	name = strings.ToLower(name)
+	s.challenges[name] = slices.DeleteFunc(s.challenges[name], func(v string) bool {
+		return v == value
+	})
+	if len(s.challenges[name]) == 0 {
+		delete(s.challenges, name)
 	}
+}
 
-	return false
+func (s *Server) getChallenges(name string) []string {
+	s.challengeMu.RLock()
+	defer s.challengeMu.RUnlock()
+	return slices.Clone(s.challenges[strings.ToLower(name)])
+}
+
+// recordType returns the type of DNS record used to serve ip.
+func recordType(ip net.IP) string {
+	if ip.To4() != nil {
+		return "A"
+	}
+	return "AAAA"
 }
 
 func (s *Server) getDNSListener() string {
@@ -304,28 +687,3 @@ func (s *Server) getHTTPListener() string {
 	}
 	return s.HTTPListener
 }
-
-func getCallerIP(r *http.Request) (net.IP, error) {
-	// Use X-Real-Ip header if available
-	ip := r.Header.Get("X-Real-Ip")
-
-	// Use X-Forwarded-For header if available
-	if ip == "" {
-		ip = r.Header.Get("X-Forwarded-For")
-	}
-
-	// Use request.RemoteAddr
-	if ip == "" {
-		lastColon := strings.LastIndex(r.RemoteAddr, ":")
-		ip = r.RemoteAddr[:lastColon]
-		ip = strings.Trim(ip, "[]")
-	}
-
-	// Ensure it is a valid IP
-	out := net.ParseIP(ip)
-	if out == nil {
-		return nil, fmt.Errorf("not a valid ip: %s", ip)
-	}
-
-	return out, nil
-}
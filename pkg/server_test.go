@@ -1,9 +1,17 @@
 package ddns
 
 import (
+	"fmt"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"regexp"
+	"sync"
 	"testing"
+
+	"github.com/miekg/dns"
 )
 
 func TestServerAllow(t *testing.T) {
@@ -50,28 +58,34 @@ func TestServerSet(t *testing.T) {
 	for k, v := range domains {
 		s.Set(k, v)
 	}
-	if s.Domains == nil {
-		t.Fatalf("not initialized: Server.Domains")
+	if s.Store == nil {
+		t.Fatalf("not initialized: Server.Store")
 	}
 	for domain, ip := range domains {
-		got, ok := s.Domains[domain]
-		if !ok {
-			t.Fatalf("key missing from Server.Domains: %s", domain)
+		got := s.Get(domain)
+		if got == nil {
+			t.Fatalf("domain missing from Server.Store: %s", domain)
 		}
 		if !got.Equal(ip) {
-			t.Fatalf(`incorrect value for Server.Domains["%s"], got: "%s", expected: "%s"`, domain, got, ip)
+			t.Fatalf(`incorrect value for Server.Get("%s"), got: "%s", expected: "%s"`, domain, got, ip)
 		}
 	}
 
 	// overwrite a single value
 	domain, ip := "myotherdomain", net.ParseIP("3.3.3.3")
 	s.Set(domain, ip)
-	got, ok := s.Domains[domain]
-	if !ok {
-		t.Fatalf("key missing from Server.Domains: %s", domain)
+	got := s.Get(domain)
+	if got == nil {
+		t.Fatalf("domain missing from Server.Store: %s", domain)
 	}
 	if !got.Equal(ip) {
-		t.Fatalf(`incorrect overwritten value for Server.Domains["%s"], got: "%s", expected: "%s"`, domain, got, ip)
+		t.Fatalf(`incorrect overwritten value for Server.Get("%s"), got: "%s", expected: "%s"`, domain, got, ip)
+	}
+
+	// delete a single value
+	s.Delete(domain)
+	if got := s.Get(domain); got != nil {
+		t.Fatalf(`deleted domain still has a value: "%s"`, got)
 	}
 }
 
@@ -86,47 +100,185 @@ func TestServerLoad(t *testing.T) {
 		"mydomain.com":      net.ParseIP("1.2.3.4"),
 		"myotherdomain.com": net.ParseIP("4.3.2.1"),
 	}
-	if s.Domains == nil {
-		t.Fatalf("not initialized: Server.Domains")
+	if _, ok := s.Store.(*YAMLStore); !ok {
+		t.Fatalf("incorrect store type for hosts file: %T", s.Store)
 	}
 	for domain, ip := range domains {
-		got, ok := s.Domains[domain]
-		if !ok {
-			t.Fatalf("key missing from Server.Domains: %s", domain)
+		got := s.Get(domain)
+		if got == nil {
+			t.Fatalf("domain missing from Server.Store: %s", domain)
 		}
 		if !got.Equal(ip) {
-			t.Fatalf(`incorrect value for Server.Domains["%s"], got: "%s", expected: "%s"`, domain, got, ip)
+			t.Fatalf(`incorrect value for Server.Get("%s"), got: "%s", expected: "%s"`, domain, got, ip)
 		}
 	}
 
-	// overwrite a single value
-	//s.HostsFile = "testdata/hosts-new.yaml"
-	//if err := s.Load(); err != nil {
-	//	t.Fatal(err)
-	//}
-	//domain, ip := "mydomain.com", net.ParseIP("3.3.3.3")
-	//got, ok := s.Domains[domain]
-	//if !ok {
-	//	t.Fatalf("key missing from Server.Domains: %s", domain)
-	//}
-	//if !got.Equal(ip) {
-	//	t.Fatalf(`incorrect overwritten value for Server.Domains["%s"], got: "%s", expected: "%s"`, domain, got, ip)
-	//}
-
-	s.HostsFile = "testdata/hosts-new.yaml"
+	// Values from the hosts file take precedence over Server.Domains. Use a
+	// copy, since the missing domains are written to the hosts file.
+	b, err := os.ReadFile("testdata/hosts-new.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostsFile := filepath.Join(t.TempDir(), "hosts.yaml")
+	if err := os.WriteFile(hostsFile, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	s = Server{
+		HostsFile: hostsFile,
+		Domains:   domains,
+	}
 	if err := s.Load(); err != nil {
 		t.Fatal(err)
 	}
 	// what got overwritten
-	domains["mydomain.com"] = net.ParseIP("3.3.3.3")
-	for domain, ip := range domains {
-		got, ok := s.Domains[domain]
-		if !ok {
-			t.Fatalf("key missing from Server.Domains: %s", domain)
+	expected := map[string]net.IP{
+		"mydomain.com":      net.ParseIP("3.3.3.3"),
+		"myotherdomain.com": net.ParseIP("4.3.2.1"),
+	}
+	for domain, ip := range expected {
+		got := s.Get(domain)
+		if got == nil {
+			t.Fatalf("domain missing from Server.Store: %s", domain)
 		}
 		if !got.Equal(ip) {
-			t.Fatalf(`incorrect value for Server.Domains["%s"], got: "%s", expected: "%s"`, domain, got, ip)
+			t.Fatalf(`incorrect value for Server.Get("%s"), got: "%s", expected: "%s"`, domain, got, ip)
+		}
+	}
+}
+
+func TestServerHandleDNSChallenge(t *testing.T) {
+	s := Server{}
+	name := "_acme-challenge.mydomain.com"
+	s.addChallenge(name, "token1")
+	s.addChallenge(name, "token2")
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), dns.TypeTXT)
+	w := &testResponseWriter{}
+	s.handleDNS()(w, m)
+	if w.msg == nil || len(w.msg.Answer) != 2 {
+		t.Fatalf("expected 2 TXT answers, got: %v", w.msg)
+	}
+	for i, expected := range []string{"token1", "token2"} {
+		txt, ok := w.msg.Answer[i].(*dns.TXT)
+		if !ok || txt.Txt[0] != expected {
+			t.Fatalf(`incorrect TXT answer %d, got: "%s", expected: "%s"`, i, w.msg.Answer[i], expected)
+		}
+	}
+
+	s.removeChallenge(name, "token1")
+	s.removeChallenge(name, "token2")
+	w = &testResponseWriter{}
+	s.handleDNS()(w, m)
+	if len(w.msg.Answer) != 0 {
+		t.Fatalf("expected no answers after removing challenges, got: %v", w.msg.Answer)
+	}
+}
+
+// TestServerConcurrency exercises DNS queries, API updates, hosts file reloads
+// and config reloads at the same time. Run with -race to detect data races.
+func TestServerConcurrency(t *testing.T) {
+	s := &Server{
+		HostsFile:      filepath.Join(t.TempDir(), "hosts.yaml"),
+		AllowedAPIKeys: APIKeyMatcher{"mykey": nil},
+	}
+	if err := s.Load(); err != nil {
+		t.Fatal(err)
+	}
+	h := s.handler()
+
+	const workers, iterations = 4, 50
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(4)
+
+		go func() {
+			defer wg.Done()
+			for j := 0; j < iterations; j++ {
+				m := new(dns.Msg)
+				m.SetQuestion(fmt.Sprintf("domain%d.com.", j%5), dns.TypeA)
+				s.handleDNS()(&testResponseWriter{}, m)
+			}
+		}()
+
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < iterations; j++ {
+				url := fmt.Sprintf("/api/v1/update?domain=domain%d.com&ip=1.1.%d.%d", j%5, i, j)
+				r := httptest.NewRequest(http.MethodPost, url, nil)
+				r.Header.Set("Authorization", "Bearer mykey")
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, r)
+				if w.Code != http.StatusOK && w.Code != http.StatusCreated {
+					t.Errorf("update failed with status %d: %s", w.Code, w.Body)
+					return
+				}
+			}
+		}(i)
+
+		go func() {
+			defer wg.Done()
+			for j := 0; j < iterations/10; j++ {
+				s.ReloadHostsFile()
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+			for j := 0; j < iterations/10; j++ {
+				next := &Server{AllowedAPIKeys: APIKeyMatcher{"mykey": nil}}
+				if _, err := s.Reload(next); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// The hosts file matches the records served
+	domains, err := readHostsFile(s.HostsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for domain, ip := range domains {
+		if got := s.Get(domain); !got.Equal(ip) {
+			t.Fatalf(`hosts file and store differ for %s, got: "%s", expected: "%s"`, domain, got, ip)
 		}
 	}
+}
+
+// testResponseWriter is a [dns.ResponseWriter] which records the reply.
+type testResponseWriter struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (w *testResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
 
+func TestServerHandleDNSA(t *testing.T) {
+	s := Server{}
+	s.Set("mydomain.com", net.ParseIP("1.2.3.4"))
+	s.Set("v6.com", net.ParseIP("::1"))
+
+	m := new(dns.Msg)
+	m.SetQuestion("mydomain.com.", dns.TypeA)
+	w := &testResponseWriter{}
+	s.handleDNS()(w, m)
+	if len(w.msg.Answer) != 1 || len(w.msg.Ns) != 0 {
+		t.Fatalf("expected a single answer, got: %v", w.msg)
+	}
+	if a, ok := w.msg.Answer[0].(*dns.A); !ok || !a.A.Equal(net.ParseIP("1.2.3.4")) {
+		t.Fatalf("incorrect answer: %v", w.msg.Answer[0])
+	}
+
+	m.SetQuestion("v6.com.", dns.TypeA)
+	w = &testResponseWriter{}
+	s.handleDNS()(w, m)
+	if len(w.msg.Answer) != 0 {
+		t.Fatalf("expected no A answer for an IPv6 address, got: %v", w.msg.Answer)
+	}
 }
@@ -0,0 +1,403 @@
+package ddns
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// The type of an [IPSourceConfig].
+const (
+	SourceTypeServer    = "server"    // ask the DDNS server, see [ServerSource]
+	SourceTypeInterface = "interface" // read a network interface, see [InterfaceSource]
+	SourceTypeCommand   = "command"   // run a command, see [CommandSource]
+	SourceTypeSTUN      = "stun"      // ask a STUN server, see [STUNSource]
+	SourceTypeHTTP      = "http"      // ask a "what is my IP" endpoint, see [HTTPSource]
+	SourceTypeDNS       = "dns"       // query a DNS resolver, see [DNSSource]
+	SourceTypeConsensus = "consensus" // ask several sources, see [ConsensusSource]
+	SourceTypeUPnP      = "upnp"      // ask the router using UPnP, see [UPnPSource]
+	SourceTypeNATPMP    = "natpmp"    // ask the router using NAT-PMP or PCP, see [NATPMPSource]
+)
+
+// The address family of an IP source.
+const (
+	FamilyIPv4 = "ipv4"
+	FamilyIPv6 = "ipv6"
+)
+
+// commandSourceTimeout is how long a [CommandSource] command may run.
+const commandSourceTimeout = 30 * time.Second
+
+// IPSource determines the IP which the agent should publish.
+type IPSource interface {
+	IP(ctx context.Context) (net.IP, error)
+}
+
+// IPWatcher is implemented by sources which can tell when the IP may have
+// changed, so the agent can check immediately instead of waiting for the next
+// interval.
+type IPWatcher interface {
+	// Changes returns a channel which receives a value when the IP may have
+	// changed, until ctx is cancelled. The channel should only be closed once
+	// ctx is done. If it is closed earlier, the agent falls back to checking at
+	// each interval.
+	Changes(ctx context.Context) (<-chan struct{}, error)
+}
+
+// watchRetryDelay is the delay before a watcher is opened again after an
+// error. It doubles after each consecutive error, up to watchMaxRetryDelay.
+var watchRetryDelay = time.Second
+
+const watchMaxRetryDelay = time.Minute
+
+// watch implements [IPWatcher.Changes] for a connection which receives a
+// message whenever the IP may have changed. If opening or reading fails, a
+// change is reported, since messages may have been missed, and the connection
+// is opened again with backoff. The channel is closed when ctx is done.
+func watch(ctx context.Context, name string, open func() (io.ReadCloser, error)) (<-chan struct{}, error) {
+	conn, err := open()
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+	go func() {
+		defer close(ch)
+		delay := watchRetryDelay
+		for {
+			received, err := readAll(ctx, conn, notify)
+			if ctx.Err() != nil {
+				return
+			}
+			if received {
+				delay = watchRetryDelay
+			}
+			notify()
+
+			for {
+				slog.Warn("failed to watch for ip changes, reopening", "watcher", name, "error", err.Error(), "retry_in", delay.String())
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(delay):
+				}
+				delay = min(delay*2, watchMaxRetryDelay)
+				if conn, err = open(); err == nil {
+					break
+				}
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// readAll calls notify for each message read from conn, until reading fails
+// or ctx is done, and then closes conn. received is true if any message was
+// read.
+func readAll(ctx context.Context, conn io.ReadCloser, notify func()) (received bool, err error) {
+	// Closing conn interrupts Read
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer func() {
+		if stop() {
+			conn.Close()
+		}
+	}()
+
+	buf := make([]byte, 4096)
+	for {
+		if _, err := conn.Read(buf); err != nil {
+			return received, err
+		}
+		received = true
+		notify()
+	}
+}
+
+// IPSourceConfig selects and configures an [IPSource].
+type IPSourceConfig struct {
+	// Type is one of the SourceType constants. If not set, [SourceTypeServer]
+	// is used.
+	Type string
+
+	// Interface is the name of the network interface for
+	// [SourceTypeInterface].
+	Interface string
+
+	// Family is [FamilyIPv4] or [FamilyIPv6], for sources which can return
+	// either. If not set, [FamilyIPv4] is used.
+	Family string
+
+	// Watch enables watching for address changes. With
+	// [SourceTypeInterface], this is only supported on Linux, using netlink.
+	// With [SourceTypeNATPMP], the announcements of the router are used.
+	Watch bool
+
+	// Command is run by the shell for [SourceTypeCommand].
+	Command string
+
+	// Server is the host and port of the server for [SourceTypeSTUN] and
+	// [SourceTypeDNS], or the address of the router for [SourceTypeNATPMP].
+	Server string
+
+	// URL is the endpoint for [SourceTypeHTTP], or the device description of
+	// the router for [SourceTypeUPnP].
+	URL string
+
+	// Name and RecordType are the query for [SourceTypeDNS]. See [DNSSource].
+	Name       string
+	RecordType string
+
+	// Sources and Quorum configure [SourceTypeConsensus]. See
+	// [ConsensusSource].
+	Sources []*IPSourceConfig
+	Quorum  int
+}
+
+// sourceFor returns the IP source for domain. See [Agent.Sources].
+func (a *Agent) sourceFor(domain string) (IPSource, error) {
+	return a.sourceConfig(domain).source(a)
+}
+
+// sourceConfig returns the config of the IP source for domain.
+func (a *Agent) sourceConfig(domain string) *IPSourceConfig {
+	cfg := a.Source
+	if c, ok := a.Sources[domain]; ok {
+		cfg = c
+	}
+	if cfg == nil {
+		cfg = &IPSourceConfig{}
+	}
+	return cfg
+}
+
+func (c *IPSourceConfig) getType() string {
+	if c.Type == "" {
+		return SourceTypeServer
+	}
+	return c.Type
+}
+
+func (c *IPSourceConfig) source(a *Agent) (IPSource, error) {
+	family := c.Family
+	if family == "" {
+		family = FamilyIPv4
+	}
+	if family != FamilyIPv4 && family != FamilyIPv6 {
+		return nil, fmt.Errorf("unknown address family: %s", family)
+	}
+
+	switch c.Type {
+	case SourceTypeServer, "":
+		return &ServerSource{Agent: a, Family: c.Family}, nil
+	case SourceTypeInterface:
+		if c.Interface == "" {
+			return nil, fmt.Errorf("no interface configured for %s source", c.Type)
+		}
+		return &InterfaceSource{Name: c.Interface, Family: family, Watch: c.Watch}, nil
+	case SourceTypeCommand:
+		if c.Command == "" {
+			return nil, fmt.Errorf("no command configured for %s source", c.Type)
+		}
+		return &CommandSource{Command: c.Command}, nil
+	case SourceTypeSTUN:
+		if c.Server == "" {
+			return nil, fmt.Errorf("no server configured for %s source", c.Type)
+		}
+		return &STUNSource{Server: c.Server, Family: family}, nil
+	case SourceTypeHTTP:
+		if c.URL == "" {
+			return nil, fmt.Errorf("no url configured for %s source", c.Type)
+		}
+		return &HTTPSource{URL: c.URL, Family: family}, nil
+	case SourceTypeDNS:
+		if c.Server == "" || c.Name == "" {
+			return nil, fmt.Errorf("no server or name configured for %s source", c.Type)
+		}
+		return &DNSSource{Resolver: c.Server, Name: c.Name, RecordType: c.RecordType, Family: family}, nil
+	case SourceTypeUPnP, SourceTypeNATPMP:
+		if family != FamilyIPv4 {
+			return nil, fmt.Errorf("%s source only supports %s", c.Type, FamilyIPv4)
+		}
+		if c.Type == SourceTypeUPnP {
+			return &UPnPSource{DescriptionURL: c.URL}, nil
+		}
+		return &NATPMPSource{Gateway: c.Server, Watch: c.Watch}, nil
+	case SourceTypeConsensus:
+		if len(c.Sources) == 0 {
+			return nil, fmt.Errorf("no sources configured for %s source", c.Type)
+		}
+		if c.Quorum > len(c.Sources) {
+			return nil, fmt.Errorf("quorum of %d is more than the %d sources", c.Quorum, len(c.Sources))
+		}
+		out := &ConsensusSource{Quorum: c.Quorum}
+		for _, sc := range c.Sources {
+			// Sources inherit the family, unless they set their own
+			if sc.Family == "" {
+				copied := *sc
+				copied.Family = family
+				sc = &copied
+			}
+			source, err := sc.source(a)
+			if err != nil {
+				return nil, err
+			}
+			out.Sources = append(out.Sources, source)
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("unknown ip source type: %s", c.Type)
+}
+
+// ServerSource asks the DDNS server for the IP of the agent, using
+// [Agent.DetermineIP].
+type ServerSource struct {
+	Agent *Agent
+
+	// Family is the address family which the IP must have, if set. The
+	// server sees the address which the agent connects from, so it must be
+	// reachable over that family.
+	Family string
+}
+
+func (s *ServerSource) IP(ctx context.Context) (net.IP, error) {
+	v, err := s.Agent.DetermineIP(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ip, err := parseSourceIP(v)
+	if err != nil {
+		return nil, err
+	}
+	if s.Family != "" && familyOf(ip) != s.Family {
+		return nil, fmt.Errorf("the server saw the %s address %s, the agent must connect to it over %s", familyOf(ip), ip, s.Family)
+	}
+	return ip, nil
+}
+
+// familyOf returns the address family of ip.
+func familyOf(ip net.IP) string {
+	if ip.To4() != nil {
+		return FamilyIPv4
+	}
+	return FamilyIPv6
+}
+
+// checkFamily returns ip, or an error if family is set and ip is of the other
+// family. Sources which ask a remote service use it, since the service may
+// answer with an address of either family.
+func checkFamily(ip net.IP, family string) (net.IP, error) {
+	if family != "" && familyOf(ip) != family {
+		return nil, fmt.Errorf("ip source returned an %s address for %s: %s", familyOf(ip), family, ip)
+	}
+	return ip, nil
+}
+
+// InterfaceSource reads the address of a network interface, for machines
+// which have a public address directly on an interface. Loopback and
+// link-local addresses are ignored, as are IPv6 unique local, temporary
+// (privacy extension) and deprecated addresses. Public addresses are preferred
+// over private ones.
+type InterfaceSource struct {
+	Name   string
+	Family string
+
+	// Watch enables [InterfaceSource.Changes].
+	Watch bool
+}
+
+func (s *InterfaceSource) IP(ctx context.Context) (net.IP, error) {
+	iface, err := net.InterfaceByName(s.Name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	excluded, err := excludedIPv6Addrs(s.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	var private net.IP
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip, _ := netip.AddrFromSlice(ipnet.IP)
+		ip = ip.Unmap()
+		if !usableInterfaceAddr(ip, s.Family) || excluded[ip] {
+			continue
+		}
+		if !ip.IsPrivate() {
+			return net.IP(ip.AsSlice()), nil
+		}
+		if private == nil {
+			private = net.IP(ip.AsSlice())
+		}
+	}
+	if private != nil {
+		return private, nil
+	}
+	return nil, fmt.Errorf("no usable %s address on interface %s", s.Family, s.Name)
+}
+
+// Changes returns a channel which receives a value when an address is added to
+// or removed from any interface. It is only supported on Linux.
+func (s *InterfaceSource) Changes(ctx context.Context) (<-chan struct{}, error) {
+	if !s.Watch {
+		return nil, nil
+	}
+	return watchAddressChanges(ctx)
+}
+
+// usableInterfaceAddr returns true if ip could be published for family.
+func usableInterfaceAddr(ip netip.Addr, family string) bool {
+	if ip.Is4() != (family == FamilyIPv4) {
+		return false
+	}
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	// IPv6 unique local addresses (fc00::/7) are never reachable from outside
+	return !(ip.Is6() && ip.IsPrivate())
+}
+
+// CommandSource runs a command with the shell, and uses the IP which it prints
+// on the first line of its output.
+type CommandSource struct {
+	Command string
+}
+
+func (s *CommandSource) IP(ctx context.Context) (net.IP, error) {
+	ctx, cancel := context.WithTimeout(ctx, commandSourceTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "sh", "-c", s.Command).Output()
+	if err != nil {
+		return nil, fmt.Errorf("ip source command failed: %w", err)
+	}
+	line, _, _ := strings.Cut(string(out), "\n")
+	return parseSourceIP(line)
+}
+
+// parseSourceIP parses an IP returned by a source.
+func parseSourceIP(s string) (net.IP, error) {
+	ip := net.ParseIP(strings.TrimSpace(s))
+	if ip == nil {
+		return nil, fmt.Errorf("ip source returned an invalid ip: %q", s)
+	}
+	return ip, nil
+}
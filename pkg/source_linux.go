@@ -0,0 +1,112 @@
+package ddns
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Flags of IPv6 addresses in /proc/net/if_inet6 which should not be published.
+const excludedIPv6Flags = unix.IFA_F_TEMPORARY | unix.IFA_F_DEPRECATED | unix.IFA_F_TENTATIVE | unix.IFA_F_DADFAILED
+
+// excludedIPv6Addrs returns the temporary, deprecated and tentative IPv6
+// addresses of the interface, which the net package does not report.
+func excludedIPv6Addrs(iface string) (map[netip.Addr]bool, error) {
+	out := map[netip.Addr]bool{}
+	f, err := os.Open("/proc/net/if_inet6")
+	if errors.Is(err, os.ErrNotExist) {
+		// IPv6 is disabled
+		return out, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// Each line is: address, index, prefix length, scope, flags, name
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 6 || fields[5] != iface {
+			continue
+		}
+		flags, err := strconv.ParseUint(fields[4], 16, 32)
+		if err != nil || flags&excludedIPv6Flags == 0 {
+			continue
+		}
+		b, err := hex.DecodeString(fields[0])
+		if err != nil {
+			continue
+		}
+		if ip, ok := netip.AddrFromSlice(b); ok {
+			out[ip] = true
+		}
+	}
+	return out, scanner.Err()
+}
+
+// watchAddressChanges subscribes to netlink notifications for IPv4 and IPv6
+// address changes.
+func watchAddressChanges(ctx context.Context) (<-chan struct{}, error) {
+	return watch(ctx, "netlink", openNetlink)
+}
+
+// openNetlink opens a netlink socket which receives IPv4 and IPv6 address
+// changes.
+func openNetlink() (io.ReadCloser, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC|unix.SOCK_NONBLOCK, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, err
+	}
+	sa := &unix.SockaddrNetlink{
+		Family: unix.AF_NETLINK,
+		Groups: unix.RTMGRP_IPV4_IFADDR | unix.RTMGRP_IPV6_IFADDR,
+	}
+	if err := unix.Bind(fd, sa); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	// Using a file for the non-blocking socket lets Close interrupt Read
+	return os.NewFile(uintptr(fd), "netlink"), nil
+}
+
+// defaultGateway returns the IPv4 default gateway from /proc/net/route.
+func defaultGateway() (net.IP, error) {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// Each line is: interface, destination, gateway, flags, ... with the
+	// addresses in little endian hex
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[1] != "00000000" {
+			continue
+		}
+		flags, err := strconv.ParseUint(fields[3], 16, 16)
+		if err != nil || flags&unix.RTF_GATEWAY == 0 {
+			continue
+		}
+		b, err := hex.DecodeString(fields[2])
+		if err != nil || len(b) != 4 {
+			continue
+		}
+		return net.IPv4(b[3], b[2], b[1], b[0]), nil
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, errors.New("no default gateway")
+}
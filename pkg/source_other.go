@@ -0,0 +1,24 @@
+//go:build !linux
+
+package ddns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+)
+
+// excludedIPv6Addrs is only supported on Linux. Elsewhere, temporary IPv6
+// addresses can not be told apart, so none are excluded.
+func excludedIPv6Addrs(iface string) (map[netip.Addr]bool, error) {
+	return map[netip.Addr]bool{}, nil
+}
+
+func watchAddressChanges(ctx context.Context) (<-chan struct{}, error) {
+	return nil, errors.New("watching for address changes is only supported on Linux")
+}
+
+func defaultGateway() (net.IP, error) {
+	return nil, errors.New("finding the default gateway is only supported on Linux, set the gateway instead")
+}
@@ -0,0 +1,368 @@
+package ddns
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// publicSourceTimeout is how long the STUN, HTTP and DNS sources wait for a
+// response.
+const publicSourceTimeout = 10 * time.Second
+
+// stunMagicCookie is the fixed value in every RFC 5389 STUN message.
+const stunMagicCookie = 0x2112A442
+
+// stunRTO is the initial retransmission timeout of a STUN request (RFC 5389,
+// section 7.2.1). It doubles after each retransmission. After the last of
+// stunMaxRequests, the response is awaited for stunLastWait times stunRTO.
+var stunRTO = 500 * time.Millisecond
+
+const (
+	stunMaxRequests = 7
+	stunLastWait    = 16
+)
+
+// STUN message types and attributes used by [STUNSource].
+const (
+	stunBindingRequest  = 0x0001
+	stunBindingResponse = 0x0101
+	stunMappedAddress   = 0x0001
+	stunXORMappedAddr   = 0x0020
+)
+
+// STUNSource sends an RFC 5389 binding request to a STUN server, which
+// responds with the address the request came from.
+type STUNSource struct {
+	// Server is the host and port of the STUN server, such as
+	// "stun.l.google.com:19302".
+	Server string
+	Family string
+}
+
+func (s *STUNSource) IP(ctx context.Context) (net.IP, error) {
+	ctx, cancel := context.WithTimeout(ctx, publicSourceTimeout)
+	defer cancel()
+	d := net.Dialer{}
+	conn, err := d.DialContext(ctx, familyNetwork("udp", s.Family), s.Server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+
+	req := make([]byte, 20)
+	binary.BigEndian.PutUint16(req[0:], stunBindingRequest)
+	binary.BigEndian.PutUint32(req[4:], stunMagicCookie)
+	txID := req[8:20]
+	if _, err := rand.Read(txID); err != nil {
+		return nil, err
+	}
+
+	// UDP is unreliable, so the request is retransmitted with the same
+	// transaction ID until a response arrives
+	rto := stunRTO
+	for sent := 1; ; sent++ {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		wait := rto
+		if sent == stunMaxRequests {
+			wait = stunRTO * stunLastWait
+		}
+		readDeadline := time.Now().Add(wait)
+		if readDeadline.After(deadline) {
+			readDeadline = deadline
+		}
+		conn.SetReadDeadline(readDeadline)
+
+		ip, err := readSTUNResponse(conn, txID)
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() && sent < stunMaxRequests && ctx.Err() == nil && time.Now().Before(deadline) {
+			rto *= 2
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("stun: %w", err)
+		}
+		return checkFamily(ip, s.Family)
+	}
+}
+
+// readSTUNResponse reads from conn until a binding response for txID arrives,
+// or the read deadline passes. Other packets, such as stray datagrams or late
+// responses, are ignored.
+func readSTUNResponse(conn net.Conn, txID []byte) (net.IP, error) {
+	buf := make([]byte, 1500)
+	var invalid error
+	for {
+		n, err := conn.Read(buf)
+		if err != nil && invalid != nil {
+			return nil, fmt.Errorf("%w, ignored %v", err, invalid)
+		}
+		if err != nil {
+			return nil, err
+		}
+		ip, err := parseSTUNResponse(buf[:n], txID)
+		if err != nil {
+			invalid = err
+			continue
+		}
+		return ip, nil
+	}
+}
+
+// parseSTUNResponse returns the mapped address in a binding response.
+func parseSTUNResponse(b []byte, txID []byte) (net.IP, error) {
+	if len(b) < 20 || binary.BigEndian.Uint16(b[0:]) != stunBindingResponse ||
+		binary.BigEndian.Uint32(b[4:]) != stunMagicCookie || string(b[8:20]) != string(txID) {
+		return nil, errors.New("stun: invalid binding response")
+	}
+	attrs := b[20:]
+	if l := int(binary.BigEndian.Uint16(b[2:])); l <= len(attrs) {
+		attrs = attrs[:l]
+	}
+
+	var mapped net.IP
+	for len(attrs) >= 4 {
+		typ := binary.BigEndian.Uint16(attrs[0:])
+		l := int(binary.BigEndian.Uint16(attrs[2:]))
+		if 4+l > len(attrs) {
+			break
+		}
+		v := attrs[4 : 4+l]
+		switch typ {
+		case stunXORMappedAddr:
+			if ip := parseSTUNAddress(v, b[4:20]); ip != nil {
+				return ip, nil
+			}
+		case stunMappedAddress:
+			mapped = parseSTUNAddress(v, nil)
+		}
+		// Attributes are padded to a multiple of 4 bytes
+		attrs = attrs[4+(l+3)&^3:]
+	}
+	if mapped != nil {
+		return mapped, nil
+	}
+	return nil, errors.New("stun: no mapped address in response")
+}
+
+// parseSTUNAddress parses a (XOR-)MAPPED-ADDRESS attribute. If xor is not nil,
+// it contains the magic cookie and transaction ID which the address is XORed
+// with.
+func parseSTUNAddress(v []byte, xor []byte) net.IP {
+	if len(v) < 4 {
+		return nil
+	}
+	var ipLen int
+	switch v[1] {
+	case 0x01:
+		ipLen = 4
+	case 0x02:
+		ipLen = 16
+	default:
+		return nil
+	}
+	if len(v) < 4+ipLen {
+		return nil
+	}
+	ip := make(net.IP, ipLen)
+	copy(ip, v[4:4+ipLen])
+	for i := range ip {
+		if xor != nil {
+			ip[i] ^= xor[i]
+		}
+	}
+	return ip
+}
+
+// HTTPSource gets the IP from a "what is my IP" HTTP endpoint, which responds
+// with the address of the caller as plain text, such as
+// "https://api.ipify.org".
+type HTTPSource struct {
+	URL    string
+	Family string
+
+	// client is created when first needed, so that connections are reused
+	client     *http.Client
+	clientOnce sync.Once
+}
+
+func (s *HTTPSource) IP(ctx context.Context) (net.IP, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.getClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET request to %s returned unexpected status code: %d", s.URL, res.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(res.Body, 256))
+	if err != nil {
+		return nil, err
+	}
+	ip, err := parseSourceIP(string(body))
+	if err != nil {
+		return nil, err
+	}
+	return checkFamily(ip, s.Family)
+}
+
+// getClient returns the client for the source, which only connects using
+// [HTTPSource.Family].
+func (s *HTTPSource) getClient() *http.Client {
+	s.clientOnce.Do(func() {
+		d := &net.Dialer{}
+		network := familyNetwork("tcp", s.Family)
+		s.client = &http.Client{
+			Timeout: publicSourceTimeout,
+			Transport: &http.Transport{
+				Proxy: http.ProxyFromEnvironment,
+				DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+					return d.DialContext(ctx, network, addr)
+				},
+			},
+		}
+	})
+	return s.client
+}
+
+// DNSSource gets the IP by querying a resolver which answers with the address
+// of the caller, such as "myip.opendns.com" at "resolver1.opendns.com:53" (A
+// or AAAA), or "o-o.myaddr.l.google.com" at "ns1.google.com:53" (TXT).
+type DNSSource struct {
+	// Resolver is the host and port of the DNS server to query.
+	Resolver string
+	Name     string
+
+	// RecordType is "A", "AAAA" or "TXT". If not set, A is used for
+	// [FamilyIPv4] and AAAA for [FamilyIPv6].
+	RecordType string
+	Family     string
+}
+
+func (s *DNSSource) IP(ctx context.Context) (net.IP, error) {
+	rtype := s.RecordType
+	if rtype == "" {
+		rtype = "A"
+		if s.Family == FamilyIPv6 {
+			rtype = "AAAA"
+		}
+	}
+	qtype, ok := dns.StringToType[strings.ToUpper(rtype)]
+	if !ok {
+		return nil, fmt.Errorf("unknown record type: %s", rtype)
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(s.Name), qtype)
+	c := &dns.Client{Net: familyNetwork("udp", s.Family), Timeout: publicSourceTimeout}
+	r, _, err := c.ExchangeContext(ctx, m, s.Resolver)
+	if err != nil {
+		return nil, err
+	}
+	for _, rr := range r.Answer {
+		switch v := rr.(type) {
+		case *dns.A:
+			return checkFamily(v.A, s.Family)
+		case *dns.AAAA:
+			return checkFamily(v.AAAA, s.Family)
+		case *dns.TXT:
+			if len(v.Txt) > 0 {
+				ip, err := parseSourceIP(v.Txt[0])
+				if err != nil {
+					return nil, err
+				}
+				return checkFamily(ip, s.Family)
+			}
+		}
+	}
+	return nil, fmt.Errorf("no %s answer for %s from %s", rtype, s.Name, s.Resolver)
+}
+
+// ConsensusSource queries several sources at once, and only returns an IP
+// if at least Quorum of them agree. This protects against a single source
+// returning a wrong address.
+type ConsensusSource struct {
+	Sources []IPSource
+
+	// Quorum is the number of sources which must agree. If not set, a
+	// majority of the sources is required. With a quorum of half of the
+	// sources or less, it is an error if more than one IP reaches it.
+	Quorum int
+}
+
+func (s *ConsensusSource) IP(ctx context.Context) (net.IP, error) {
+	results := make([]net.IP, len(s.Sources))
+	errs := make([]error, len(s.Sources))
+	wg := sync.WaitGroup{}
+	for i, source := range s.Sources {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = source.IP(ctx)
+		}()
+	}
+	wg.Wait()
+
+	quorum := s.Quorum
+	if quorum <= 0 {
+		quorum = len(s.Sources)/2 + 1
+	}
+	votes := map[string]int{}
+	var agreed []net.IP
+	for i, ip := range results {
+		if errs[i] != nil {
+			continue
+		}
+		votes[ip.String()]++
+		if votes[ip.String()] == quorum {
+			agreed = append(agreed, ip)
+		}
+	}
+	switch len(agreed) {
+	case 0:
+		return nil, fmt.Errorf("no quorum of %d sources agree, got: %v", quorum, consensusSummary(results, errs))
+	case 1:
+		return agreed[0], nil
+	}
+	return nil, fmt.Errorf("more than one ip reached the quorum of %d sources, got: %v", quorum, consensusSummary(results, errs))
+}
+
+func consensusSummary(results []net.IP, errs []error) []string {
+	out := []string{}
+	for i, ip := range results {
+		if errs[i] != nil {
+			out = append(out, errs[i].Error())
+		} else {
+			out = append(out, ip.String())
+		}
+	}
+	return out
+}
+
+// familyNetwork returns the network for family, such as "udp4" for "udp".
+func familyNetwork(network, family string) string {
+	switch family {
+	case FamilyIPv4:
+		return network + "4"
+	case FamilyIPv6:
+		return network + "6"
+	}
+	return network
+}
@@ -0,0 +1,229 @@
+package ddns
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startSTUNServer starts a local STUN server which responds to binding
+// requests with the XOR-MAPPED-ADDRESS of the caller, after ignoring the first
+// drop requests.
+func startSTUNServer(t *testing.T, drop int) string {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n < 20 {
+				continue
+			}
+			if drop > 0 {
+				drop--
+				continue
+			}
+			ip := addr.(*net.UDPAddr).IP.To4()
+			res := make([]byte, 32)
+			binary.BigEndian.PutUint16(res[0:], stunBindingResponse)
+			binary.BigEndian.PutUint16(res[2:], 12)
+			copy(res[4:20], buf[4:20])
+			binary.BigEndian.PutUint16(res[20:], stunXORMappedAddr)
+			binary.BigEndian.PutUint16(res[22:], 8)
+			res[25] = 0x01
+			binary.BigEndian.PutUint16(res[26:], uint16(addr.(*net.UDPAddr).Port)^uint16(stunMagicCookie>>16))
+			for i := range ip {
+				res[28+i] = ip[i] ^ buf[4+i]
+			}
+			// A stray datagram and a response to another transaction
+			// come first, and must be ignored.
+			conn.WriteTo([]byte("stray"), addr)
+			stale := append([]byte(nil), res...)
+			stale[19] ^= 0xff
+			conn.WriteTo(stale, addr)
+			conn.WriteTo(res, addr)
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func TestSTUNSource(t *testing.T) {
+	stunRTO = 10 * time.Millisecond
+
+	// Lost requests are retransmitted
+	for _, drop := range []int{0, 2} {
+		s := &STUNSource{Server: startSTUNServer(t, drop), Family: FamilyIPv4}
+		ip, err := s.IP(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ip.String() != "127.0.0.1" {
+			t.Fatalf(`incorrect ip, got: "%s"`, ip)
+		}
+	}
+
+	s := &STUNSource{Server: startSTUNServer(t, stunMaxRequests), Family: FamilyIPv4}
+	if _, err := s.IP(context.Background()); err == nil {
+		t.Fatalf("expected error when every request is lost")
+	}
+}
+
+func TestParseSTUNResponse(t *testing.T) {
+	txID := []byte("abcdefghijkl")
+	header := func(length int) []byte {
+		b := make([]byte, 20)
+		binary.BigEndian.PutUint16(b[0:], stunBindingResponse)
+		binary.BigEndian.PutUint16(b[2:], uint16(length))
+		binary.BigEndian.PutUint32(b[4:], stunMagicCookie)
+		copy(b[8:], txID)
+		return b
+	}
+
+	// A MAPPED-ADDRESS is used by older servers
+	b := append(header(12), 0, 1, 0, 8, 0, 1, 0, 80, 1, 2, 3, 4)
+	if ip, err := parseSTUNResponse(b, txID); err != nil || ip.String() != "1.2.3.4" {
+		t.Fatalf(`incorrect mapped address, got: "%s", error: %v`, ip, err)
+	}
+
+	invalid := map[string][]byte{
+		"short":          b[:10],
+		"wrong tx id":    append(header(0)[:8], []byte("zzzzzzzzzzzz")...),
+		"no address":     header(0),
+		"truncated attr": append(header(12), 0, 1, 0, 8, 0, 1),
+	}
+	for name, b := range invalid {
+		if _, err := parseSTUNResponse(b, txID); err == nil {
+			t.Fatalf("expected error for %s response", name)
+		}
+	}
+}
+
+func TestHTTPSource(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			fmt.Fprintln(w, "1.2.3.4")
+		case "/ipv6":
+			fmt.Fprintln(w, "2001:db8::1")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	s := &HTTPSource{URL: ts.URL}
+	ip, err := s.IP(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.String() != "1.2.3.4" {
+		t.Fatalf(`incorrect ip, got: "%s"`, ip)
+	}
+
+	s = &HTTPSource{URL: ts.URL + "/missing"}
+	if _, err := s.IP(context.Background()); err == nil {
+		t.Fatalf("expected error for unexpected status code")
+	}
+
+	s = &HTTPSource{URL: ts.URL + "/ipv6", Family: FamilyIPv4}
+	if _, err := s.IP(context.Background()); err == nil {
+		t.Fatalf("expected error for an address of the wrong family")
+	}
+}
+
+func TestDNSSource(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		q := r.Question[0]
+		hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET}
+		switch q.Qtype {
+		case dns.TypeA:
+			m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: net.ParseIP("1.2.3.4")})
+		case dns.TypeTXT:
+			m.Answer = append(m.Answer, &dns.TXT{Hdr: hdr, Txt: []string{"2001:db8::1"}})
+		}
+		w.WriteMsg(m)
+	})}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	tests := map[string]string{
+		"":    "1.2.3.4",
+		"TXT": "2001:db8::1",
+	}
+	for rtype, expected := range tests {
+		s := &DNSSource{Resolver: conn.LocalAddr().String(), Name: "myip.example.com", RecordType: rtype}
+		ip, err := s.IP(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ip.String() != expected {
+			t.Fatalf(`incorrect ip for "%s" query, got: "%s", expected: "%s"`, rtype, ip, expected)
+		}
+	}
+
+	s := &DNSSource{Resolver: conn.LocalAddr().String(), Name: "myip.example.com", RecordType: "AAAA"}
+	if _, err := s.IP(context.Background()); err == nil {
+		t.Fatalf("expected error when there is no answer")
+	}
+
+	s = &DNSSource{Resolver: conn.LocalAddr().String(), Name: "myip.example.com", RecordType: "TXT", Family: FamilyIPv4}
+	if _, err := s.IP(context.Background()); err == nil {
+		t.Fatalf("expected error for an address of the wrong family")
+	}
+}
+
+func TestConsensusSource(t *testing.T) {
+	agree := &CommandSource{Command: "echo 1.2.3.4"}
+	disagree := &CommandSource{Command: "echo 4.3.2.1"}
+	failing := &CommandSource{Command: "exit 1"}
+
+	tests := []struct {
+		sources  []IPSource
+		quorum   int
+		expected string
+	}{
+		{[]IPSource{agree, agree, disagree}, 0, "1.2.3.4"},
+		{[]IPSource{agree, agree, failing}, 0, "1.2.3.4"},
+		{[]IPSource{agree, disagree, failing}, 0, ""},
+		{[]IPSource{agree, failing}, 1, "1.2.3.4"},
+		{[]IPSource{agree, disagree}, 1, ""},
+		{[]IPSource{agree, agree, disagree}, 3, ""},
+	}
+	for i, test := range tests {
+		s := &ConsensusSource{Sources: test.sources, Quorum: test.quorum}
+		ip, err := s.IP(context.Background())
+		if test.expected == "" {
+			if err == nil {
+				t.Fatalf("test %d: expected error, got: %s", i, ip)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("test %d: %v", i, err)
+		}
+		if ip.String() != test.expected {
+			t.Fatalf(`test %d: incorrect ip, got: "%s", expected: "%s"`, i, ip, test.expected)
+		}
+	}
+}
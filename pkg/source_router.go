@@ -0,0 +1,414 @@
+package ddns
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrCGNAT is returned by router sources when the WAN address of the router
+// is private or in the RFC 6598 shared address space. This usually means the
+// ISP uses carrier-grade NAT, and the address can not be reached from the
+// internet, so it is not published.
+var ErrCGNAT = errors.New("the router does not have a public WAN address (carrier-grade NAT?)")
+
+const (
+	// natpmpPort is the port of the NAT-PMP and PCP server on the gateway.
+	natpmpPort = 5351
+
+	// natpmpTimeout is how long to wait for a NAT-PMP or PCP response,
+	// including retransmissions.
+	natpmpTimeout = 2 * time.Second
+
+	// pcpMapLifetime is the lifetime requested for the short-lived mapping
+	// which PCP needs to report the external address.
+	pcpMapLifetime = 60
+)
+
+// NAT-PMP and PCP opcodes and result codes used by [NATPMPSource].
+const (
+	natpmpOpExternalAddress = 0
+	natpmpResultUnsupported = 1
+	pcpVersion              = 2
+	pcpOpMap                = 1
+	pcpResponseBit          = 0x80
+)
+
+// natpmpRTO is the initial retransmission timeout of a NAT-PMP or PCP request
+// (RFC 6886, section 3.1). It doubles after each retransmission.
+var natpmpRTO = 250 * time.Millisecond
+
+// ssdpAddr is where SSDP searches are sent. It is a variable for tests.
+var ssdpAddr = "239.255.255.250:1900"
+
+// ssdpTimeout is how long to wait for SSDP responses.
+const ssdpTimeout = 3 * time.Second
+
+// checkWANAddress returns ip, or [ErrCGNAT] if it is not public.
+func checkWANAddress(ip net.IP) (net.IP, error) {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok || !AddressRange("public").Contains(addr) {
+		return nil, fmt.Errorf("%w: %s", ErrCGNAT, ip)
+	}
+	return ip, nil
+}
+
+// UPnPSource asks the router for its WAN address using the
+// GetExternalIPAddress action of a UPnP Internet Gateway Device. The router
+// is discovered using SSDP, unless DescriptionURL is set. Only IPv4 is
+// supported.
+type UPnPSource struct {
+	// DescriptionURL is the URL of the device description of the router,
+	// such as "http://192.168.1.1:5000/rootDesc.xml".
+	DescriptionURL string
+
+	mu          sync.Mutex
+	controlURL  string
+	serviceType string
+}
+
+// upnpDevice is a device in a UPnP device description.
+type upnpDevice struct {
+	Services []upnpService `xml:"serviceList>service"`
+	Devices  []upnpDevice  `xml:"deviceList>device"`
+}
+
+type upnpService struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+}
+
+// wanService returns the first WANIPConnection or WANPPPConnection service
+// of the device or its embedded devices.
+func (d *upnpDevice) wanService() *upnpService {
+	for i, s := range d.Services {
+		if strings.HasPrefix(s.ServiceType, "urn:schemas-upnp-org:service:WANIPConnection:") ||
+			strings.HasPrefix(s.ServiceType, "urn:schemas-upnp-org:service:WANPPPConnection:") {
+			return &d.Services[i]
+		}
+	}
+	for i := range d.Devices {
+		if s := d.Devices[i].wanService(); s != nil {
+			return s
+		}
+	}
+	return nil
+}
+
+func (s *UPnPSource) IP(ctx context.Context) (net.IP, error) {
+	ctx, cancel := context.WithTimeout(ctx, publicSourceTimeout)
+	defer cancel()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.controlURL == "" {
+		if err := s.discover(ctx); err != nil {
+			return nil, err
+		}
+	}
+	ip, err := s.externalIP(ctx)
+	if err != nil {
+		// The router may have restarted on a different port, so discover it
+		// again next time
+		s.controlURL = ""
+		return nil, err
+	}
+	return checkWANAddress(ip)
+}
+
+// discover finds the control URL of the WAN connection service.
+func (s *UPnPSource) discover(ctx context.Context) error {
+	location := s.DescriptionURL
+	if location == "" {
+		var err error
+		if location, err = ssdpSearch(ctx); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET request to %s returned unexpected status code: %d", location, res.StatusCode)
+	}
+
+	desc := struct {
+		URLBase string     `xml:"URLBase"`
+		Device  upnpDevice `xml:"device"`
+	}{}
+	if err := xml.NewDecoder(res.Body).Decode(&desc); err != nil {
+		return fmt.Errorf("invalid upnp device description: %w", err)
+	}
+	service := desc.Device.wanService()
+	if service == nil {
+		return fmt.Errorf("no WAN connection service in upnp device description: %s", location)
+	}
+
+	base, err := url.Parse(location)
+	if err != nil {
+		return err
+	}
+	if desc.URLBase != "" {
+		if base, err = url.Parse(desc.URLBase); err != nil {
+			return err
+		}
+	}
+	control, err := base.Parse(service.ControlURL)
+	if err != nil {
+		return err
+	}
+	s.controlURL = control.String()
+	s.serviceType = service.ServiceType
+	return nil
+}
+
+// externalIP calls the GetExternalIPAddress action.
+func (s *UPnPSource) externalIP(ctx context.Context) (net.IP, error) {
+	body := `<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body><u:GetExternalIPAddress xmlns:u="` + s.serviceType + `"></u:GetExternalIPAddress></s:Body></s:Envelope>`
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.controlURL, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", `"`+s.serviceType+`#GetExternalIPAddress"`)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upnp GetExternalIPAddress returned unexpected status code: %d", res.StatusCode)
+	}
+
+	envelope := struct {
+		Body struct {
+			Response struct {
+				IP string `xml:"NewExternalIPAddress"`
+			} `xml:",any"`
+		} `xml:"Body"`
+	}{}
+	if err := xml.NewDecoder(res.Body).Decode(&envelope); err != nil {
+		return nil, fmt.Errorf("invalid upnp response: %w", err)
+	}
+	if envelope.Body.Response.IP == "" {
+		return nil, errors.New("the router does not have a WAN address")
+	}
+	return parseSourceIP(envelope.Body.Response.IP)
+}
+
+// ssdpSearch sends an SSDP search for Internet Gateway Devices, and returns
+// the location of the device description of the first one which responds.
+func ssdpSearch(ctx context.Context) (string, error) {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(ssdpTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+
+	addr, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return "", err
+	}
+	search := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: 239.255.255.250:1900\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n" +
+		"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n\r\n"
+	if _, err := conn.WriteTo([]byte(search), addr); err != nil {
+		return "", err
+	}
+
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return "", fmt.Errorf("no upnp gateway found: %w", err)
+		}
+		res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+		res.Body.Close()
+		if location := res.Header.Get("Location"); location != "" {
+			return location, nil
+		}
+	}
+}
+
+// NATPMPSource asks the router for its WAN address using NAT-PMP (RFC
+// 6886), or PCP (RFC 6887) if the router only supports that. Only IPv4 is
+// supported.
+type NATPMPSource struct {
+	// Gateway is the address of the router, optionally with a port. If not
+	// set, the default gateway is used, which is only supported on Linux.
+	Gateway string
+
+	// Watch enables [NATPMPSource.Changes].
+	Watch bool
+}
+
+func (s *NATPMPSource) IP(ctx context.Context) (net.IP, error) {
+	gateway := s.Gateway
+	if gateway == "" {
+		gw, err := defaultGateway()
+		if err != nil {
+			return nil, err
+		}
+		gateway = gw.String()
+	}
+	if _, _, err := net.SplitHostPort(gateway); err != nil {
+		gateway = net.JoinHostPort(gateway, strconv.Itoa(natpmpPort))
+	}
+
+	d := net.Dialer{}
+	conn, err := d.DialContext(ctx, "udp4", gateway)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	ip, err := natpmpExternalAddress(ctx, conn)
+	if errors.Is(err, errors.ErrUnsupported) {
+		ip, err = pcpExternalAddress(ctx, conn)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return checkWANAddress(ip)
+}
+
+// Changes returns a channel which receives a value when the router announces
+// a new WAN address to the local network. NAT-PMP and PCP routers multicast
+// these announcements to 224.0.0.1:5350.
+func (s *NATPMPSource) Changes(ctx context.Context) (<-chan struct{}, error) {
+	if !s.Watch {
+		return nil, nil
+	}
+	return watch(ctx, "nat-pmp", func() (io.ReadCloser, error) {
+		conn, err := net.ListenMulticastUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4allsys, Port: natpmpPort - 1})
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	})
+}
+
+// natpmpExternalAddress sends a NAT-PMP external address request. If the
+// router does not support NAT-PMP, the error wraps [errors.ErrUnsupported].
+func natpmpExternalAddress(ctx context.Context, conn net.Conn) (net.IP, error) {
+	b, err := natpmpExchange(ctx, conn, []byte{0, natpmpOpExternalAddress})
+	if err != nil {
+		return nil, err
+	}
+	if len(b) >= 4 && (b[0] == pcpVersion || binary.BigEndian.Uint16(b[2:]) == natpmpResultUnsupported) {
+		return nil, fmt.Errorf("nat-pmp: %w", errors.ErrUnsupported)
+	}
+	if len(b) < 12 || b[0] != 0 || b[1] != natpmpOpExternalAddress|pcpResponseBit {
+		return nil, errors.New("nat-pmp: invalid response")
+	}
+	if result := binary.BigEndian.Uint16(b[2:]); result != 0 {
+		return nil, fmt.Errorf("nat-pmp: request failed with result code %d", result)
+	}
+	return net.IP(b[8:12]), nil
+}
+
+// pcpExternalAddress sends a PCP MAP request, which reports the external
+// address of the mapping it creates. The short-lived mapping is for the port
+// of conn, and is deleted again once the address is read.
+func pcpExternalAddress(ctx context.Context, conn net.Conn) (net.IP, error) {
+	local := conn.LocalAddr().(*net.UDPAddr)
+	req := make([]byte, 60)
+	req[0] = pcpVersion
+	req[1] = pcpOpMap
+	binary.BigEndian.PutUint32(req[4:], pcpMapLifetime)
+	copy(req[8:24], local.IP.To16())
+	nonce := req[24:36]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	req[36] = 17 // UDP
+	binary.BigEndian.PutUint16(req[40:], uint16(local.Port))
+	// The IPv4-mapped unspecified address asks for an IPv4 external address
+	copy(req[44:60], net.IPv4zero.To16())
+
+	b, err := natpmpExchange(ctx, conn, req)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < 60 || b[0] != pcpVersion || b[1] != pcpOpMap|pcpResponseBit || !bytes.Equal(b[24:36], nonce) {
+		return nil, errors.New("pcp: invalid response")
+	}
+	if b[3] != 0 {
+		return nil, fmt.Errorf("pcp: request failed with result code %d", b[3])
+	}
+	ip := net.IP(b[44:60])
+
+	// A lifetime of 0 with the same nonce deletes the mapping
+	binary.BigEndian.PutUint32(req[4:], 0)
+	if _, err := natpmpExchange(ctx, conn, req); err != nil {
+		slog.Debug("failed to delete pcp mapping", "error", err.Error())
+	}
+
+	if ip.To4() == nil {
+		return nil, fmt.Errorf("pcp: external address is not IPv4: %s", ip)
+	}
+	return ip.To4(), nil
+}
+
+// natpmpExchange sends req and returns the response. The request is
+// retransmitted until a response arrives or natpmpTimeout passes.
+func natpmpExchange(ctx context.Context, conn net.Conn, req []byte) ([]byte, error) {
+	deadline := time.Now().Add(natpmpTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	buf := make([]byte, 1100)
+	for rto := natpmpRTO; ; rto *= 2 {
+		readDeadline := time.Now().Add(rto)
+		if readDeadline.After(deadline) {
+			readDeadline = deadline
+		}
+		conn.SetDeadline(readDeadline)
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		n, err := conn.Read(buf)
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() && ctx.Err() == nil && time.Now().Before(deadline) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("no response from the gateway: %w", err)
+		}
+		return buf[:n], nil
+	}
+}
@@ -0,0 +1,212 @@
+package ddns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testUPnPDescription = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+  <device>
+    <deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+    <deviceList>
+      <device>
+        <deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+        <deviceList>
+          <device>
+            <deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+            <serviceList>
+              <service>
+                <serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+                <controlURL>/ctl/IPConn</controlURL>
+              </service>
+            </serviceList>
+          </device>
+        </deviceList>
+      </device>
+    </deviceList>
+  </device>
+</root>`
+
+// startUPnPGateway starts a local UPnP gateway, which reports wanIP as its
+// external address, and an SSDP responder pointing at it.
+func startUPnPGateway(t *testing.T, wanIP string) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/rootDesc.xml":
+			fmt.Fprint(w, testUPnPDescription)
+		case "/ctl/IPConn":
+			if r.Header.Get("SOAPAction") != `"urn:schemas-upnp-org:service:WANIPConnection:1#GetExternalIPAddress"` {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			fmt.Fprintf(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>`+
+				`<u:GetExternalIPAddressResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1">`+
+				`<NewExternalIPAddress>%s</NewExternalIPAddress></u:GetExternalIPAddressResponse></s:Body></s:Envelope>`, wanIP)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(ts.Close)
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if !strings.HasPrefix(string(buf[:n]), "M-SEARCH") {
+				continue
+			}
+			res := "HTTP/1.1 200 OK\r\nST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\nLOCATION: " + ts.URL + "/rootDesc.xml\r\n\r\n"
+			conn.WriteTo([]byte(res), addr)
+		}
+	}()
+
+	previous := ssdpAddr
+	ssdpAddr = conn.LocalAddr().String()
+	t.Cleanup(func() { ssdpAddr = previous })
+}
+
+func TestUPnPSource(t *testing.T) {
+	startUPnPGateway(t, "1.2.3.4")
+	s := &UPnPSource{}
+	for i := 0; i < 2; i++ {
+		ip, err := s.IP(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ip.String() != "1.2.3.4" {
+			t.Fatalf(`incorrect ip, got: "%s"`, ip)
+		}
+	}
+}
+
+func TestUPnPSourceCGNAT(t *testing.T) {
+	startUPnPGateway(t, "100.64.1.2")
+	if _, err := (&UPnPSource{}).IP(context.Background()); !errors.Is(err, ErrCGNAT) {
+		t.Fatalf("expected carrier-grade NAT error, got: %v", err)
+	}
+}
+
+// startNATPMPGateway starts a local NAT-PMP gateway, which reports wanIP as
+// its external address. If pcpOnly is set, it only supports PCP. The first
+// request is dropped, and the lifetimes of PCP MAP requests are sent to the
+// returned channel.
+func startNATPMPGateway(t *testing.T, wanIP string, pcpOnly bool) (string, <-chan uint32) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	lifetimes := make(chan uint32, 10)
+	go func() {
+		buf := make([]byte, 1100)
+		for dropped := false; ; dropped = true {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if !dropped {
+				continue
+			}
+			var res []byte
+			switch {
+			case n == 2 && buf[0] == 0 && pcpOnly:
+				res = []byte{pcpVersion, pcpResponseBit, 0, 1}
+			case n == 2 && buf[0] == 0:
+				res = make([]byte, 12)
+				res[1] = natpmpOpExternalAddress | pcpResponseBit
+				copy(res[8:], net.ParseIP(wanIP).To4())
+			case n == 60 && buf[0] == pcpVersion && buf[1] == pcpOpMap:
+				res = make([]byte, 60)
+				copy(res, buf[:60])
+				res[1] = pcpOpMap | pcpResponseBit
+				res[3] = 0
+				copy(res[44:], net.ParseIP(wanIP).To16())
+				lifetimes <- binary.BigEndian.Uint32(buf[4:])
+			default:
+				continue
+			}
+			conn.WriteTo(res, addr)
+		}
+	}()
+	return conn.LocalAddr().String(), lifetimes
+}
+
+func TestNATPMPSource(t *testing.T) {
+	natpmpRTO = 10 * time.Millisecond
+
+	// The dropped first request is retransmitted
+	for _, pcpOnly := range []bool{false, true} {
+		gateway, lifetimes := startNATPMPGateway(t, "1.2.3.4", pcpOnly)
+		s := &NATPMPSource{Gateway: gateway}
+		ip, err := s.IP(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ip.String() != "1.2.3.4" {
+			t.Fatalf(`incorrect ip (pcp only: %t), got: "%s"`, pcpOnly, ip)
+		}
+		if pcpOnly {
+			// The mapping is deleted after the address is read
+			if l := <-lifetimes; l != pcpMapLifetime {
+				t.Fatalf("incorrect pcp mapping lifetime, got: %d", l)
+			}
+			if l := <-lifetimes; l != 0 {
+				t.Fatalf("expected pcp mapping to be deleted, got lifetime: %d", l)
+			}
+		}
+	}
+
+	for _, wanIP := range []string{"100.64.1.2", "192.168.1.2"} {
+		gateway, _ := startNATPMPGateway(t, wanIP, false)
+		s := &NATPMPSource{Gateway: gateway}
+		if _, err := s.IP(context.Background()); !errors.Is(err, ErrCGNAT) {
+			t.Fatalf("expected carrier-grade NAT error for %s, got: %v", wanIP, err)
+		}
+	}
+}
+
+func TestParseNATPMPResponse(t *testing.T) {
+	invalid := map[string][]byte{
+		"short":        {0, natpmpOpExternalAddress | pcpResponseBit},
+		"wrong opcode": {0, 1, 0, 0, 0, 0, 0, 0, 1, 2, 3, 4},
+		"failed":       {0, natpmpOpExternalAddress | pcpResponseBit, 0, 3, 0, 0, 0, 0, 1, 2, 3, 4},
+	}
+	for name, res := range invalid {
+		conn := &testPacketConn{res: res}
+		_, err := natpmpExternalAddress(context.Background(), conn)
+		if err == nil || errors.Is(err, errors.ErrUnsupported) {
+			t.Fatalf("expected error for %s response, got: %v", name, err)
+		}
+	}
+}
+
+// testPacketConn is a net.Conn which responds to every write with res.
+type testPacketConn struct {
+	net.Conn
+	res []byte
+}
+
+func (c *testPacketConn) Write(b []byte) (int, error) { return len(b), nil }
+
+func (c *testPacketConn) Read(b []byte) (int, error) {
+	return copy(b, c.res), nil
+}
+
+func (c *testPacketConn) SetDeadline(t time.Time) error { return nil }
@@ -0,0 +1,157 @@
+package ddns
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestCommandSource(t *testing.T) {
+	s := &CommandSource{Command: "echo ' 2001:db8::1'; echo ignored"}
+	ip, err := s.IP(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.String() != "2001:db8::1" {
+		t.Fatalf(`incorrect ip, got: "%s"`, ip)
+	}
+
+	for _, command := range []string{"echo notanip", "exit 1"} {
+		s := &CommandSource{Command: command}
+		if _, err := s.IP(context.Background()); err == nil {
+			t.Fatalf("expected error for command: %s", command)
+		}
+	}
+}
+
+func TestUsableInterfaceAddr(t *testing.T) {
+	tests := []struct {
+		ip       string
+		family   string
+		expected bool
+	}{
+		{"1.2.3.4", FamilyIPv4, true},
+		{"192.168.1.2", FamilyIPv4, true},
+		{"1.2.3.4", FamilyIPv6, false},
+		{"127.0.0.1", FamilyIPv4, false},
+		{"169.254.1.1", FamilyIPv4, false},
+		{"2001:db8::1", FamilyIPv6, true},
+		{"2001:db8::1", FamilyIPv4, false},
+		{"fe80::1", FamilyIPv6, false},
+		{"fd00::1", FamilyIPv6, false},
+		{"::1", FamilyIPv6, false},
+	}
+	for _, test := range tests {
+		if got := usableInterfaceAddr(netip.MustParseAddr(test.ip), test.family); got != test.expected {
+			t.Fatalf("incorrect result for %s (%s), got: %t, expected: %t", test.ip, test.family, got, test.expected)
+		}
+	}
+}
+
+func TestAgentSourceFor(t *testing.T) {
+	a := &Agent{
+		Source: &IPSourceConfig{Type: SourceTypeCommand, Command: "echo 1.2.3.4"},
+		Sources: map[string]*IPSourceConfig{
+			"v6.com": {Type: SourceTypeInterface, Interface: "eth0", Family: FamilyIPv6},
+		},
+	}
+	if s, err := a.sourceFor("home.com"); err != nil {
+		t.Fatal(err)
+	} else if _, ok := s.(*CommandSource); !ok {
+		t.Fatalf("expected the default source, got: %T", s)
+	}
+	if s, err := a.sourceFor("v6.com"); err != nil {
+		t.Fatal(err)
+	} else if s, ok := s.(*InterfaceSource); !ok || s.Family != FamilyIPv6 {
+		t.Fatalf("expected the interface source for the domain, got: %+v", s)
+	}
+	if s, err := (&Agent{}).sourceFor("home.com"); err != nil {
+		t.Fatal(err)
+	} else if _, ok := s.(*ServerSource); !ok {
+		t.Fatalf("expected the server source by default, got: %T", s)
+	}
+
+	// Consensus sources inherit the family
+	a.Source = &IPSourceConfig{Type: SourceTypeConsensus, Family: FamilyIPv6, Sources: []*IPSourceConfig{
+		{Type: SourceTypeSTUN, Server: "stun.example.com:3478"},
+		{Type: SourceTypeHTTP, URL: "https://ip.example.com", Family: FamilyIPv4},
+	}}
+	if s, err := a.sourceFor("home.com"); err != nil {
+		t.Fatal(err)
+	} else if c, ok := s.(*ConsensusSource); !ok || len(c.Sources) != 2 {
+		t.Fatalf("expected a consensus source, got: %+v", s)
+	} else if c.Sources[0].(*STUNSource).Family != FamilyIPv6 || c.Sources[1].(*HTTPSource).Family != FamilyIPv4 {
+		t.Fatalf("incorrect families for consensus sources: %+v", c.Sources)
+	}
+
+	invalid := []*IPSourceConfig{
+		{Type: "unknown"},
+		{Type: SourceTypeInterface},
+		{Type: SourceTypeCommand},
+		{Family: "ipv5"},
+		{Type: SourceTypeSTUN},
+		{Type: SourceTypeHTTP},
+		{Type: SourceTypeDNS, Server: "127.0.0.1:53"},
+		{Type: SourceTypeUPnP, Family: FamilyIPv6},
+		{Type: SourceTypeNATPMP, Family: FamilyIPv6},
+		{Type: SourceTypeConsensus},
+		{Type: SourceTypeConsensus, Quorum: 2, Sources: []*IPSourceConfig{{Type: SourceTypeServer}}},
+		{Type: SourceTypeConsensus, Sources: []*IPSourceConfig{{Type: SourceTypeHTTP}}},
+	}
+	for _, cfg := range invalid {
+		if _, err := (&Agent{Source: cfg}).sourceFor("home.com"); err == nil {
+			t.Fatalf("expected error for source: %+v", cfg)
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	watchRetryDelay = time.Millisecond
+
+	opened := make(chan *io.PipeWriter, 1)
+	open := func() (io.ReadCloser, error) {
+		r, w := io.Pipe()
+		opened <- w
+		return r, nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := watch(ctx, "test", open)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receive := func() {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				t.Fatal("expected the channel to stay open")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("expected a change")
+		}
+	}
+
+	w := <-opened
+	w.Write([]byte("change"))
+	receive()
+
+	// A read error is reported as a change, and the watcher is opened again
+	w.CloseWithError(errors.New("no buffer space available"))
+	receive()
+	w = <-opened
+	w.Write([]byte("change"))
+	receive()
+
+	cancel()
+	select {
+	case _, ok := <-ch:
+		if ok {
+			t.Fatal("expected the channel to be closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the channel to be closed")
+	}
+}
@@ -0,0 +1,155 @@
+package ddns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+)
+
+const (
+	StoreTypeYAML   = "yaml"   // the hosts file, see [YAMLStore]
+	StoreTypeSQLite = "sqlite" // an embedded SQLite database, see [SQLiteStore]
+	StoreTypeBolt   = "bolt"   // an embedded bbolt database, see [BoltStore]
+	StoreTypeMemory = "memory" // no persistence, see [MemoryStore]
+)
+
+// Store persists the domain/IP associations served by the server.
+// Implementations must be safe for concurrent use.
+type Store interface {
+	// Get returns the IP for domain, or nil if there is no record.
+	Get(domain string) (net.IP, error)
+
+	// List returns all records.
+	List() (Domains, error)
+
+	// Put creates or updates the record for domain.
+	Put(domain string, ip net.IP) error
+
+	// Delete removes the record for domain. Deleting a domain which does not
+	// exist is not an error.
+	Delete(domain string) error
+
+	// Watch returns a channel which receives an event for every change made
+	// using the store, until ctx is cancelled. The channel is also closed if
+	// the receiver does not keep up, so that it can watch again and call List
+	// to catch up, instead of missing changes.
+	Watch(ctx context.Context) <-chan StoreEvent
+
+	// Close releases any resources held by the store.
+	Close() error
+}
+
+// StoreEvent describes a change to a record. IP is nil if the record was
+// deleted.
+type StoreEvent struct {
+	Domain string
+	IP     net.IP
+}
+
+// OpenStore opens a store of the given type, which is one of the StoreType
+// constants. The path is ignored by [StoreTypeMemory].
+func OpenStore(storeType, path string) (Store, error) {
+	switch storeType {
+	case StoreTypeYAML, "":
+		return NewYAMLStore(path), nil
+	case StoreTypeSQLite:
+		return OpenSQLiteStore(path)
+	case StoreTypeBolt:
+		return OpenBoltStore(path)
+	case StoreTypeMemory:
+		return NewMemoryStore(), nil
+	}
+	return nil, fmt.Errorf("unknown store type: %s", storeType)
+}
+
+// MemoryStore is a [Store] which does not persist anything.
+type MemoryStore struct {
+	broadcaster
+
+	mu      sync.RWMutex
+	domains Domains
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{domains: Domains{}}
+}
+
+func (m *MemoryStore) Get(domain string) (net.IP, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.domains[domain], nil
+}
+
+func (m *MemoryStore) List() (Domains, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	out := make(Domains, len(m.domains))
+	for k, v := range m.domains {
+		out[k] = v
+	}
+	return out, nil
+}
+
+func (m *MemoryStore) Put(domain string, ip net.IP) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.domains[domain] = ip
+	m.publish(StoreEvent{Domain: domain, IP: ip})
+	return nil
+}
+
+func (m *MemoryStore) Delete(domain string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.domains, domain)
+	m.publish(StoreEvent{Domain: domain})
+	return nil
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
+
+// broadcaster implements [Store.Watch] for stores which only see changes made
+// through themselves.
+type broadcaster struct {
+	mu   sync.Mutex
+	subs map[chan StoreEvent]struct{}
+}
+
+func (b *broadcaster) Watch(ctx context.Context) <-chan StoreEvent {
+	ch := make(chan StoreEvent, 64)
+	b.mu.Lock()
+	if b.subs == nil {
+		b.subs = map[chan StoreEvent]struct{}{}
+	}
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		// The channel is already closed if the receiver fell behind
+		if _, ok := b.subs[ch]; ok {
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}()
+
+	return ch
+}
+
+func (b *broadcaster) publish(e StoreEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
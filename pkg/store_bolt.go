@@ -0,0 +1,106 @@
+package ddns
+
+import (
+	"net"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltBucket is the bucket which holds the records, keyed by domain.
+var boltBucket = []byte("domains")
+
+// BoltStore is a [Store] backed by an embedded bbolt database. Each change
+// only writes the affected record, so it is suited to many domains with
+// frequent updates.
+type BoltStore struct {
+	broadcaster
+
+	db *bolt.DB
+
+	// writeMu serializes writes, so that events are published in the same
+	// order as the changes are committed
+	writeMu sync.Mutex
+}
+
+// OpenBoltStore opens the database at path, creating it if needed.
+func OpenBoltStore(path string) (*BoltStore, error) {
+	if err := mkdirParent(path); err != nil {
+		return nil, err
+	}
+
+	// Fail instead of hanging if another process holds the database lock
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltStore{db: db}, nil
+}
+
+func (b *BoltStore) Get(domain string) (net.IP, error) {
+	var ip net.IP
+	err := b.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(boltBucket).Get([]byte(domain)); v != nil {
+			ip = net.ParseIP(string(v))
+		}
+		return nil
+	})
+	return ip, err
+}
+
+func (b *BoltStore) List() (Domains, error) {
+	out := Domains{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).ForEach(func(k, v []byte) error {
+			out[string(k)] = net.ParseIP(string(v))
+			return nil
+		})
+	})
+	return out, err
+}
+
+func (b *BoltStore) Put(domain string, ip net.IP) error {
+	b.writeMu.Lock()
+	defer b.writeMu.Unlock()
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Put([]byte(domain), []byte(ip.String()))
+	})
+	if err == nil {
+		b.publish(StoreEvent{Domain: domain, IP: ip})
+	}
+	return err
+}
+
+func (b *BoltStore) Delete(domain string) error {
+	b.writeMu.Lock()
+	defer b.writeMu.Unlock()
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Delete([]byte(domain))
+	})
+	if err == nil {
+		b.publish(StoreEvent{Domain: domain})
+	}
+	return err
+}
+
+func (b *BoltStore) Close() error {
+	return b.db.Close()
+}
+
+// mkdirParent creates the parent directories of p if they do not exist.
+func mkdirParent(p string) error {
+	return os.MkdirAll(path.Dir(p), 0755)
+}
@@ -0,0 +1,102 @@
+package ddns
+
+import (
+	"database/sql"
+	"errors"
+	"net"
+	"sync"
+
+	_ "modernc.org/sqlite"
+)
+
+const sqliteSchema = `CREATE TABLE IF NOT EXISTS records (
+	domain TEXT PRIMARY KEY,
+	ip TEXT NOT NULL
+)`
+
+// SQLiteStore is a [Store] backed by an embedded SQLite database. Each change
+// only writes the affected record, so it is suited to many domains with
+// frequent updates.
+type SQLiteStore struct {
+	broadcaster
+
+	db *sql.DB
+
+	// writeMu serializes writes, so that events are published in the same
+	// order as the changes are committed
+	writeMu sync.Mutex
+}
+
+// OpenSQLiteStore opens the database at path, creating it if needed.
+func OpenSQLiteStore(path string) (*SQLiteStore, error) {
+	if err := mkdirParent(path); err != nil {
+		return nil, err
+	}
+
+	dsn := "file:" + path + "?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &SQLiteStore{db: db}, nil
+}
+
+func (s *SQLiteStore) Get(domain string) (net.IP, error) {
+	var ip string
+	err := s.db.QueryRow(`SELECT ip FROM records WHERE domain = ?`, domain).Scan(&ip)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return net.ParseIP(ip), nil
+}
+
+func (s *SQLiteStore) List() (Domains, error) {
+	rows, err := s.db.Query(`SELECT domain, ip FROM records`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := Domains{}
+	for rows.Next() {
+		var domain, ip string
+		if err := rows.Scan(&domain, &ip); err != nil {
+			return nil, err
+		}
+		out[domain] = net.ParseIP(ip)
+	}
+	return out, rows.Err()
+}
+
+func (s *SQLiteStore) Put(domain string, ip net.IP) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	_, err := s.db.Exec(`INSERT INTO records (domain, ip) VALUES (?, ?)
+		ON CONFLICT (domain) DO UPDATE SET ip = excluded.ip`, domain, ip.String())
+	if err == nil {
+		s.publish(StoreEvent{Domain: domain, IP: ip})
+	}
+	return err
+}
+
+func (s *SQLiteStore) Delete(domain string) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	_, err := s.db.Exec(`DELETE FROM records WHERE domain = ?`, domain)
+	if err == nil {
+		s.publish(StoreEvent{Domain: domain})
+	}
+	return err
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,289 @@
+package ddns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStores(t *testing.T) {
+	stores := map[string]func(dir string) (Store, error){
+		StoreTypeMemory: func(string) (Store, error) { return NewMemoryStore(), nil },
+		StoreTypeYAML:   func(dir string) (Store, error) { return NewYAMLStore(filepath.Join(dir, "hosts.yaml")), nil },
+		StoreTypeSQLite: func(dir string) (Store, error) { return OpenSQLiteStore(filepath.Join(dir, "ddns.db")) },
+		StoreTypeBolt:   func(dir string) (Store, error) { return OpenBoltStore(filepath.Join(dir, "ddns.bolt")) },
+	}
+
+	for name, open := range stores {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			st, err := open(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			testStore(t, st)
+			if err := st.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if name == StoreTypeMemory {
+				return
+			}
+
+			// Records should survive reopening the store
+			st, err = open(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer st.Close()
+			if y, ok := st.(*YAMLStore); ok {
+				if err := y.Load(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := st.Get("mydomain.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.Equal(net.ParseIP("2001:db8::1")) {
+				t.Fatalf(`incorrect value after reopening, got: "%s"`, got)
+			}
+		})
+	}
+}
+
+func testStore(t *testing.T, st Store) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := st.Watch(ctx)
+
+	if got, err := st.Get("mydomain.com"); err != nil || got != nil {
+		t.Fatalf(`expected no record, got: "%s", error: %v`, got, err)
+	}
+
+	puts := map[string]net.IP{
+		"mydomain.com":      net.ParseIP("1.2.3.4"),
+		"myotherdomain.com": net.ParseIP("4.3.2.1"),
+	}
+	for domain, ip := range puts {
+		if err := st.Put(domain, ip); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := st.Put("mydomain.com", net.ParseIP("2001:db8::1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Delete("myotherdomain.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Delete("missing.com"); err != nil {
+		t.Fatalf("deleting a missing domain should not fail: %v", err)
+	}
+
+	all, err := st.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 1 || !all["mydomain.com"].Equal(net.ParseIP("2001:db8::1")) {
+		t.Fatalf("incorrect records: %v", all)
+	}
+
+	// 2 puts, 1 overwrite and 2 deletes
+	for i := 0; i < 5; i++ {
+		select {
+		case <-events:
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for event %d", i)
+		}
+	}
+	cancel()
+	for range events {
+	}
+}
+
+func TestYAMLStoreBackups(t *testing.T) {
+	hostsFile := filepath.Join(t.TempDir(), "hosts.yaml")
+	st := NewYAMLStore(hostsFile)
+	st.Backups = 2
+	for i := 1; i <= 4; i++ {
+		if err := st.Put("mydomain.com", net.IPv4(1, 1, 1, byte(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only the requested number of backups are kept
+	for i, expected := range map[int]string{1: "1.1.1.3", 2: "1.1.1.2"} {
+		domains, err := readHostsFile(backupName(hostsFile, i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := domains["mydomain.com"]; !got.Equal(net.ParseIP(expected)) {
+			t.Fatalf(`incorrect value in backup %d, got: "%s", expected: "%s"`, i, got, expected)
+		}
+	}
+	if _, err := os.Stat(backupName(hostsFile, 3)); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("too many backups were kept")
+	}
+
+	// A truncated hosts file falls back to the newest backup
+	if err := os.WriteFile(hostsFile, []byte("mydomain.com: [1.1."), 0644); err != nil {
+		t.Fatal(err)
+	}
+	st = NewYAMLStore(hostsFile)
+	st.Backups = 2
+	if err := st.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := st.Get("mydomain.com"); !got.Equal(net.ParseIP("1.1.1.3")) {
+		t.Fatalf(`incorrect value loaded from backup, got: "%s"`, got)
+	}
+
+	// The corrupt file does not replace the good backup on the next write
+	if err := st.Put("mydomain.com", net.ParseIP("1.1.1.5")); err != nil {
+		t.Fatal(err)
+	}
+	domains, err := readHostsFile(backupName(hostsFile, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := domains["mydomain.com"]; !got.Equal(net.ParseIP("1.1.1.3")) {
+		t.Fatalf(`incorrect value in backup after recovery, got: "%s"`, got)
+	}
+}
+
+func TestYAMLStoreReload(t *testing.T) {
+	hostsFile := filepath.Join(t.TempDir(), "hosts.yaml")
+	st := NewYAMLStore(hostsFile)
+	st.Put("keep.com", net.ParseIP("1.1.1.1"))
+	st.Put("change.com", net.ParseIP("1.1.1.2"))
+	st.Put("remove.com", net.ParseIP("1.1.1.3"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := st.Watch(ctx)
+
+	edited := "keep.com: 1.1.1.1\nchange.com: 2.2.2.2\nadd.com: 3.3.3.3\n"
+	if err := os.WriteFile(hostsFile, []byte(edited), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"keep.com":   "1.1.1.1",
+		"change.com": "2.2.2.2",
+		"add.com":    "3.3.3.3",
+		"remove.com": "<nil>",
+	}
+	for domain, ip := range expected {
+		got, _ := st.Get(domain)
+		if got.String() != ip {
+			t.Fatalf(`incorrect value for %s after reload, got: "%s", expected: "%s"`, domain, got, ip)
+		}
+	}
+
+	// Only the changed records are published
+	got := map[string]string{}
+	for len(got) < 3 {
+		select {
+		case e := <-events:
+			got[e.Domain] = e.IP.String()
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for events, got: %v", got)
+		}
+	}
+	if _, ok := got["keep.com"]; ok {
+		t.Fatalf("unexpected event for unchanged record")
+	}
+
+	// Invalid content keeps the current records
+	if err := os.WriteFile(hostsFile, []byte("keep.com: [1.1."), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Reload(); err == nil {
+		t.Fatalf("expected error for invalid hosts file")
+	}
+	if got, _ := st.Get("add.com"); !got.Equal(net.ParseIP("3.3.3.3")) {
+		t.Fatalf(`records changed after invalid reload, got: "%s"`, got)
+	}
+}
+
+func TestYAMLStoreWriteFailure(t *testing.T) {
+	dir := t.TempDir()
+	hostsFile := filepath.Join(dir, "hosts.yaml")
+	st := NewYAMLStore(hostsFile)
+	st.Put("home.com", net.ParseIP("1.1.1.1"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := st.Watch(ctx)
+
+	// The hosts file can not be replaced while it is a directory
+	os.Remove(hostsFile)
+	if err := os.Mkdir(hostsFile, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Put("home.com", net.ParseIP("2.2.2.2")); err == nil {
+		t.Fatal("expected the write to fail")
+	}
+	if err := st.Delete("home.com"); err == nil {
+		t.Fatal("expected the write to fail")
+	}
+
+	// The records in memory still match the last successful write
+	if got, _ := st.Get("home.com"); !got.Equal(net.ParseIP("1.1.1.1")) {
+		t.Fatalf("incorrect value after a failed write, got: %s", got)
+	}
+	select {
+	case e := <-events:
+		t.Fatalf("expected no events for failed writes, got: %+v", e)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestYAMLStoreReloadOwnWrites(t *testing.T) {
+	hostsFile := filepath.Join(t.TempDir(), "hosts.yaml")
+	st := NewYAMLStore(hostsFile)
+	st.Put("home.com", net.ParseIP("1.1.1.1"))
+
+	if changed, err := st.reload(); err != nil || changed {
+		t.Fatalf("expected the store's own write to be ignored, got: %v, %v", changed, err)
+	}
+
+	if err := os.WriteFile(hostsFile, []byte("home.com: 2.2.2.2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := st.reload(); err != nil || !changed {
+		t.Fatalf("expected the edited hosts file to be reloaded, got: %v, %v", changed, err)
+	}
+	if got, _ := st.Get("home.com"); !got.Equal(net.ParseIP("2.2.2.2")) {
+		t.Fatalf("incorrect value after reload: %s", got)
+	}
+}
+
+func TestStoreWatchOverflow(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	st := NewMemoryStore()
+	events := st.Watch(ctx)
+	for i := 0; i < 100; i++ {
+		if err := st.Put("mydomain.com", net.IPv4(10, 0, 0, byte(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The receiver fell behind, so the channel is closed after the buffered
+	// events instead of dropping the rest
+	n := 0
+	for range events {
+		n++
+	}
+	if n != 64 {
+		t.Fatalf("expected 64 buffered events, got: %d", n)
+	}
+	cancel()
+}
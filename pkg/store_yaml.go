@@ -0,0 +1,291 @@
+package ddns
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultHostsFileBackups is the number of previous versions of the hosts file
+// which are kept by default.
+const DefaultHostsFileBackups = 3
+
+// YAMLStore is a [Store] which saves all records to a YAML hosts file, mapping
+// each domain to its IP. The whole file is rewritten on every change, so it is
+// best suited to a small number of domains. The file is replaced atomically,
+// and previous versions are kept as backups.
+//
+// Reads use an immutable snapshot of the records, so they never wait for a
+// write to the hosts file. Writes are serialized.
+type YAMLStore struct {
+	broadcaster
+
+	// Backups is the number of previous versions of the hosts file to keep, as
+	// "<path>.1.bak" (the newest) and so on. If zero,
+	// [DefaultHostsFileBackups] is used. A negative value disables backups.
+	Backups int
+
+	path string
+
+	// domains is the current snapshot of the records. It is replaced, never
+	// modified, while holding mu.
+	domains atomic.Pointer[Domains]
+
+	// mu serializes changes to the records and writes to the hosts file.
+	mu sync.Mutex
+
+	// corrupt is set when the hosts file could not be loaded, so that it does
+	// not replace a good backup on the next write.
+	corrupt bool
+
+	// hash is the SHA-256 of the hosts file when it was last written or read,
+	// so that the store's own writes do not trigger a reload.
+	hash [sha256.Size]byte
+}
+
+// NewYAMLStore returns a store which uses the hosts file at path. The file is
+// not read until [YAMLStore.Load] is called, and is created when the first
+// change is made.
+func NewYAMLStore(path string) *YAMLStore {
+	y := &YAMLStore{path: path}
+	y.domains.Store(&Domains{})
+	return y
+}
+
+// snapshot returns the current records, which must not be modified.
+func (y *YAMLStore) snapshot() Domains {
+	return *y.domains.Load()
+}
+
+// update applies fn to a copy of the records, then makes the copy the current
+// snapshot. The caller must hold the lock.
+func (y *YAMLStore) update(fn func(Domains)) {
+	next := y.next(fn)
+	y.domains.Store(&next)
+}
+
+// change is like update, but first writes the changed records to the hosts
+// file. If the write fails, the snapshot is left unchanged. The caller must
+// hold the lock.
+func (y *YAMLStore) change(fn func(Domains)) error {
+	next := y.next(fn)
+	if err := y.write(next); err != nil {
+		return err
+	}
+	y.domains.Store(&next)
+	return nil
+}
+
+// next returns a copy of the records with fn applied.
+func (y *YAMLStore) next(fn func(Domains)) Domains {
+	current := y.snapshot()
+	next := make(Domains, len(current))
+	for k, v := range current {
+		next[k] = v
+	}
+	fn(next)
+	return next
+}
+
+// Load merges the records from the hosts file, if it exists, into the store.
+// If the hosts file cannot be read or parsed, the newest valid backup is used
+// instead.
+func (y *YAMLStore) Load() error {
+	b, err := os.ReadFile(y.path)
+	var domains Domains
+	if err == nil {
+		domains, err = parseHostsFile(b)
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		slog.Info("hosts file does not exist", "path", y.path)
+		return nil
+	}
+	if err != nil {
+		slog.Error("HOSTS FILE IS CORRUPT, trying backups", "path", y.path, "error", err.Error())
+		backup, backupDomains, backupErr := y.readNewestBackup()
+		if backupErr != nil {
+			y.mu.Lock()
+			y.corrupt = true
+			y.mu.Unlock()
+			return errors.Join(err, backupErr)
+		}
+		slog.Warn("LOADED DOMAINS FROM BACKUP HOSTS FILE, recent changes may be missing", "path", backup)
+		domains = backupDomains
+	} else {
+		slog.Info("loaded domains from hosts file", "path", y.path)
+	}
+
+	y.mu.Lock()
+	defer y.mu.Unlock()
+	y.corrupt = err != nil
+	if err == nil {
+		y.hash = sha256.Sum256(b)
+	}
+	y.update(func(d Domains) {
+		for k, v := range domains {
+			d[k] = v
+		}
+	})
+	return nil
+}
+
+// Reload replaces the records in the store with the contents of the hosts
+// file, which may have been changed by hand. If the file is missing or cannot
+// be parsed, the current records are kept. An event is published for each
+// record which changed.
+func (y *YAMLStore) Reload() error {
+	_, err := y.reload()
+	return err
+}
+
+// reload is like Reload, but does nothing if the hosts file is the same as
+// when it was last written or read, and returns false in that case.
+func (y *YAMLStore) reload() (bool, error) {
+	// Read while holding the lock, so that a concurrent write is not undone
+	y.mu.Lock()
+	defer y.mu.Unlock()
+	b, err := os.ReadFile(y.path)
+	if err != nil {
+		return false, err
+	}
+	hash := sha256.Sum256(b)
+	if hash == y.hash {
+		return false, nil
+	}
+	domains, err := parseHostsFile(b)
+	if err != nil {
+		return false, err
+	}
+
+	current := y.snapshot()
+	y.domains.Store(&domains)
+	y.corrupt = false
+	y.hash = hash
+
+	for k, v := range domains {
+		if !v.Equal(current[k]) {
+			y.publish(StoreEvent{Domain: k, IP: v})
+		}
+	}
+	for k := range current {
+		if _, ok := domains[k]; !ok {
+			y.publish(StoreEvent{Domain: k})
+		}
+	}
+	return true, nil
+}
+
+// readNewestBackup returns the contents of the newest backup of the hosts file
+// which can be parsed.
+func (y *YAMLStore) readNewestBackup() (string, Domains, error) {
+	for i := 1; i <= y.getBackups(); i++ {
+		p := backupName(y.path, i)
+		domains, err := readHostsFile(p)
+		if err == nil {
+			return p, domains, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.Error("backup hosts file is corrupt", "path", p, "error", err.Error())
+		}
+	}
+	return "", nil, fmt.Errorf("no valid backup of hosts file: %s", y.path)
+}
+
+func readHostsFile(p string) (Domains, error) {
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	return parseHostsFile(b)
+}
+
+func parseHostsFile(b []byte) (Domains, error) {
+	domains := Domains{}
+	if err := yaml.Unmarshal(b, &domains); err != nil {
+		return nil, err
+	}
+	return domains, nil
+}
+
+func (y *YAMLStore) Get(domain string) (net.IP, error) {
+	return y.snapshot()[domain], nil
+}
+
+func (y *YAMLStore) List() (Domains, error) {
+	current := y.snapshot()
+	out := make(Domains, len(current))
+	for k, v := range current {
+		out[k] = v
+	}
+	return out, nil
+}
+
+func (y *YAMLStore) Put(domain string, ip net.IP) error {
+	y.mu.Lock()
+	defer y.mu.Unlock()
+	if err := y.change(func(d Domains) { d[domain] = ip }); err != nil {
+		return err
+	}
+	y.publish(StoreEvent{Domain: domain, IP: ip})
+	return nil
+}
+
+func (y *YAMLStore) Delete(domain string) error {
+	y.mu.Lock()
+	defer y.mu.Unlock()
+	if err := y.change(func(d Domains) { delete(d, domain) }); err != nil {
+		return err
+	}
+	y.publish(StoreEvent{Domain: domain})
+	return nil
+}
+
+func (y *YAMLStore) Close() error {
+	return nil
+}
+
+// write saves domains to the hosts file. The caller must hold the lock.
+func (y *YAMLStore) write(domains Domains) error {
+	b, err := yaml.Marshal(domains)
+	if err != nil {
+		return err
+	}
+
+	// Try to create parent directories if needed
+	hostsDir := path.Dir(y.path)
+	if _, err := os.Stat(hostsDir); errors.Is(err, os.ErrNotExist) {
+		slog.Info("creating directory for hosts file", "path", hostsDir)
+		if err := os.MkdirAll(hostsDir, 0755); err != nil {
+			return err
+		}
+	}
+
+	if !y.corrupt {
+		if err := rotateBackups(y.path, y.getBackups()); err != nil {
+			// Losing a backup is better than losing the change
+			slog.Error("failed to back up hosts file", "path", y.path, "error", err.Error())
+		}
+	}
+
+	if err := writeFileAtomic(y.path, b, 0644); err != nil {
+		return err
+	}
+	y.corrupt = false
+	y.hash = sha256.Sum256(b)
+	return nil
+}
+
+func (y *YAMLStore) getBackups() int {
+	if y.Backups == 0 {
+		return DefaultHostsFileBackups
+	}
+	return y.Backups
+}
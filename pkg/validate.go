@@ -0,0 +1,284 @@
+package ddns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+)
+
+// Validate checks the settings of the server which are otherwise only checked
+// once it is running, such as the listeners and the files it reads and
+// writes. It returns an error for every setting which is invalid, and a
+// warning for every setting which is insecure.
+func (s *Server) Validate() (warnings []string, err error) {
+	errs := []error{}
+	check := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	warn := func(format string, args ...any) {
+		warnings = append(warnings, fmt.Sprintf(format, args...))
+	}
+
+	check(validateListener("HTTPListener", s.getHTTPListener()))
+	check(validateListener("DNSListener", s.getDNSListener()))
+
+	// The store, as in Server.getStore()
+	storeType := s.StoreType
+	if storeType == "" && s.HostsFile != "" {
+		storeType = StoreTypeYAML
+	}
+	switch storeType {
+	case StoreTypeYAML:
+		if s.HostsFile == "" {
+			check(errors.New("HostsFile: required for the yaml store"))
+		}
+		check(checkWritable("HostsFile", s.HostsFile))
+	case StoreTypeSQLite, StoreTypeBolt:
+		if s.StorePath == "" {
+			check(fmt.Errorf("StorePath: required for the %s store", storeType))
+		}
+		check(checkWritable("StorePath", s.StorePath))
+	case "", StoreTypeMemory:
+	default:
+		check(fmt.Errorf("StoreType: unknown store type: %s", s.StoreType))
+	}
+	check(checkWritable("KeysFile", s.getKeysFile()))
+	check(checkWritable("AuditLogFile", s.getAuditLogFile()))
+	check(checkWritable("WebhookDeadLetterFile", s.getWebhookDeadLetterFile()))
+	if worldReadable(s.getKeysFile()) {
+		warn("KeysFile: %s can be read by any user", s.getKeysFile())
+	}
+
+	if (s.TLSCertFile == "") != (s.TLSKeyFile == "") {
+		check(errors.New("TLSCertFile: both a TLS certificate and key are required"))
+	}
+	check(checkReadable("TLSCertFile", s.TLSCertFile))
+	check(checkReadable("TLSKeyFile", s.TLSKeyFile))
+	if worldReadable(s.TLSKeyFile) {
+		warn("TLSKeyFile: %s can be read by any user", s.TLSKeyFile)
+	}
+	if s.ACME != nil {
+		if len(s.ACME.Domains) == 0 {
+			check(errors.New("ACME: no domains configured"))
+		}
+		check(checkWritable("ACME.CacheDir", s.ACME.CacheDir))
+	}
+
+	for _, w := range s.Webhooks {
+		check(validateURL("Webhooks", w.URL))
+	}
+
+	keys := []string{}
+	for key := range s.AllowedAPIKeys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		warn("AllowedAPIKeys: %s is a plaintext API key, prefer hashed keys (see \"ddns keys generate\")", plaintextKeyID(key))
+		if s.AllowedAPIKeys[key] == nil {
+			warn("AllowedAPIKeys: %s may update any domain", plaintextKeyID(key))
+		}
+	}
+	for _, k := range s.APIKeys {
+		if k.Domains == nil && k.Policy == nil && !k.Admin && !k.Disabled {
+			warn("APIKeys: %s may update any domain", k.ID)
+		}
+	}
+
+	for _, p := range s.TrustedProxies {
+		switch {
+		case p.Bits() == 0:
+			warn("TrustedProxies: %s trusts the proxy headers sent by any client, which can then choose their IP", p)
+		case AddressRange("public").Contains(p.Addr()):
+			warn("TrustedProxies: %s is a public range, so clients in it can choose their IP using proxy headers", p)
+		}
+	}
+	if s.ProxyProtocol && len(s.TrustedProxies) == 0 {
+		warn("ProxyProtocol: has no effect without TrustedProxies")
+	}
+
+	return warnings, errors.Join(errs...)
+}
+
+// Validate checks the settings of the agent which are otherwise only checked
+// once it is running, such as its IP sources, hooks and jobs. It returns an
+// error for every setting which is invalid, and a warning for every setting
+// which is insecure.
+func (a *Agent) Validate() (warnings []string, err error) {
+	errs := []error{}
+	check := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if _, err := a.getServerMode(); err != nil {
+		check(fmt.Errorf("ServerMode: %w", err))
+	}
+	for _, server := range a.servers() {
+		check(validateURL("ServerAddress", server))
+		u, err := url.Parse(server)
+		if err == nil && u.Scheme == "http" && a.APIKey != "" && !isLoopback(u.Hostname()) {
+			warnings = append(warnings, fmt.Sprintf("ServerAddress: the API key is sent to %s without TLS", server))
+		}
+	}
+
+	check(checkReadable("CAFile", a.CAFile))
+	check(checkReadable("ClientCertFile", a.ClientCertFile))
+	check(checkReadable("ClientKeyFile", a.ClientKeyFile))
+	if a.Proxy != "" {
+		check(validateURL("Proxy", a.Proxy))
+	}
+	if a.StatusListener != "" {
+		check(validateListener("StatusListener", a.StatusListener))
+	}
+	check(checkWritable("StateFile", a.StateFile))
+
+	for _, h := range a.Hooks {
+		check(h.validate())
+	}
+	if _, err := a.Source.orDefault().source(a); err != nil {
+		check(fmt.Errorf("Source: %w", err))
+	}
+	domains := []string{}
+	for domain := range a.Sources {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	for _, domain := range domains {
+		if _, err := a.Sources[domain].orDefault().source(a); err != nil {
+			check(fmt.Errorf("Sources: %s: %w", domain, err))
+		}
+	}
+	for i, job := range a.Jobs {
+		if _, err := a.jobAgent(job); err != nil {
+			check(fmt.Errorf("Jobs: job %d: %w", i+1, err))
+		}
+	}
+
+	return warnings, errors.Join(errs...)
+}
+
+// orDefault returns c, or the default config if c is nil.
+func (c *IPSourceConfig) orDefault() *IPSourceConfig {
+	if c == nil {
+		return &IPSourceConfig{}
+	}
+	return c
+}
+
+// validateListener returns an error unless addr is a host and port to listen
+// on.
+func validateListener(name, addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Errorf("%s: invalid port: %s", name, port)
+	}
+	return nil
+}
+
+// validateURL returns an error unless u is an absolute HTTP or HTTPS URL.
+func validateURL(name, u string) error {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("%s: not an http or https URL: %s", name, u)
+	}
+	return nil
+}
+
+// checkReadable returns an error if the file at path can not be read. An
+// empty path is not checked.
+func checkReadable(name, path string) error {
+	if path == "" {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return f.Close()
+}
+
+// checkWritable returns an error if the file at path can not be written, or
+// created if it does not exist, along with any missing directories. An empty
+// path is not checked.
+func checkWritable(name, path string) error {
+	if path == "" {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err == nil && info.IsDir() {
+		// Directories, such as the ACME cache, must allow creating files
+		return checkDirWritable(name, path)
+	}
+	if err == nil {
+		f, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		return f.Close()
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return checkDirWritable(name, filepath.Dir(path))
+}
+
+// checkDirWritable returns an error if files can not be created in dir. If dir
+// does not exist, it is created when needed, so its nearest existing parent is
+// checked instead.
+func checkDirWritable(name, dir string) error {
+	for {
+		info, err := os.Stat(dir)
+		if err == nil && !info.IsDir() {
+			return fmt.Errorf("%s: %s is not a directory", name, dir)
+		}
+		if err == nil {
+			break
+		}
+		parent := filepath.Dir(dir)
+		if !errors.Is(err, os.ErrNotExist) || parent == dir {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		dir = parent
+	}
+	f, err := os.CreateTemp(dir, ".ddns-validate-*")
+	if err != nil {
+		return fmt.Errorf("%s: can not create files in %s", name, dir)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// worldReadable returns true if the file at path can be read by any user.
+func worldReadable(path string) bool {
+	if path == "" || runtime.GOOS == "windows" {
+		return false
+	}
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().Perm()&0o004 != 0
+}
+
+// isLoopback returns true if host is localhost or a loopback address.
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	addr, err := netip.ParseAddr(host)
+	return err == nil && addr.IsLoopback()
+}
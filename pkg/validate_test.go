@@ -0,0 +1,113 @@
+package ddns
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestServerValidate(t *testing.T) {
+	dir := t.TempDir()
+	s := &Server{
+		HostsFile:      filepath.Join(dir, "hosts.yaml"),
+		AllowedAPIKeys: APIKeyMatcher{"plaintextkey": nil},
+		TrustedProxies: []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0")},
+	}
+	warnings, err := s.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"AllowedAPIKeys: " + plaintextKeyID("plaintextkey") + " is a plaintext API key",
+		"AllowedAPIKeys: " + plaintextKeyID("plaintextkey") + " may update any domain",
+		"TrustedProxies: 0.0.0.0/0 trusts the proxy headers sent by any client",
+	}
+	if len(warnings) != len(expected) {
+		t.Fatalf("expected %d warnings, got: %v", len(expected), warnings)
+	}
+	for i, w := range expected {
+		if !strings.HasPrefix(warnings[i], w) {
+			t.Errorf("expected warning %q, got: %q", w, warnings[i])
+		}
+	}
+
+	s = &Server{
+		HTTPListener: "localhost",
+		DNSListener:  ":99999",
+		StoreType:    StoreTypeSQLite,
+		HostsFile:    filepath.Join(dir, "missing", "hosts.yaml"),
+		TLSCertFile:  filepath.Join(dir, "cert.pem"),
+	}
+	_, err = s.Validate()
+	if err == nil {
+		t.Fatal("expected errors")
+	}
+	for _, name := range []string{"HTTPListener", "DNSListener", "StorePath", "TLSCertFile"} {
+		if !strings.Contains(err.Error(), name+":") {
+			t.Errorf("expected an error for %s, got: %v", name, err)
+		}
+	}
+}
+
+func TestAgentValidate(t *testing.T) {
+	dir := t.TempDir()
+	a := &Agent{
+		ServerAddress: "http://ddns.example.com",
+		APIKey:        "key",
+		StateFile:     filepath.Join(dir, "state.json"),
+	}
+	warnings, err := a.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "without TLS") {
+		t.Fatalf("expected a warning for the API key sent without TLS, got: %v", warnings)
+	}
+
+	// The API key is not sent over the network to localhost
+	a.ServerAddress = "http://localhost:8080"
+	if warnings, _ := a.Validate(); len(warnings) != 0 {
+		t.Fatalf("expected no warnings, got: %v", warnings)
+	}
+
+	a = &Agent{
+		ServerAddress:  "ddns.example.com",
+		CAFile:         filepath.Join(dir, "ca.pem"),
+		StatusListener: "localhost",
+		Source:         &IPSourceConfig{Type: "unknown"},
+		Hooks:          []*AgentHook{{}},
+	}
+	_, err = a.Validate()
+	if err == nil {
+		t.Fatal("expected errors")
+	}
+	for _, name := range []string{"ServerAddress", "CAFile", "StatusListener", "Source"} {
+		if !strings.Contains(err.Error(), name+":") {
+			t.Errorf("expected an error for %s, got: %v", name, err)
+		}
+	}
+}
+
+func TestCheckWritable(t *testing.T) {
+	dir := t.TempDir()
+	if err := checkWritable("File", filepath.Join(dir, "new.txt")); err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Fatalf("expected the check to leave no files behind, got: %v", entries)
+	}
+
+	// Missing directories are created when needed
+	if err := checkWritable("File", filepath.Join(dir, "missing", "new.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkWritable("File", filepath.Join(dir, "file", "new.txt")); err == nil {
+		t.Fatal("expected an error for a parent which is not a directory")
+	}
+}
@@ -0,0 +1,235 @@
+package ddns
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"path"
+	"regexp"
+	"time"
+)
+
+// DefaultWebhookDeadLetterFileName is the name of the dead letter log when
+// [Server.WebhookDeadLetterFile] is not set. It is stored in the same
+// directory as the hosts file or database.
+const DefaultWebhookDeadLetterFileName = "webhooks-failed.jsonl"
+
+// DefaultWebhookMaxAttempts is the number of times a delivery is attempted by
+// default before it is written to the dead letter log.
+const DefaultWebhookMaxAttempts = 5
+
+// WebhookSignatureHeader contains the HMAC-SHA256 of the request body, keyed
+// with [Webhook.Secret], as "sha256=<hex>".
+const WebhookSignatureHeader = "X-Ddns-Signature"
+
+// webhookTimeout is how long to wait for a response to each delivery attempt.
+const webhookTimeout = 10 * time.Second
+
+// webhookClient is shared by all deliveries, so that connections are reused.
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// webhookRetryDelay is the delay before the first retry. It doubles after each
+// failed attempt.
+var webhookRetryDelay = time.Second
+
+// The event in a [WebhookPayload].
+const (
+	WebhookEventUpdated = "updated" // a record was created or changed
+	WebhookEventDeleted = "deleted" // a record was deleted
+)
+
+// Webhook is an HTTP endpoint which receives a POST request with a
+// [WebhookPayload] after each change to a record made using the API.
+// Deliveries are made in the background, so they may arrive out of order.
+type Webhook struct {
+	URL string
+
+	// Secret, if set, is used to sign each request. See
+	// [WebhookSignatureHeader].
+	Secret string
+
+	// Domains, if set, must match the domain for the webhook to be called.
+	Domains *regexp.Regexp
+
+	// MaxAttempts is the number of times a delivery is attempted before it is
+	// written to the dead letter log. If zero, [DefaultWebhookMaxAttempts] is
+	// used.
+	MaxAttempts int
+}
+
+// WebhookPayload is the body of a webhook request.
+type WebhookPayload struct {
+	Event  string    `json:"event"`
+	Domain string    `json:"domain"`
+	OldIP  net.IP    `json:"old,omitempty"`
+	NewIP  net.IP    `json:"new,omitempty"`
+	KeyID  string    `json:"key"`
+	Time   time.Time `json:"time"`
+}
+
+// WebhookDeadLetter is written to the dead letter log for a delivery which
+// failed every attempt.
+type WebhookDeadLetter struct {
+	Time     time.Time      `json:"time"`
+	URL      string         `json:"url"`
+	Attempts int            `json:"attempts"`
+	Error    string         `json:"error"`
+	Payload  WebhookPayload `json:"payload"`
+}
+
+// Sign returns the value of the [WebhookSignatureHeader] for body.
+func (wh *Webhook) Sign(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(wh.Secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliver sends the payload, retrying with exponential backoff. The error of
+// the last attempt is returned if every attempt fails, or if ctx is done while
+// waiting to retry.
+func (wh *Webhook) deliver(ctx context.Context, p WebhookPayload) (attempts int, err error) {
+	body, err := json.Marshal(p)
+	if err != nil {
+		return 0, err
+	}
+
+	maxAttempts := wh.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultWebhookMaxAttempts
+	}
+	delay := webhookRetryDelay
+	for attempts = 1; ; attempts++ {
+		if err = wh.send(body); err == nil {
+			return attempts, nil
+		}
+		if attempts == maxAttempts {
+			return attempts, err
+		}
+		slog.Warn("webhook delivery failed, retrying", "url", wh.URL, "attempt", attempts, "error", err.Error())
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return attempts, fmt.Errorf("stopped before retrying: %w", err)
+		}
+		delay *= 2
+	}
+}
+
+func (wh *Webhook) send(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, wh.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if wh.Secret != "" {
+		req.Header.Set(WebhookSignatureHeader, wh.Sign(body))
+	}
+	res, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("POST request to %s returned unexpected status code: %d", wh.URL, res.StatusCode)
+	}
+	return nil
+}
+
+// notify calls the webhooks which match the domain in the background.
+func (s *Server) notify(key *APIKey, event, domain string, oldIP, newIP net.IP) {
+	p := WebhookPayload{
+		Event:  event,
+		Domain: domain,
+		OldIP:  oldIP,
+		NewIP:  newIP,
+		KeyID:  key.ID,
+		Time:   time.Now().UTC(),
+	}
+
+	s.configMu.RLock()
+	webhooks := s.Webhooks
+	s.configMu.RUnlock()
+	for _, wh := range webhooks {
+		if wh.Domains != nil && !wh.Domains.MatchString(domain) {
+			continue
+		}
+		s.webhookWG.Add(1)
+		go func() {
+			defer s.webhookWG.Done()
+			attempts, err := wh.deliver(s.getWebhookCtx(), p)
+			if err != nil {
+				slog.Error("webhook delivery failed, writing to dead letter log", "url", wh.URL, "domain", domain, "error", err.Error())
+				s.writeDeadLetter(WebhookDeadLetter{
+					Time:     time.Now().UTC(),
+					URL:      wh.URL,
+					Attempts: attempts,
+					Error:    err.Error(),
+					Payload:  p,
+				})
+			}
+		}()
+	}
+}
+
+// getWebhookCtx returns the context which is cancelled by
+// [Server.stopWebhooks()].
+func (s *Server) getWebhookCtx() context.Context {
+	s.webhookOnce.Do(func() {
+		s.webhookCtx, s.webhookCancel = context.WithCancel(context.Background())
+	})
+	return s.webhookCtx
+}
+
+// stopWebhooks stops retrying the deliveries in progress, so that each is
+// written to the dead letter log once its current attempt fails, and waits
+// for them to finish or for ctx to be done.
+func (s *Server) stopWebhooks(ctx context.Context) error {
+	s.getWebhookCtx()
+	s.webhookCancel()
+
+	done := make(chan struct{})
+	go func() {
+		s.webhookWG.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("webhook deliveries still in progress: %w", ctx.Err())
+	}
+}
+
+func (s *Server) writeDeadLetter(d WebhookDeadLetter) {
+	p := s.getWebhookDeadLetterFile()
+	if p == "" {
+		return
+	}
+	s.deadLetterMu.Lock()
+	defer s.deadLetterMu.Unlock()
+	if err := appendJSONLine(p, d); err != nil {
+		slog.Error("failed to write webhook dead letter log", "path", p, "error", err.Error())
+	}
+}
+
+func (s *Server) getWebhookDeadLetterFile() string {
+	if s.WebhookDeadLetterFile != "" {
+		return s.WebhookDeadLetterFile
+	}
+	if s.HostsFile != "" {
+		return path.Join(path.Dir(s.HostsFile), DefaultWebhookDeadLetterFileName)
+	}
+	if s.StorePath != "" {
+		return path.Join(path.Dir(s.StorePath), DefaultWebhookDeadLetterFileName)
+	}
+	return ""
+}
@@ -0,0 +1,125 @@
+package ddns
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhooks(t *testing.T) {
+	webhookRetryDelay = time.Millisecond
+
+	mu := sync.Mutex{}
+	received := []WebhookPayload{}
+	failures := 1
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		// The first attempt fails, to check that it is retried
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		wh := &Webhook{Secret: "secret"}
+		if got := r.Header.Get(WebhookSignatureHeader); got != wh.Sign(body) {
+			t.Errorf("incorrect signature: %s", got)
+		}
+		p := WebhookPayload{}
+		if err := json.Unmarshal(body, &p); err != nil {
+			t.Error(err)
+		}
+		received = append(received, p)
+	}))
+	defer hook.Close()
+
+	dir := t.TempDir()
+	s := &Server{
+		HostsFile:      filepath.Join(dir, "hosts.yaml"),
+		AllowedAPIKeys: APIKeyMatcher{"mykey": nil},
+		Webhooks: []*Webhook{
+			{URL: hook.URL, Secret: "secret", Domains: regexp.MustCompile(`^home\.com$`)},
+			{URL: "http://127.0.0.1:1/unreachable", MaxAttempts: 2},
+		},
+	}
+	ts := httptest.NewServer(s.handler())
+	defer ts.Close()
+	a := &Agent{ServerAddress: ts.URL, APIKey: "mykey"}
+
+	a.UpdateIP(context.Background(), "home.com", "1.2.3.4")
+	a.UpdateIP(context.Background(), "home.com", "1.2.3.4") // unchanged, no webhook
+	a.UpdateIP(context.Background(), "work.com", "5.6.7.8") // filtered out for the first webhook
+	s.webhookWG.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 1 {
+		t.Fatalf("expected 1 delivery, got: %+v", received)
+	}
+	p := received[0]
+	if p.Event != WebhookEventUpdated || p.Domain != "home.com" || p.OldIP != nil || p.NewIP.String() != "1.2.3.4" || p.KeyID == "" {
+		t.Fatalf("incorrect payload: %+v", p)
+	}
+
+	// Both deliveries to the unreachable webhook are dead letters
+	b, err := os.ReadFile(filepath.Join(dir, DefaultWebhookDeadLetterFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := 0
+	for _, line := range bytes.Split(bytes.TrimSpace(b), []byte("\n")) {
+		d := WebhookDeadLetter{}
+		if err := json.Unmarshal(line, &d); err != nil {
+			t.Fatal(err)
+		}
+		if d.Attempts != 2 || d.Error == "" {
+			t.Fatalf("incorrect dead letter: %+v", d)
+		}
+		lines++
+	}
+	if lines != 2 {
+		t.Fatalf("expected 2 dead letters, got: %d", lines)
+	}
+}
+
+func TestWebhooksStop(t *testing.T) {
+	webhookRetryDelay = time.Hour
+
+	dir := t.TempDir()
+	s := &Server{
+		HostsFile: filepath.Join(dir, "hosts.yaml"),
+		Webhooks:  []*Webhook{{URL: "http://127.0.0.1:1/unreachable"}},
+	}
+	s.notify(&APIKey{ID: "key"}, WebhookEventUpdated, "home.com", nil, nil)
+
+	// The delivery is waiting to be retried, and is written to the dead letter
+	// log instead
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.stopWebhooks(ctx); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, DefaultWebhookDeadLetterFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := WebhookDeadLetter{}
+	if err := json.Unmarshal(b, &d); err != nil {
+		t.Fatal(err)
+	}
+	if d.Attempts != 1 || d.Payload.Domain != "home.com" {
+		t.Fatalf("incorrect dead letter: %+v", d)
+	}
+}
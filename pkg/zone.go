@@ -0,0 +1,145 @@
+package ddns
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Default SOA timers used when exporting a zone, in seconds.
+const (
+	DefaultZoneRefresh = 3600
+	DefaultZoneRetry   = 900
+	DefaultZoneExpire  = 1209600
+	DefaultZoneMinTTL  = 60
+)
+
+// ZoneConfig describes the zone served by the server. It is used to add SOA
+// and NS records when exporting records as a zone file.
+type ZoneConfig struct {
+	// Origin is the name of the zone, such as "myddns.com".
+	Origin string
+
+	// Nameservers are the names of the authoritative nameservers for the zone.
+	// The first one is used as the primary nameserver in the SOA record.
+	Nameservers []string
+
+	// Hostmaster is the email address of the person responsible for the zone.
+	// If not set, "hostmaster@<origin>" is used.
+	Hostmaster string
+
+	// TTL is the TTL of exported records. The DNS server answers with a TTL of
+	// zero, so that changes take effect immediately.
+	TTL uint32
+}
+
+// ExportZone writes domains as an RFC 1035 master file. If zone is not nil and
+// has an origin, SOA and NS records are included, and domains outside of the
+// zone are left out.
+func ExportZone(w io.Writer, domains Domains, zone *ZoneConfig) error {
+	if zone == nil {
+		zone = &ZoneConfig{}
+	}
+	origin := ""
+	if zone.Origin != "" {
+		origin = dns.Fqdn(zone.Origin)
+	}
+
+	rrs := []dns.RR{}
+	if origin != "" {
+		fmt.Fprintf(w, "$ORIGIN %s\n", origin)
+		if len(zone.Nameservers) > 0 {
+			rrs = append(rrs, zone.soa())
+		}
+		for _, ns := range zone.Nameservers {
+			rrs = append(rrs, &dns.NS{Hdr: zone.header(origin, dns.TypeNS), Ns: dns.Fqdn(ns)})
+		}
+	}
+
+	names := make([]string, 0, len(domains))
+	for domain := range domains {
+		names = append(names, domain)
+	}
+	slices.Sort(names)
+	for _, domain := range names {
+		name := dns.Fqdn(domain)
+		if origin != "" && !dns.IsSubDomain(origin, name) {
+			slog.Warn("skipping record outside of zone", "domain", domain, "zone", zone.Origin)
+			continue
+		}
+		ip := domains[domain]
+		if ip.To4() != nil {
+			rrs = append(rrs, &dns.A{Hdr: zone.header(name, dns.TypeA), A: ip})
+		} else {
+			rrs = append(rrs, &dns.AAAA{Hdr: zone.header(name, dns.TypeAAAA), AAAA: ip})
+		}
+	}
+
+	for _, rr := range rrs {
+		if _, err := fmt.Fprintln(w, rr.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportZone parses a zone file and returns the A and AAAA records it contains.
+// Relative names are resolved against origin, unless the file sets $ORIGIN.
+// Since each domain has a single IP, only the first A or AAAA record for a
+// name is used. All other records are returned as skipped.
+func ImportZone(r io.Reader, origin string) (domains Domains, skipped []dns.RR, err error) {
+	if origin != "" {
+		origin = dns.Fqdn(origin)
+	}
+	domains = Domains{}
+	zp := dns.NewZoneParser(r, origin, "")
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		var ip net.IP
+		switch v := rr.(type) {
+		case *dns.A:
+			ip = v.A
+		case *dns.AAAA:
+			ip = v.AAAA
+		}
+		domain := strings.ToLower(strings.TrimSuffix(rr.Header().Name, "."))
+		if _, exists := domains[domain]; ip == nil || exists {
+			skipped = append(skipped, rr)
+			continue
+		}
+		domains[domain] = ip
+	}
+	if err := zp.Err(); err != nil {
+		return nil, nil, err
+	}
+	return domains, skipped, nil
+}
+
+func (z *ZoneConfig) header(name string, rrtype uint16) dns.RR_Header {
+	return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: z.TTL}
+}
+
+func (z *ZoneConfig) soa() *dns.SOA {
+	origin := dns.Fqdn(z.Origin)
+	mbox := "hostmaster." + origin
+	if z.Hostmaster != "" {
+		// The local part of the address is the first label, with dots escaped
+		local, domain, _ := strings.Cut(z.Hostmaster, "@")
+		mbox = strings.ReplaceAll(local, ".", `\.`) + "." + dns.Fqdn(domain)
+	}
+	return &dns.SOA{
+		Hdr:     z.header(origin, dns.TypeSOA),
+		Ns:      dns.Fqdn(z.Nameservers[0]),
+		Mbox:    mbox,
+		Serial:  uint32(time.Now().Unix()),
+		Refresh: DefaultZoneRefresh,
+		Retry:   DefaultZoneRetry,
+		Expire:  DefaultZoneExpire,
+		Minttl:  DefaultZoneMinTTL,
+	}
+}
@@ -0,0 +1,90 @@
+package ddns
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/go-test/deep"
+	"github.com/miekg/dns"
+)
+
+func TestExportZone(t *testing.T) {
+	domains := Domains{
+		"home.myddns.com": net.ParseIP("1.2.3.4"),
+		"v6.myddns.com":   net.ParseIP("2001:db8::1"),
+		"other.com":       net.ParseIP("5.6.7.8"),
+	}
+	zone := &ZoneConfig{
+		Origin:      "myddns.com",
+		Nameservers: []string{"ns1.server.com", "ns2.server.com"},
+		Hostmaster:  "john.doe@server.com",
+		TTL:         300,
+	}
+
+	b := &bytes.Buffer{}
+	if err := ExportZone(b, domains, zone); err != nil {
+		t.Fatal(err)
+	}
+
+	// The output can be parsed again, and out of zone records are skipped
+	zp := dns.NewZoneParser(b, "", "")
+	types := []string{}
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		types = append(types, dns.TypeToString[rr.Header().Rrtype]+" "+rr.Header().Name)
+		if rr.Header().Ttl != 300 {
+			t.Fatalf("incorrect TTL for %s", rr)
+		}
+		if soa, ok := rr.(*dns.SOA); ok && soa.Mbox != `john\.doe.server.com.` {
+			t.Fatalf(`incorrect SOA mbox, got: "%s"`, soa.Mbox)
+		}
+	}
+	if err := zp.Err(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"SOA myddns.com.",
+		"NS myddns.com.",
+		"NS myddns.com.",
+		"A home.myddns.com.",
+		"AAAA v6.myddns.com.",
+	}
+	if diff := deep.Equal(types, expected); diff != nil {
+		t.Fatalf("incorrect records exported: %v", diff)
+	}
+}
+
+func TestImportZone(t *testing.T) {
+	zone := `$TTL 3600
+@       IN SOA  ns1.server.com. hostmaster.myddns.com. 1 3600 900 1209600 60
+@       IN NS   ns1.server.com.
+home    IN A    1.2.3.4
+home    IN AAAA 2001:db8::1
+V6      IN AAAA 2001:db8::2
+www.other.com. IN A 5.6.7.8
+mail    IN MX   10 home
+`
+	domains, skipped, err := ImportZone(strings.NewReader(zone), "myddns.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := Domains{
+		"home.myddns.com": net.ParseIP("1.2.3.4"),
+		"v6.myddns.com":   net.ParseIP("2001:db8::2"),
+		"www.other.com":   net.ParseIP("5.6.7.8"),
+	}
+	if diff := deep.Equal(domains, expected); diff != nil {
+		t.Fatalf("incorrect records imported: %v", diff)
+	}
+
+	// SOA, NS, the second record for home and MX
+	if len(skipped) != 4 {
+		t.Fatalf("expected 4 skipped records, got: %v", skipped)
+	}
+
+	if _, _, err := ImportZone(strings.NewReader("home IN A notanip\n"), "myddns.com"); err == nil {
+		t.Fatalf("expected error for invalid zone file")
+	}
+}